@@ -26,7 +26,7 @@ func addBalancesListCmd() *cobra.Command {
 			defer s.Close()
 
 			res := fmt.Sprintf("Account balances at: %s\n", hex.EncodeToString([]byte(s.GetLastHash()[:])))
-			for acc, val := range s.Balances {
+			for acc, val := range s.Balance() {
 				res += "-----\n"
 				res += fmt.Sprintf("%s : %d\n", acc, val)
 				res += "-----\n"
@@ -26,8 +26,8 @@ func addMigrationCmd() *cobra.Command {
 			}()
 
 			pendingBlock0 := node.NewPendingBlock(database.Hash{}, 0, []database.SignedTx{
-				*database.NewSignedTx(*database.NewTx(minerAcc, minerAcc, "", 3), []byte{}),
-				*database.NewSignedTx(*database.NewTx(minerAcc, minerAcc, "reward", 700), []byte{}),
+				*database.NewSignedTx(*database.NewTx(minerAcc, minerAcc, "", 3, 1), []byte{}),
+				*database.NewSignedTx(*database.NewTx(minerAcc, minerAcc, "reward", 700, 2), []byte{}),
 			}, minerAcc)
 			block0, err := node.Mine(cmd.Context(), pendingBlock0)
 			if err != nil {
@@ -41,12 +41,12 @@ func addMigrationCmd() *cobra.Command {
 			fmt.Printf("parent block hash: %x\n", block0.Header.ParentHash)
 
 			pendingBlock1 := node.NewPendingBlock(block0Hash, 1, []database.SignedTx{
-				*database.NewSignedTx(*database.NewTx(minerAcc, database.NewAccount("c9849c4f99c1a4a8fa57f0a6032f5e094acadeab"), "", 2000), []byte{}),
-				*database.NewSignedTx(*database.NewTx(minerAcc, minerAcc, "reward", 100), []byte{}),
-				*database.NewSignedTx(*database.NewTx(database.NewAccount("c9849c4f99c1a4a8fa57f0a6032f5e094acadeab"), minerAcc, "", 1), []byte{}),
-				*database.NewSignedTx(*database.NewTx(database.NewAccount("c9849c4f99c1a4a8fa57f0a6032f5e094acadeab"), minerAcc, "", 50), []byte{}),
-				*database.NewSignedTx(*database.NewTx(minerAcc, minerAcc, "reward", 600), []byte{}),
-				*database.NewSignedTx(*database.NewTx(minerAcc, minerAcc, "reward", 2600), []byte{}),
+				*database.NewSignedTx(*database.NewTx(minerAcc, database.NewAccount("c9849c4f99c1a4a8fa57f0a6032f5e094acadeab"), "", 2000, 3), []byte{}),
+				*database.NewSignedTx(*database.NewTx(minerAcc, minerAcc, "reward", 100, 4), []byte{}),
+				*database.NewSignedTx(*database.NewTx(database.NewAccount("c9849c4f99c1a4a8fa57f0a6032f5e094acadeab"), minerAcc, "", 1, 1), []byte{}),
+				*database.NewSignedTx(*database.NewTx(database.NewAccount("c9849c4f99c1a4a8fa57f0a6032f5e094acadeab"), minerAcc, "", 50, 2), []byte{}),
+				*database.NewSignedTx(*database.NewTx(minerAcc, minerAcc, "reward", 600, 5), []byte{}),
+				*database.NewSignedTx(*database.NewTx(minerAcc, minerAcc, "reward", 2600, 6), []byte{}),
 			}, minerAcc)
 
 			block1, err := node.Mine(cmd.Context(), pendingBlock1)
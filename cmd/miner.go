@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"taraskrasiuk/blockchain_l/internal/node"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/spf13/cobra"
+)
+
+const DEFAULT_WORK_POLL = 5 * time.Second
+
+func addMinerCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "miner",
+		Short: "Mine the work of a running node",
+		Run: func(cmd *cobra.Command, args []string) {
+			var (
+				host, _    = cmd.Flags().GetString("host")
+				port, _    = cmd.Flags().GetUint("port")
+				miner, _   = cmd.Flags().GetString("miner")
+				threads, _ = cmd.Flags().GetInt("threads")
+				poll, _    = cmd.Flags().GetDuration("poll")
+			)
+			var coinbase common.Address
+			if miner != "" {
+				coinbase = database.NewAccount(miner)
+			}
+			fmt.Printf("Mining the work of the node %s:%d with %d threads\n", host, port, threads)
+			if err := runMiner(cmd.Context(), node.NewWorkClient(host, port), coinbase, threads, poll); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	cmd.Flags().String("host", DEFAULT_HOST, "The host of the node")
+	cmd.Flags().Uint("port", DEFAULT_PORT, "The http port of the node")
+	cmd.Flags().String("miner", "", "The miner account address, the node's miner by default")
+	cmd.Flags().Int("threads", node.MINER_THREADS, "The number of the mining workers")
+	cmd.Flags().Duration("poll", DEFAULT_WORK_POLL, "How often the node is polled for the new work")
+	return cmd
+}
+
+// Mine the work of the node until the context is done. The mining of the work is canceled,
+// when the node moves to another block.
+func runMiner(ctx context.Context, client *node.WorkClient, coinbase common.Address, threads int, poll time.Duration) error {
+	for ctx.Err() == nil {
+		work, err := client.GetWork(ctx, coinbase)
+		if err != nil {
+			// no pending transactions or the node isn't reachable
+			select {
+			case <-time.After(poll):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		fmt.Printf("Mining the block %d of work %s\n", work.Header.Number, work.WorkID)
+
+		miningCtx, cancel := context.WithCancel(ctx)
+		go watchWork(miningCtx, cancel, client, coinbase, work, poll)
+		header, err := node.MineHeader(miningCtx, work.Header, threads)
+		cancel()
+		if err != nil {
+			fmt.Printf("Stopped mining work %s: %v\n", work.WorkID, err)
+			continue
+		}
+		res, err := client.SubmitWork(ctx, node.SubmitWorkReq{
+			WorkID:     work.WorkID,
+			Nonce:      header.Nonce,
+			ExtraNonce: header.ExtraNonce,
+			Time:       header.Time,
+		})
+		if err != nil {
+			fmt.Printf("The solution of work %s is rejected: %v\n", work.WorkID, err)
+			continue
+		}
+		fmt.Printf("Mined the block %d %s\n", header.Number, res.Hash)
+	}
+	return nil
+}
+
+// Cancel the mining, when the work of the node is built on another block.
+func watchWork(ctx context.Context, cancel context.CancelFunc, client *node.WorkClient, coinbase common.Address, work node.WorkRes, poll time.Duration) {
+	t := time.NewTicker(poll)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			latest, err := client.GetWork(ctx, coinbase)
+			if err != nil || latest.Header.ParentHash != work.Header.ParentHash {
+				cancel()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func addMiningCmd() *cobra.Command {
+	var miningCmd = &cobra.Command{
+		Use:   "mining",
+		Short: "Control the mining of a running node ( start, stop, coinbase, threads )",
+	}
+	miningCmd.PersistentFlags().String("host", DEFAULT_HOST, "The host of the node, the admin API accepts the loopback addresses only")
+	miningCmd.PersistentFlags().Uint("port", DEFAULT_PORT, "The http port of the node")
+
+	run := func(call func(ctx context.Context, c *node.MiningAdminClient) (node.MiningStatusRes, error)) func(cmd *cobra.Command, args []string) {
+		return func(cmd *cobra.Command, args []string) {
+			var (
+				host, _ = cmd.Flags().GetString("host")
+				port, _ = cmd.Flags().GetUint("port")
+			)
+			status, err := call(cmd.Context(), node.NewMiningAdminClient(host, port))
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Mining enabled: %t\nMining a block: %t\nCoinbase: %s\nThreads: %d\n",
+				status.Enabled, status.Mining, status.Coinbase, status.Threads)
+		}
+	}
+
+	miningCmd.AddCommand(&cobra.Command{
+		Use:   "start",
+		Short: "Start mining the pending transactions",
+		Run: run(func(ctx context.Context, c *node.MiningAdminClient) (node.MiningStatusRes, error) {
+			return c.Start(ctx)
+		}),
+	})
+	miningCmd.AddCommand(&cobra.Command{
+		Use:   "stop",
+		Short: "Stop mining, the node keeps relaying the blocks and the transactions",
+		Run: run(func(ctx context.Context, c *node.MiningAdminClient) (node.MiningStatusRes, error) {
+			return c.Stop(ctx)
+		}),
+	})
+	miningCmd.AddCommand(&cobra.Command{
+		Use:   "coinbase [address]",
+		Short: "Change the address rewarded for the mined blocks",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			run(func(ctx context.Context, c *node.MiningAdminClient) (node.MiningStatusRes, error) {
+				return c.SetCoinbase(ctx, database.NewAccount(args[0]))
+			})(cmd, args)
+		},
+	})
+	miningCmd.AddCommand(&cobra.Command{
+		Use:   "threads [number]",
+		Short: "Set the number of the mining workers",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			threads, err := strconv.Atoi(args[0])
+			if err != nil || threads <= 0 {
+				log.Fatalf("invalid number of the threads %s", args[0])
+			}
+			run(func(ctx context.Context, c *node.MiningAdminClient) (node.MiningStatusRes, error) {
+				return c.SetThreads(ctx, threads)
+			})(cmd, args)
+		},
+	})
+	return miningCmd
+}
@@ -26,4 +26,6 @@ func init() {
 	rootCmd.AddCommand(addMigrationCmd())
 	rootCmd.AddCommand(addNodeCmd())
 	rootCmd.AddCommand(addWalletCmd())
+	rootCmd.AddCommand(addMinerCmd())
+	rootCmd.AddCommand(addMiningCmd())
 }
@@ -3,6 +3,9 @@ package cmd
 import (
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"taraskrasiuk/blockchain_l/internal/database"
 	"taraskrasiuk/blockchain_l/internal/node"
 	"taraskrasiuk/blockchain_l/internal/server"
@@ -12,36 +15,90 @@ import (
 
 const (
 	DEFAULT_PORT              = 8080
+	DEFAULT_P2P_PORT          = 9080
 	DEFAULT_HOST              = "localhost"
 	BOOTSTRAP_NODE_BY_DEFAULT = false
 )
 
-func runBootstrapNode(cmd *cobra.Command, datadir, host string, port uint, miner string) error {
-	srv := server.NewNodeServer(node.NewNode(datadir, port, host, nil, database.NewAccount(miner), true), port)
+func runBootstrapNode(cmd *cobra.Command, datadir, host string, port, p2pPort uint, miner string) error {
+	n := node.NewNode(datadir, port, host, nil, database.NewAccount(miner), true)
+	n.SetP2PPort(p2pPort)
+	configureNode(cmd, n)
+	srv := server.NewNodeServer(n, port)
 
 	return srv.Run(cmd.Context())
 }
 
-func runPeerNode(cmd *cobra.Command, datadir, host string, port uint, miner string) error {
-	bootstrapIp, err := cmd.Flags().GetString("bootstrapIp")
+func runPeerNode(cmd *cobra.Command, datadir, host string, port, p2pPort uint, miner string) error {
+	bootstraps, err := bootstrapPeers(cmd)
 	if err != nil {
 		return err
 	}
-	bootstrapPort, err := cmd.Flags().GetUint("bootstrapPort")
-	if err != nil {
-		return err
+	if len(bootstraps) == 0 {
+		return fmt.Errorf("no bootstrap nodes defined, use --bootstrapIp, --bootstrapNodes or --bootstrapConfig")
+	}
+	for _, b := range bootstraps {
+		fmt.Printf("successfully added the bootstrap node with ip %s and port %d \n", b.IP, b.Port)
 	}
-	// set an ip of extrenal node
-	boostrap := node.NewPeerNode(bootstrapIp, bootstrapPort, true, false)
-	fmt.Printf("successfully added the bootstrap node with ip %s and port %d \n", bootstrapIp, bootstrapPort)
 
-	srv := server.NewNodeServer(node.NewNode(datadir, port, host, boostrap, database.NewAccount(miner), true), port)
+	n := node.NewNode(datadir, port, host, &bootstraps[0], database.NewAccount(miner), true)
+	for _, b := range bootstraps[1:] {
+		n.AddBootstrapPeer(b)
+	}
+	n.SetP2PPort(p2pPort)
+	configureNode(cmd, n)
+	srv := server.NewNodeServer(n, port)
 	if err := srv.Run(cmd.Context()); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Apply the optional node settings of the run flags.
+func configureNode(cmd *cobra.Command, n *node.Node) {
+	if rotation, _ := cmd.Flags().GetDuration("txJournalRotation"); rotation > 0 {
+		n.SetTxJournalRotation(rotation)
+	}
+	if threads, _ := cmd.Flags().GetInt("minerThreads"); threads > 0 {
+		n.SetMinerThreads(threads)
+	}
+	if mine, _ := cmd.Flags().GetBool("mine"); !mine {
+		n.StopMining()
+	}
+}
+
+// Collect the bootstrap nodes from the --bootstrapIp, --bootstrapNodes and --bootstrapConfig flags.
+func bootstrapPeers(cmd *cobra.Command) ([]node.PeerNode, error) {
+	var (
+		bootstrapIp, _      = cmd.Flags().GetString("bootstrapIp")
+		bootstrapPort, _    = cmd.Flags().GetUint("bootstrapPort")
+		bootstrapP2PPort, _ = cmd.Flags().GetUint("bootstrapP2PPort")
+		bootstrapNodes, _   = cmd.Flags().GetStringSlice("bootstrapNodes")
+		bootstrapConfig, _  = cmd.Flags().GetString("bootstrapConfig")
+	)
+	var res []node.PeerNode
+	if bootstrapIp != "" {
+		bootstrap := node.NewPeerNode(bootstrapIp, bootstrapPort, true, false)
+		bootstrap.P2PPort = bootstrapP2PPort
+		res = append(res, *bootstrap)
+	}
+	for _, addr := range bootstrapNodes {
+		bootstrap, err := node.ParseBootstrapPeer(addr, bootstrapP2PPort)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, bootstrap)
+	}
+	if bootstrapConfig != "" {
+		fromConfig, err := node.LoadBootstrapConfig(bootstrapConfig, bootstrapP2PPort)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, fromConfig...)
+	}
+	return res, nil
+}
+
 func addRunCmd() *cobra.Command {
 	var cmd = &cobra.Command{
 		Use:   "run",
@@ -50,35 +107,63 @@ func addRunCmd() *cobra.Command {
 			var (
 				datadir, _     = cmd.Flags().GetString("dir")
 				port, _        = cmd.Flags().GetUint("port")
+				p2pPort, _     = cmd.Flags().GetUint("p2pPort")
 				host, _        = cmd.Flags().GetString("host")
 				isBootstrap, _ = cmd.Flags().GetBool("bootstrap")
 				miner, _       = cmd.Flags().GetString("miner")
+				compression, _ = cmd.Flags().GetString("compression")
 			)
 
+			// stop the node gracefully on SIGINT or SIGTERM
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			cmd.SetContext(ctx)
+
+			// without the flag the node keeps the codec the blocks db is written with
+			if compression != "" {
+				blocksCompression, err := database.ParseCompression(compression)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if err := database.SetBlocksCompression(datadir, blocksCompression); err != nil {
+					log.Fatal(err)
+				}
+			}
+
 			if isBootstrap {
 				fmt.Printf("Running a bootstrap node %s and port %d\n", datadir, port)
-				if err := runBootstrapNode(cmd, datadir, host, port, miner); err != nil {
+				if err := runBootstrapNode(cmd, datadir, host, port, p2pPort, miner); err != nil {
 					log.Fatal(err)
 				}
 			} else {
 				fmt.Printf("Running a peer node with dir: %s, host %s and port %d\n", datadir, host, port)
-				if err := runPeerNode(cmd, datadir, host, port, miner); err != nil {
+				if err := runPeerNode(cmd, datadir, host, port, p2pPort, miner); err != nil {
 					log.Fatal(err)
 				}
 			}
+			fmt.Println("The node is stopped")
 		},
 	}
 
 	addRequiredArg(cmd)
 	cmd.Flags().Uint("port", DEFAULT_PORT, "Define the port number")
 	cmd.MarkFlagRequired("port")
+	cmd.Flags().Uint("p2pPort", DEFAULT_P2P_PORT, "Define the port of the node-to-node protocol, 0 disables it")
 	cmd.Flags().String("host", DEFAULT_HOST, "Define a host")
 	cmd.MarkFlagRequired("host")
 	cmd.Flags().String("miner", "", "define the miner account address")
 	cmd.MarkFlagRequired("miner")
 
+	cmd.Flags().String("compression", "", "The blocks db compression: none, snappy or zstd. Can be changed only for an empty db, the stored one is kept by default")
+
 	cmd.Flags().Bool("bootstrap", BOOTSTRAP_NODE_BY_DEFAULT, "Is running a bootstrap node or not")
 	cmd.Flags().String("bootstrapIp", "", "The ip of the bootstrap node")
 	cmd.Flags().Uint("bootstrapPort", DEFAULT_PORT, "The bootstrap node port")
+	cmd.Flags().Uint("bootstrapP2PPort", DEFAULT_P2P_PORT, "The bootstrap node p2p port, 0 if it doesn't run the p2p protocol")
+	cmd.Flags().StringSlice("bootstrapNodes", nil, "The comma separated bootstrap nodes in the form of ip:port or ip:port:p2pPort")
+	cmd.Flags().Bool("mine", true, "Mine the pending transactions, a relay node doesn't mine")
+	cmd.Flags().Int("minerThreads", node.MINER_THREADS, "The number of the mining workers")
+	cmd.Flags().Duration("txJournalRotation", node.TX_JOURNAL_ROTATION, "How often the pending transactions journal is compacted")
+	cmd.Flags().String("bootstrapConfig", "", "The json file listing the bootstrap nodes, {\"bootstrap_nodes\": [\"ip:port:p2pPort\"]}")
 	return cmd
 }
@@ -41,14 +41,14 @@ func txAddCmd() *cobra.Command {
 			fromAcc := database.NewAccount(from)
 			toAcc := database.NewAccount(to)
 
-			tx := database.NewTx(fromAcc, toAcc, data, value)
-			signedTx := database.NewSignedTx(*tx, []byte{})
 			s, err := database.NewState(dirname, true)
 			if err != nil {
 				log.Fatal(err)
 				return
 			}
 			defer s.Close()
+			tx := database.NewTx(fromAcc, toAcc, data, value, s.NextAccountNonce(fromAcc))
+			signedTx := database.NewSignedTx(*tx, []byte{})
 
 			pendingBlock := node.NewPendingBlock(*s.GetLastHash(), s.NextBlockNumber(), []database.SignedTx{*signedTx}, database.NewAccount("miner"))
 			miningCtx, cancel := context.WithTimeout(cmd.Context(), 5*time.Minute)
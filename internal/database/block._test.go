@@ -3,6 +3,7 @@ package database
 import (
 	"encoding/hex"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -50,3 +51,121 @@ func TestValidBlock(t *testing.T) {
 		t.Fatal("the hash is not correct")
 	}
 }
+
+func TestValidateBlockLimits(t *testing.T) {
+	block := NewBlock(Hash{}, 1, 0, []SignedTx{createTx("from", "to", 100)}, NewAccount("miner"))
+	if err := ValidateBlockLimits(block); err != nil {
+		t.Fatalf("expected a small block to be valid, got %v", err)
+	}
+
+	txWithLongData := createTx("from", "to", 100)
+	txWithLongData.Data = strings.Repeat("a", MaxTxDataLen+1)
+	block = NewBlock(Hash{}, 1, 0, []SignedTx{txWithLongData}, NewAccount("miner"))
+	if err := ValidateBlockLimits(block); err == nil {
+		t.Fatal("expected an error for the transaction data over the limit")
+	}
+
+	txs := make([]SignedTx, MaxBlockTXs+1)
+	for i := range txs {
+		txs[i] = createTx("from", "to", uint(i))
+	}
+	block = NewBlock(Hash{}, 1, 0, txs, NewAccount("miner"))
+	if err := ValidateBlockLimits(block); err == nil {
+		t.Fatal("expected an error for the transactions count over the limit")
+	}
+}
+
+func TestBlockHash_CommitsToPayload(t *testing.T) {
+	txs := []SignedTx{createTx("from", "to", 100), createTx("from", "to", 200), createTx("from", "to", 300)}
+	block := NewBlock(Hash{}, 1, 0, txs, NewAccount("miner"))
+	if err := ValidateTxRoot(block); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := block.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerHash, err := block.Header.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != headerHash {
+		t.Fatal("expected the block hash to be the header hash")
+	}
+
+	tampered := block
+	tampered.Payload = append([]SignedTx{}, txs...)
+	tampered.Payload[2].Value = 301
+	if err := ValidateTxRoot(tampered); err == nil {
+		t.Fatal("expected the tampered payload to mismatch the tx root")
+	}
+	if TxRoot(nil) != (Hash{}) {
+		t.Fatal("expected the zero root for an empty payload")
+	}
+}
+
+// Search the nonce, which satisfies the proof of work.
+func mineTestHeader(t *testing.T, h BlockHeader) (BlockHeader, Hash) {
+	for nonce := uint32(0); nonce < 1<<24; nonce++ {
+		h.Nonce = nonce
+		hash, err := h.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if IsValidBlock(hash) {
+			return h, hash
+		}
+	}
+	t.Fatal("could not mine the test header")
+	return h, Hash{}
+}
+
+func TestValidateHeader(t *testing.T) {
+	now := time.Now()
+	parent := Hash{1}
+	header, hash := mineTestHeader(t, BlockHeader{ParentHash: parent, Number: 5, Time: uint64(now.Unix())})
+
+	got, err := ValidateHeader(header, parent, 4, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != hash {
+		t.Fatalf("expected the header hash %s, got %s", hash, got)
+	}
+	if _, err := ValidateHeader(header, Hash{2}, 4, now); err == nil {
+		t.Fatal("expected a header with another parent to be rejected")
+	}
+	if _, err := ValidateHeader(header, parent, 5, now); err == nil {
+		t.Fatal("expected a header with a wrong number to be rejected")
+	}
+	if _, err := ValidateHeader(header, parent, 4, now.Add(-3*MaxFutureBlockTime)); err == nil {
+		t.Fatal("expected a header from the future to be rejected")
+	}
+	unmined := header
+	unmined.Nonce++
+	if h, _ := unmined.Hash(); !IsValidBlock(h) {
+		if _, err := ValidateHeader(unmined, parent, 4, now); err == nil {
+			t.Fatal("expected a header without the proof of work to be rejected")
+		}
+	}
+}
+
+func TestNonceHasher(t *testing.T) {
+	block := NewBlock(Hash{1}, 7, 0, nil, NewAccount("miner"))
+	hasher, err := NewNonceHasher(block.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf []byte
+	for _, nonce := range []uint32{0, 1, 10, 4294967295} {
+		block.Header.Nonce = nonce
+		expected, err := block.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hash Hash
+		if hash, buf = hasher.Hash(nonce, buf); hash != expected {
+			t.Fatalf("unexpected hash of the nonce %d", nonce)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package database
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -12,7 +15,7 @@ import (
 
 type Hash [32]byte
 
-func (h *Hash) MarshalText() ([]byte, error) {
+func (h Hash) MarshalText() ([]byte, error) {
 	return []byte(hex.EncodeToString(h[:])), nil
 }
 
@@ -25,6 +28,11 @@ func (h Hash) String() string {
 	return hex.EncodeToString(h[:])
 }
 
+// The zero hash is the parent of the first block.
+func (h Hash) IsEmpty() bool {
+	return h == Hash{}
+}
+
 type Block struct {
 	Header  BlockHeader `json:"header"`
 	Payload []SignedTx  `json:"payload"`
@@ -37,6 +45,7 @@ func NewBlock(parentHash Hash, num uint64, nonce uint32, payload []SignedTx, min
 		Time:       uint64(time.Now().Unix()),
 		Nonce:      nonce,
 		Miner:      miner,
+		TxRoot:     TxRoot(payload),
 	}
 	return Block{
 		Header:  h,
@@ -50,14 +59,108 @@ type BlockHeader struct {
 	Nonce      uint32         `json:"nonce"`
 	Time       uint64         `json:"time"`
 	Miner      common.Address `json:"miner"`
+	// the merkle root of the payload, it binds the payload to the header
+	TxRoot Hash `json:"txRoot"`
+	// extends the nonce space, when all the nonces of the header are tried
+	ExtraNonce uint32 `json:"extraNonce,omitempty"`
+}
+
+func (h BlockHeader) Hash() (Hash, error) {
+	headerJson, err := json.Marshal(h)
+	if err != nil {
+		return Hash{}, err
+	}
+	return sha256.Sum256(headerJson), nil
+}
+
+// NonceHasher hashes the header with different nonces. The rest of the header is encoded once,
+// so the miner doesn't encode the whole header on every attempt.
+type NonceHasher struct {
+	prefix []byte
+	suffix []byte
+}
+
+func NewNonceHasher(h BlockHeader) (*NonceHasher, error) {
+	h.Nonce = 0
+	headerJson, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	field := []byte(`"nonce":0,`)
+	i := bytes.Index(headerJson, field)
+	if i < 0 {
+		return nil, errors.New("could not find the nonce in the encoded header")
+	}
+	i += len(field) - 2
+	return &NonceHasher{prefix: headerJson[:i], suffix: headerJson[i+1:]}, nil
 }
 
+// The hash of the header with the nonce, the same as BlockHeader.Hash. The buffer is reused between the calls.
+func (nh *NonceHasher) Hash(nonce uint32, buf []byte) (Hash, []byte) {
+	buf = append(buf[:0], nh.prefix...)
+	buf = strconv.AppendUint(buf, uint64(nonce), 10)
+	buf = append(buf, nh.suffix...)
+	return sha256.Sum256(buf), buf
+}
+
+// The block hash is the hash of the header. The header commits to the payload by the TxRoot,
+// so the headers can be validated before the payload is downloaded.
 func (b Block) Hash() (Hash, error) {
-	blockJson, err := json.Marshal(b)
+	return b.Header.Hash()
+}
+
+// The merkle root of the signed transactions. The zero hash for an empty payload.
+func TxRoot(txs []SignedTx) Hash {
+	if len(txs) == 0 {
+		return Hash{}
+	}
+	level := make([]Hash, len(txs))
+	for i, tx := range txs {
+		// a signed transaction is always JSON encodable
+		txJson, _ := json.Marshal(tx)
+		level[i] = sha256.Sum256(txJson)
+	}
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([]Hash, len(level)/2)
+		for i := range next {
+			next[i] = sha256.Sum256(append(level[2*i][:], level[2*i+1][:]...))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// Validate that the block's payload matches the header's TxRoot.
+func ValidateTxRoot(b Block) error {
+	if root := TxRoot(b.Payload); root != b.Header.TxRoot {
+		return fmt.Errorf("the block payload root %s doesn't match the header's root %s", root, b.Header.TxRoot)
+	}
+	return nil
+}
+
+// Validate the header against its parent without the payload: the number, the parent hash,
+// the proof of work and the block time. Returns the header's hash.
+func ValidateHeader(h BlockHeader, parentHash Hash, parentNumber uint64, now time.Time) (Hash, error) {
+	if h.Number != parentNumber+1 {
+		return Hash{}, fmt.Errorf("the header number is incorrect, expected to be %d got %d", parentNumber+1, h.Number)
+	}
+	if h.ParentHash != parentHash {
+		return Hash{}, fmt.Errorf("the header %d parent hash is incorrect, expected to be %s got %s", h.Number, parentHash, h.ParentHash)
+	}
+	hash, err := h.Hash()
 	if err != nil {
 		return Hash{}, err
 	}
-	return sha256.Sum256(blockJson), nil
+	if !IsValidBlock(hash) {
+		return Hash{}, fmt.Errorf("the header %d hash %s doesn't satisfy the proof of work", h.Number, hash)
+	}
+	if blockTime := time.Unix(int64(h.Time), 0); blockTime.After(now.Add(MaxFutureBlockTime)) {
+		return Hash{}, fmt.Errorf("the header %d time %s is too far in the future", h.Number, blockTime.Format(time.RFC3339))
+	}
+	return hash, nil
 }
 
 type BlockFS struct {
@@ -65,12 +168,71 @@ type BlockFS struct {
 	Value Block `json:"block"`
 }
 
+// Consensus limits for a block.
+const (
+	// The maximum size of the JSON encoded block in bytes.
+	MaxBlockSize = 1 << 20
+	// The maximum number of transactions in a block.
+	MaxBlockTXs = 2000
+	// The maximum length of the transaction's data field.
+	MaxTxDataLen = 256
+)
+
+// Validate that the block fits into the consensus limits.
+func ValidateBlockLimits(b Block) error {
+	if len(b.Payload) > MaxBlockTXs {
+		return fmt.Errorf("the block contains %d transactions, the limit is %d", len(b.Payload), MaxBlockTXs)
+	}
+	for _, tx := range b.Payload {
+		if err := ValidateTxLimits(tx.Tx); err != nil {
+			return err
+		}
+	}
+	size, err := BlockSize(b)
+	if err != nil {
+		return err
+	}
+	if size > MaxBlockSize {
+		return fmt.Errorf("the block size is %d bytes, the limit is %d bytes", size, MaxBlockSize)
+	}
+	return nil
+}
+
+// Validate that the transaction fits into the consensus limits.
+func ValidateTxLimits(tx Tx) error {
+	if len(tx.Data) > MaxTxDataLen {
+		return fmt.Errorf("the transaction data is %d bytes long, the limit is %d bytes", len(tx.Data), MaxTxDataLen)
+	}
+	if tx.Fee != 0 && tx.Fee < TxFee {
+		return fmt.Errorf("the transaction fee %d is below the minimum fee %d", tx.Fee, TxFee)
+	}
+	return nil
+}
+
+// The size of the JSON encoded block.
+func BlockSize(b Block) (int, error) {
+	blockJson, err := json.Marshal(b)
+	if err != nil {
+		return 0, err
+	}
+	return len(blockJson), nil
+}
+
+// The size of the JSON encoded transaction, as it's included into the block's payload.
+func TxSize(tx SignedTx) (int, error) {
+	txJson, err := json.Marshal(tx)
+	if err != nil {
+		return 0, err
+	}
+	return len(txJson), nil
+}
+
 // Block validation
 func IsValidBlock(h Hash) bool {
-	return fmt.Sprintf("%x", h[0]) == "0" &&
-		fmt.Sprintf("%x", h[1]) == "0" &&
-		// fmt.Sprintf("%x", h[2]) == "0" &&
-		// fmt.Sprintf("%x", h[3]) == "0" &&
+	return h[0] == 0 &&
+		h[1] == 0 &&
+		// h[2] == 0 &&
+		// h[3] == 0 &&
 		// not equal to zero
-		fmt.Sprintf("%x", h[2]) != "0"
+		h[2] != 0
 }
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestState_LocatorAndRewind(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		from = crypto.PubkeyToAddress(key.PublicKey)
+		to   = NewAccount("0x01")
+	)
+	dir := setupTestDataDir(t, map[common.Address]uint{from: 100000})
+	s, err := NewState(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var hashes []Hash
+	startTime := time.Now().Add(-5 * time.Minute)
+	for i := 1; i <= 30; i++ {
+		tx := signTestTx(t, *NewTx(from, to, "", 1, s.NextAccountNonce(from)), key)
+		block := NewBlock(*s.GetLastHash(), s.NextBlockNumber(), 0, []SignedTx{tx}, NewAccount("miner"))
+		block.Header.Time = uint64(startTime.Add(time.Duration(i) * time.Second).Unix())
+		block = mineTestBlock(t, block)
+		hash, err := s.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	locator := s.BlockLocator()
+	// 10 latest blocks, then the blocks 19, 15, 7 and the zero hash
+	if len(locator) != 14 || locator[0] != hashes[29] || locator[9] != hashes[20] || locator[10] != hashes[18] || locator[12] != hashes[6] || !locator[13].IsEmpty() {
+		t.Fatalf("unexpected locator of %d hashes", len(locator))
+	}
+	if hash, number := s.FindAncestor([]Hash{{9}, hashes[12], hashes[3]}); hash != hashes[12] || number != 13 {
+		t.Fatalf("expected the block 13 to be the ancestor, got %d", number)
+	}
+	if hash, number := s.FindAncestor([]Hash{{9}}); !hash.IsEmpty() || number != 0 {
+		t.Fatal("expected the zero hash to be the ancestor of an unknown chain")
+	}
+	if _, err := s.GetBlocksAfter(Hash{9}, dir, 0); !errors.Is(err, ErrUnknownBlock) {
+		t.Fatalf("expected an unknown block error, got %v", err)
+	}
+
+	removed, err := s.RewindTo(hashes[19], dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 10 || removed[0].Header.Number != 21 {
+		t.Fatalf("expected the blocks 21..30 to be removed, got %d", len(removed))
+	}
+	if *s.GetLastHash() != hashes[19] || s.Snapshot().Balance(to) != 20 || s.NextAccountNonce(from) != 21 {
+		t.Fatal("expected the state to match the block 20")
+	}
+	if _, ok := s.BlockNumber(hashes[20]); ok {
+		t.Fatal("expected the removed block to be unknown")
+	}
+
+	// the rewound chain is persisted and can be extended
+	tx := signTestTx(t, *NewTx(from, to, "", 1, s.NextAccountNonce(from)), key)
+	block := NewBlock(*s.GetLastHash(), s.NextBlockNumber(), 0, []SignedTx{tx}, NewAccount("miner"))
+	block.Header.Time = uint64(startTime.Add(time.Minute).Unix())
+	block = mineTestBlock(t, block)
+	if _, err := s.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	reloaded, err := NewState(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if reloaded.GetLastBlock().Header.Number != 21 || reloaded.Snapshot().Balance(to) != 21 {
+		t.Fatalf("expected the reloaded chain to end at the block 21, got %d", reloaded.GetLastBlock().Header.Number)
+	}
+}
+
+// The balances rebuilt by a rewind or a restart match the ones of the blocks added live,
+// including the miner's rewards and fees.
+func TestState_RewindKeepsBalances(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	dir := setupTestDataDir(t, map[common.Address]uint{from: 100000})
+	s, err := NewState(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var (
+		hashes   []Hash
+		balances []map[common.Address]uint
+	)
+	startTime := time.Now().Add(-5 * time.Minute)
+	for i := 1; i <= 4; i++ {
+		tx := signTestTx(t, *NewTx(from, NewAccount("0x01"), "", 10, s.NextAccountNonce(from)), key)
+		block := NewBlock(*s.GetLastHash(), s.NextBlockNumber(), 0, []SignedTx{tx}, NewAccount("miner"))
+		block.Header.Time = uint64(startTime.Add(time.Duration(i) * time.Second).Unix())
+		block = mineTestBlock(t, block)
+		hash, err := s.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+		balances = append(balances, s.Balance())
+	}
+	if got := s.Snapshot().Balance(NewAccount("miner")); got != 4*(MinerReward+TxFee) {
+		t.Fatalf("expected the miner to get the rewards and the fees, got %d", got)
+	}
+
+	if _, err := s.RewindTo(hashes[1], dir); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Balance(), balances[1]) {
+		t.Fatalf("expected the rewound balances %v, got %v", balances[1], s.Balance())
+	}
+
+	s.Close()
+	reloaded, err := NewState(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if !reflect.DeepEqual(reloaded.Balance(), balances[1]) {
+		t.Fatalf("expected the reloaded balances %v, got %v", balances[1], reloaded.Balance())
+	}
+}
@@ -0,0 +1,135 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// The number of the latest blocks listed one by one in a block locator, before the step starts doubling.
+const locatorDenseBlocks = 10
+
+var ErrUnknownBlock = errors.New("unknown block")
+
+// Should be called while holding the mutex.
+func (s *State) indexBlock(hash Hash, number uint64) {
+	s.blockHashes = append(s.blockHashes, hash)
+	s.blockNumbers[hash] = number
+}
+
+// The block locator of the local chain: the hashes of the latest blocks, then the hashes spaced
+// exponentially back to the first block, and the zero hash, which every chain shares.
+// A peer finds the latest common block by the first hash of the locator it knows.
+func (s *State) BlockLocator() []Hash {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var locator []Hash
+	step := 1
+	for i := len(s.blockHashes) - 1; i >= 0; i -= step {
+		locator = append(locator, s.blockHashes[i])
+		if len(locator) >= locatorDenseBlocks {
+			step *= 2
+		}
+	}
+	return append(locator, Hash{})
+}
+
+// The number of the block with the hash in the local chain. The zero hash is the parent of the first block.
+func (s *State) BlockNumber(hash Hash) (uint64, bool) {
+	if hash.IsEmpty() {
+		return 0, true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	number, ok := s.blockNumbers[hash]
+	return number, ok
+}
+
+// The latest block of the local chain listed in the locator. Falls back to the zero hash,
+// if none of the hashes is known.
+func (s *State) FindAncestor(locator []Hash) (Hash, uint64) {
+	for _, hash := range locator {
+		if number, ok := s.BlockNumber(hash); ok {
+			return hash, number
+		}
+	}
+	return Hash{}, 0
+}
+
+// Rewind the local chain to the block with the hash, which becomes the last block. The blocks after it
+// are removed from the blocks db and returned, the balances and nonces are rebuilt from the genesis
+// the same way they're loaded on start.
+func (s *State) RewindTo(hash Hash, dirname string) ([]Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if hash == s.lastBlockHash {
+		return nil, nil
+	}
+	if _, ok := s.blockNumbers[hash]; !ok && !hash.IsEmpty() {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBlock, hash)
+	}
+
+	f, err := os.Open(getBlocksDbFile(dirname))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		kept       []byte
+		keptBlocks uint64
+		removed    []Block
+		found      = hash.IsEmpty()
+	)
+	scanner := newBlockScanner(f, s.compression)
+	for scanner.Scan() {
+		blockFS := scanner.Block()
+		if found {
+			removed = append(removed, blockFS.Value)
+			continue
+		}
+		record, err := encodeBlockRecord(s.compression, blockFS)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		kept = append(kept, record...)
+		keptBlocks++
+		found = blockFS.Key == hash
+	}
+	f.Close()
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+
+	if err := s.txIndex.truncate(keptBlocks, s.blockNumbers[hash]); err != nil {
+		return nil, err
+	}
+	// replace the blocks db file, so a crash leaves either the old or the new chain
+	tmp := getBlocksDbFile(dirname) + ".tmp"
+	if err := os.WriteFile(tmp, kept, 0644); err != nil {
+		return nil, err
+	}
+	if err := s.blockFile.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, getBlocksDbFile(dirname)); err != nil {
+		return nil, err
+	}
+
+	s.balances = make(map[common.Address]uint)
+	s.account2Nonce = make(map[common.Address]uint)
+	s.lastBlock, s.lastBlockHash = Block{}, Hash{}
+	s.blockHashes, s.blockNumbers = nil, make(map[Hash]uint64)
+	s.recentBlockTimes = nil
+	if err := s.loadGenesisFile(dirname); err != nil {
+		return nil, err
+	}
+	if err := s.loadBlocksFile(dirname); err != nil {
+		return nil, err
+	}
+	s.publish()
+	logger.Printf("rewound the chain to the block %d, %d blocks removed\n", s.lastBlock.Header.Number, len(removed))
+	return removed, nil
+}
@@ -0,0 +1,18 @@
+package database
+
+import "time"
+
+// Clock is a source of the current time. The state and the node use it for the
+// time based consensus rules, so tests can replace it with a controlled one.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// The clock backed by the local system time.
+var SystemClock Clock = systemClock{}
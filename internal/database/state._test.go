@@ -1,112 +1,237 @@
 package database
 
 import (
+	"crypto/ecdsa"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
-var testDbDir = "test-dir"
-
-// change db files which state uses.
-func setupMockGenesisDBFile(filename string) error {
-	content := `{
-			"genesis_time": "2019-03-18T00:00:00.000000000Z",
-		    "chain_id": "the-blockchain-bar-ledger",
-		    "balances": {
-		        "andrej": 1000000
-		    }
-		}`
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
-	defer f.Close()
+// Search the nonce of the block, which satisfies the proof of work.
+func mineTestBlock(t *testing.T, b Block) Block {
+	t.Helper()
+	b.Header, _ = mineTestHeader(t, b.Header)
+	return b
+}
+
+func TestState(t *testing.T) {
+	andrejKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	babayagaKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		andrej   = crypto.PubkeyToAddress(andrejKey.PublicKey)
+		babayaga = crypto.PubkeyToAddress(babayagaKey.PublicKey)
+		caesar   = NewAccount("0x0c")
+		miner    = NewAccount("0x0d")
+	)
+	dir := setupTestDataDir(t, map[common.Address]uint{andrej: 1000000})
+	s, err := NewState(dir, true)
 	if err != nil {
-		return err
+		t.Fatal(err)
+	}
+
+	startTime := time.Now().Add(-time.Minute)
+	payloads := [][]SignedTx{
+		{signTestTx(t, *NewTx(andrej, andrej, "", 3, 1), andrejKey)},
+		{
+			signTestTx(t, *NewTx(andrej, babayaga, "", 2000, 2), andrejKey),
+			signTestTx(t, *NewTx(babayaga, andrej, "", 1, 1), babayagaKey),
+			signTestTx(t, *NewTx(babayaga, caesar, "", 1000, 2), babayagaKey),
+			signTestTx(t, *NewTx(babayaga, andrej, "", 50, 3), babayagaKey),
+		},
 	}
-	_, err = f.Write([]byte(content))
+	for i, payload := range payloads {
+		block := NewBlock(*s.GetLastHash(), s.NextBlockNumber(), 0, payload, miner)
+		block.Header.Time = uint64(startTime.Add(time.Duration(i) * time.Second).Unix())
+		if _, err := s.AddBlock(mineTestBlock(t, block)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	// the balances are the same, when the blocks are replayed on start
+	state, err := NewState(dir, true)
 	if err != nil {
-		return err
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	expected := map[common.Address]uint{
+		andrej:   1000000 - 2*TxFee - 2000 + 1 + 50,
+		babayaga: 2000 - 1 - 1000 - 50 - 3*TxFee,
+		caesar:   1000,
+		miner:    2*MinerReward + 5*TxFee,
+	}
+	for acc, balance := range expected {
+		if got := state.Snapshot().Balance(acc); got != balance {
+			t.Fatalf("expected the balance for %s to be %d but got %d", acc, balance, got)
+		}
 	}
-	return nil
 }
 
-func setupMockTxDBFile(filename string) error {
-	content := `{"hash":"96a7306a8be62774de3799f1e605026327203d7eddf979ddee344eeeca05673a","block":{"header":{"ParentHash":"0000000000000000000000000000000000000000000000000000000000000000","Time":1746709322},"payload":[{"from":"andrej","to":"andrej","value":3,"data":"","createdAt":"2025-05-08T16:02:02+03:00"},{"from":"andrej","to":"andrej","value":700,"data":"reward","createdAt":"2025-05-08T16:02:02+03:00"}]}}
-{"hash":"35aa4cb8eb3c14f56563a85868339eef9de62835e1bc80827f97a471abb5db3d","block":{"header":{"ParentHash":"96a7306a8be62774de3799f1e605026327203d7eddf979ddee344eeeca05673a","Time":1746709322},"payload":[{"from":"andrej","to":"andrej","value":3,"data":"","createdAt":"2025-05-08T16:02:02+03:00"},{"from":"andrej","to":"andrej","value":700,"data":"reward","createdAt":"2025-05-08T16:02:02+03:00"},{"from":"andrej","to":"babayaga","value":2000,"data":"","createdAt":"2025-05-08T16:02:02+03:00"},{"from":"andrej","to":"andrej","value":100,"data":"reward","createdAt":"2025-05-08T16:02:02+03:00"},{"from":"babayaga","to":"andrej","value":1,"data":"","createdAt":"2025-05-08T16:02:02+03:00"},{"from":"babayaga","to":"caesar","value":1000,"data":"","createdAt":"2025-05-08T16:02:02+03:00"},{"from":"babayaga","to":"andrej","value":50,"data":"","createdAt":"2025-05-08T16:02:02+03:00"},{"from":"andrej","to":"andrej","value":600,"data":"reward","createdAt":"2025-05-08T16:02:02+03:00"}]}}`
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
-	defer f.Close()
+// Every block of the test is rejected, and the state stays at its last block.
+func TestState_AddBlockRejections(t *testing.T) {
+	key, err := crypto.GenerateKey()
 	if err != nil {
-		return err
+		t.Fatal(err)
 	}
-	_, err = f.Write([]byte(content))
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	dir := setupTestDataDir(t, map[common.Address]uint{from: 100000})
+	s, err := NewState(dir, true)
 	if err != nil {
-		return err
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	startTime := time.Now().Add(-time.Minute)
+	newBlock := func(parent Hash, number uint64, txs ...SignedTx) Block {
+		block := NewBlock(parent, number, 0, txs, NewAccount("miner"))
+		block.Header.Time = uint64(startTime.Add(time.Duration(number) * time.Second).Unix())
+		return block
+	}
+	mined := signTestTx(t, *NewTx(from, NewAccount("0x01"), "", 10, 1), key)
+	if _, err := s.AddBlock(mineTestBlock(t, newBlock(Hash{}, 1, mined))); err != nil {
+		t.Fatal(err)
+	}
+	tip := *s.GetLastHash()
+
+	unmined := newBlock(tip, 2, signTestTx(t, *NewTx(from, NewAccount("0x01"), "", 10, 2), key))
+	for hash, _ := unmined.Hash(); IsValidBlock(hash); hash, _ = unmined.Hash() {
+		unmined.Header.Nonce++
+	}
+	cases := []struct {
+		name  string
+		block Block
+		err   error
+	}{
+		{"unmined", unmined, ErrBlockPoW},
+		{"unknown parent", mineTestBlock(t, newBlock(Hash{0xde, 0xad}, 2)), ErrBlockParent},
+		{"parent of the tip", mineTestBlock(t, newBlock(Hash{}, 2)), ErrBlockParent},
+		{"wrong number", mineTestBlock(t, newBlock(tip, 77)), ErrBlockNumber},
+		{"replayed tx", mineTestBlock(t, newBlock(tip, 2, mined)), ErrTxNonce},
+		{"nonce gap", mineTestBlock(t, newBlock(tip, 2, signTestTx(t, *NewTx(from, NewAccount("0x01"), "", 10, 3), key))), ErrTxNonce},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := s.AddBlock(c.block); !errors.Is(err, c.err) {
+				t.Fatalf("expected %v, got %v", c.err, err)
+			}
+			if *s.GetLastHash() != tip || s.NextAccountNonce(from) != 2 {
+				t.Fatal("expected the rejected block not to change the state")
+			}
+		})
 	}
-	return nil
 }
 
-func setup() error {
-	// change original filenames which state uses
-	genesisFile = "utest_" + genesisFile
-	blocksFile = "utest_" + blocksFile
-	acc := common.HexToAddress("miner")
-
-	s, _ := NewState(testDbDir, true)
-	block0 := NewBlock(Hash{}, 1, 0x0123, []SignedTx{
-		*NewSignedTx(*NewTx(NewAccount("andrej"), NewAccount("andrej"), "", 3, s.NextAccountNonce(acc)), []byte{}),
-		*NewSignedTx(*NewTx(NewAccount("andrej"), NewAccount("andrej"), "reward", 700, s.NextAccountNonce(acc)), []byte{}),
-	}, NewAccount("miner"))
-	s.AddBlock(block0)
-	block0Hash, err := s.AddBlock(block0)
-	if err != nil {
-		log.Fatal(err)
-	}
-	block1 := NewBlock(block0Hash, 2, 0x0123, []SignedTx{
-		*NewSignedTx(*NewTx(NewAccount("andrej"), NewAccount("babayaga"), "", 2000, s.NextAccountNonce(acc)), []byte{}),
-		*NewSignedTx(*NewTx(NewAccount("andrej"), NewAccount("andrej"), "reward", 100, s.NextAccountNonce(acc)), []byte{}),
-		*NewSignedTx(*NewTx(NewAccount("babayaga"), NewAccount("andrej"), "", 1, s.NextAccountNonce(acc)), []byte{}),
-		*NewSignedTx(*NewTx(NewAccount("babayaga"), NewAccount("caesar"), "", 1000, s.NextAccountNonce(acc)), []byte{}),
-		*NewSignedTx(*NewTx(NewAccount("babayaga"), NewAccount("andrej"), "", 50, s.NextAccountNonce(acc)), []byte{}),
-		*NewSignedTx(*NewTx(NewAccount("andrej"), NewAccount("andrej"), "reward", 600, s.NextAccountNonce(acc)), []byte{}),
-	}, NewAccount("miner"))
-	s.AddBlock(block1)
-	return nil
+func Test_Acc(t *testing.T) {
+	a := NewAccount("qwe")
+	fmt.Println(a)
 }
 
-func cleanup() error {
-	if err := os.RemoveAll(testDbDir); err != nil {
-		return err
+// Create a data directory with a genesis file, funding the given accounts.
+func setupTestDataDir(t *testing.T, balances map[common.Address]uint) string {
+	dir := t.TempDir()
+	if err := os.MkdirAll(getDbDir(dir), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	gen := NewGenesisResource()
+	for acc, balance := range balances {
+		gen.AddAccount(acc.Hex(), balance)
+	}
+	if err := gen.SaveToFile(getGenesisFile(dir)); err != nil {
+		t.Fatal(err)
 	}
-	return nil
+	return dir
 }
 
-func TestState(t *testing.T) {
-	err := setup()
+func signTestTx(t *testing.T, tx Tx, key *ecdsa.PrivateKey) SignedTx {
+	txHash, err := tx.Hash()
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
-	defer func() {
-		if err := cleanup(); err != nil {
-			log.Fatal(err)
-		}
-	}()
+	sig, err := crypto.Sign(txHash[:], key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *NewSignedTx(tx, sig)
+}
 
-	state, _ := NewState(testDbDir, true)
+func TestState_ConcurrentReadsDuringAddBlock(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		from      = crypto.PubkeyToAddress(key.PublicKey)
+		to        = NewAccount("0x01")
+		blocksNum = 20
+		txValue   = uint(10)
+	)
+	dir := setupTestDataDir(t, map[common.Address]uint{from: 100000})
+	s, err := NewState(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
 
-	expectedBalance := 999451
-	if state.Balances[NewAccount("andrej")] != uint(expectedBalance) {
-		t.Fatalf("expected the balance for andrej to be %d but got %d", expectedBalance, state.Balances[NewAccount("andrej")])
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// every block moves txValue to the receiver, so a consistent view
+				// never has a balance which doesn't match its last block.
+				snapshot := s.Snapshot()
+				expected := uint(snapshot.LastBlock().Header.Number) * txValue
+				if got := snapshot.Balance(to); got != expected {
+					select {
+					case errs <- fmt.Errorf("expected receiver balance %d at block %d, got %d", expected, snapshot.LastBlock().Header.Number, got):
+					default:
+					}
+					return
+				}
+				_ = s.Balance()
+			}
+		}()
 	}
 
-	expectedBalance = 949
-	if state.Balances[NewAccount("babayaga")] != uint(expectedBalance) {
-		t.Fatalf("expected the balance for babayaga to be %d but got %d", expectedBalance, state.Balances[NewAccount("babayaga")])
+	startTime := time.Now().Add(-5 * time.Minute)
+	for i := 1; i <= blocksNum; i++ {
+		tx := signTestTx(t, *NewTx(from, to, "", txValue, s.NextAccountNonce(from)), key)
+		block := NewBlock(*s.GetLastHash(), s.NextBlockNumber(), 0, []SignedTx{tx}, NewAccount("miner"))
+		block.Header.Time = uint64(startTime.Add(time.Duration(i) * time.Second).Unix())
+		if _, err := s.AddBlock(mineTestBlock(t, block)); err != nil {
+			t.Fatal(err)
+		}
 	}
-}
+	close(done)
+	wg.Wait()
 
-func Test_Acc(t *testing.T) {
-	a := NewAccount("qwe")
-	fmt.Println(a)
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+	if nonce := s.NextAccountNonce(from); nonce != uint(blocksNum+1) {
+		t.Fatalf("expected the next nonce to be %d, got %d", blocksNum+1, nonce)
+	}
 }
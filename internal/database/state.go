@@ -1,12 +1,16 @@
 package database
 
 import (
-	"bufio"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 )
@@ -16,86 +20,157 @@ const (
 	TxFee       uint = 50
 )
 
+var (
+	ErrBlockNumber = errors.New("the next block number is incorrect")
+	// the block isn't a child of the last block, e.g. it's mined on a replaced tip
+	ErrBlockParent = errors.New("the next block parent hash is incorrect")
+	ErrBlockPoW    = errors.New("the block hash doesn't satisfy the proof of work")
+	ErrTxNonce     = errors.New("wrong TX nonce")
+)
+
+// State is safe for concurrent use. The writers are serialized by the mutex, while
+// the readers get the immutable view of the latest applied block.
 type State struct {
-	Balances        map[common.Address]uint
-	Account2Nonce   map[common.Address]uint
+	view atomic.Pointer[StateView]
+	// guards the fields below and the blocks db file
+	mu              sync.RWMutex
+	balances        map[common.Address]uint
+	account2Nonce   map[common.Address]uint
 	blockFile       *os.File
 	lastBlock       Block
 	lastBlockHash   Hash
 	hasGenesisBlock bool
+	compression     Compression
+	// the times of the latest MedianTimeBlocks blocks, used for the block time validation
+	recentBlockTimes []uint64
+	clock            Clock
+	// the hashes of the stored blocks in the chain order, and their block numbers
+	blockHashes  []Hash
+	blockNumbers map[Hash]uint64
+	txIndex      *txIndex
+	// set once the genesis file is loaded
+	chainID     string
+	genesisHash Hash
 }
 
 func NewState(dirname string, hasGenesisBlock bool) (*State, error) {
-	s := State{
-		Balances:        make(map[common.Address]uint),
-		Account2Nonce:   make(map[common.Address]uint),
+	return NewStateWithClock(dirname, hasGenesisBlock, SystemClock)
+}
+
+// Create a state, which validates the time based consensus rules against the given clock.
+func NewStateWithClock(dirname string, hasGenesisBlock bool, clock Clock) (*State, error) {
+	s := &State{
+		balances:        make(map[common.Address]uint),
+		account2Nonce:   make(map[common.Address]uint),
+		blockNumbers:    make(map[Hash]uint64),
 		hasGenesisBlock: hasGenesisBlock,
 		lastBlockHash:   Hash{},
+		clock:           clock,
 	}
 
 	if err := initDbDirStructureIfNotExist(dirname); err != nil {
 		return nil, err
 	}
 
+	storage, err := loadStorageConfig(dirname)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlocksDbVersion(dirname, storage); err != nil {
+		return nil, err
+	}
+	s.compression = storage.Compression
+
+	if s.txIndex, err = openTxIndex(dirname); err != nil {
+		return nil, err
+	}
+
 	if err := s.loadGenesisFile(dirname); err != nil {
 		return nil, err
 	}
 	if err := s.loadBlocksFile(dirname); err != nil {
 		return nil, err
 	}
-	return &s, nil
+	s.publish()
+	return s, nil
+}
+
+// The immutable view of the state at the latest block.
+func (s *State) Snapshot() *StateView {
+	return s.view.Load()
 }
 
+// Make the current balances, nonces and the last block visible to the readers.
+// The published maps must not be mutated afterwards.
+func (s *State) publish() {
+	s.view.Store(&StateView{
+		balances:      s.balances,
+		account2Nonce: s.account2Nonce,
+		lastBlock:     s.lastBlock,
+		lastBlockHash: s.lastBlockHash,
+	})
+}
+
+// A copy of all account balances.
 func (s *State) Balance() map[common.Address]uint {
-	res := make(map[common.Address]uint)
-	for k, v := range s.Balances {
-		res[k] = v
-	}
-	return res
+	return s.Snapshot().Balances()
 }
 
 func (s *State) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.blockFile.Close()
 }
 
 func (s *State) AddBlock(b Block) (Hash, error) {
-	// make a temporary copy of the state, in order to avoid race conditions
-	pendingState := s.copy()
-	// apply a block to pending state
-	if err := applyBlock(b, &pendingState); err != nil {
-		logger.Printf("could not apply a block %v\n", err)
-		return Hash{}, err
-	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	// get a block hash
 	blockHash, err := b.Hash()
 	if err != nil {
 		logger.Printf("could not get a block's hash %v\n", err)
 		return Hash{}, err
 	}
+	if !IsValidBlock(blockHash) {
+		return Hash{}, fmt.Errorf("%w: the block %d hash %s", ErrBlockPoW, b.Header.Number, blockHash)
+	}
+	// make a temporary copy of the state, in order to avoid race conditions
+	pendingState := s.copy()
+	// apply a block to pending state, it's validated against the tip under the same lock it's appended with
+	if err := applyBlock(b, pendingState); err != nil {
+		logger.Printf("could not apply a block %v\n", err)
+		return Hash{}, err
+	}
 	// create a blockFS instance for saving it to file
 	blockFS := BlockFS{
 		Key:   blockHash,
 		Value: b,
 	}
-	blockFSjson, err := json.Marshal(&blockFS)
+	record, err := encodeBlockRecord(s.compression, blockFS)
 	if err != nil {
 		logger.Printf("could not get marshal a block %v\n", err)
 		return Hash{}, err
 	}
 	logger.Println("Persisting a new block to db file")
-	if _, err := s.blockFile.Write(append(blockFSjson, '\n')); err != nil {
+	if _, err := s.blockFile.Write(record); err != nil {
 		logger.Printf(" could not persist a new block %v\n", err)
 		return Hash{}, err
 	}
-	s.Balances = pendingState.Balances
+	logger.Printf("adjust miner reward for %s", b.Header.Miner)
+	rewardMiner(b, pendingState)
+
+	s.balances = pendingState.balances
+	s.account2Nonce = pendingState.account2Nonce
 	s.lastBlockHash = blockHash
 	s.lastBlock = b
-
-	// reward for miner
-	logger.Printf("adjust miner reward for %s", b.Header.Miner)
-	s.Balances[b.Header.Miner] += MinerReward
-	// add Gas Fee
-	s.Balances[b.Header.Miner] += uint(len(b.Payload)) * TxFee
+	s.indexBlock(blockHash, b.Header.Number)
+	if err := s.txIndex.add(b, uint64(len(s.blockHashes))); err != nil {
+		// the index catches up on the next start
+		logger.Printf("could not index the block's transactions %v\n", err)
+	}
+	s.recentBlockTimes = appendBlockTime(s.recentBlockTimes, b.Header.Time)
+	s.publish()
 
 	logger.Println("done adding a block")
 
@@ -103,20 +178,32 @@ func (s *State) AddBlock(b Block) (Hash, error) {
 }
 
 func (s *State) GetLastHash() *Hash {
-	return &s.lastBlockHash
+	h := s.Snapshot().LastHash()
+	return &h
 }
 
 func (s *State) GetLastBlock() *Block {
-	return &s.lastBlock
+	b := s.Snapshot().LastBlock()
+	return &b
 }
 
-func (s *State) GetBlocksAfter(blockHash Hash, datadir string) ([]Block, error) {
+// Get the blocks after the block with the hash, at most limit blocks. A non positive limit means no limit.
+// Fails with ErrUnknownBlock, if the hash isn't a block of the local chain.
+func (s *State) GetBlocksAfter(blockHash Hash, datadir string, limit int) ([]Block, error) {
+	// don't read a partially written block
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.blockNumbers[blockHash]; !ok && !blockHash.IsEmpty() {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBlock, blockHash)
+	}
+
 	f, err := os.OpenFile(getBlocksDbFile(datadir), os.O_RDONLY, 0600)
 	if err != nil {
 		return nil, err
 	}
-	scanner := bufio.NewScanner(f)
-	scanner.Split(bufio.ScanLines)
+	defer f.Close()
+	scanner := newBlockScanner(f, s.compression)
 
 	blocks := []Block{}
 	shouldStartAppending := false
@@ -127,26 +214,39 @@ func (s *State) GetBlocksAfter(blockHash Hash, datadir string) ([]Block, error)
 	}
 
 	for scanner.Scan() {
-		if scanner.Err() != nil {
-			return nil, scanner.Err()
-		}
-		var currentBlock BlockFS
-		if err := json.Unmarshal(scanner.Bytes(), &currentBlock); err != nil {
-			return nil, err
-		}
+		currentBlock := scanner.Block()
 
 		if shouldStartAppending {
 			blocks = append(blocks, currentBlock.Value)
+			if limit > 0 && len(blocks) == limit {
+				break
+			}
 		}
 
 		if currentBlock.Key == blockHash {
 			shouldStartAppending = true
 		}
 	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
 
 	return blocks, nil
 }
 
+// Get the headers of the blocks after the block with the hash, at most limit headers.
+func (s *State) GetHeadersAfter(blockHash Hash, datadir string, limit int) ([]BlockHeader, error) {
+	blocks, err := s.GetBlocksAfter(blockHash, datadir, limit)
+	if err != nil {
+		return nil, err
+	}
+	headers := make([]BlockHeader, len(blocks))
+	for i, b := range blocks {
+		headers[i] = b.Header
+	}
+	return headers, nil
+}
+
 func (s *State) loadBlocksFile(dirname string) error {
 	f, err := os.OpenFile(getBlocksDbFile(dirname), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
 	if err != nil {
@@ -154,24 +254,24 @@ func (s *State) loadBlocksFile(dirname string) error {
 	}
 	s.blockFile = f
 
-	scanner := bufio.NewScanner(f)
-	scanner.Split(bufio.ScanLines)
+	scanner := newBlockScanner(f, s.compression)
 
 	for scanner.Scan() {
-		var blockFS BlockFS
-		if err := json.Unmarshal(scanner.Bytes(), &blockFS); err != nil {
-			return err
-		}
+		blockFS := scanner.Block()
 
-		// apply the block's payload
-		for _, tx := range blockFS.Value.Payload {
-			if err := applyTx(tx, s); err != nil {
-				return err
-			}
+		// apply the block's payload and the miner's reward, the same way the block was added
+		if err := applyTXs(blockFS.Value.Payload, s); err != nil {
+			return err
 		}
+		rewardMiner(blockFS.Value, s)
 
 		s.lastBlock = blockFS.Value
 		s.lastBlockHash = blockFS.Key
+		s.indexBlock(blockFS.Key, blockFS.Value.Header.Number)
+		if err := s.txIndex.add(blockFS.Value, uint64(len(s.blockHashes))); err != nil {
+			return err
+		}
+		s.recentBlockTimes = appendBlockTime(s.recentBlockTimes, blockFS.Value.Header.Time)
 	}
 
 	if scanner.Err() != nil {
@@ -213,53 +313,96 @@ func (s *State) loadGenesisFile(dirname string) error {
 	}
 	// set a balances to state
 	for k, v := range genesisData.Balances {
-		s.Balances[common.Address(k)] = v
+		s.balances[common.Address(k)] = v
 	}
+	s.chainID = genesisData.ChainID
+	s.genesisHash = sha256.Sum256(res)
 
 	return nil
 }
 
-func (s *State) copy() State {
-	newState := State{}
+// Copy the balances, nonces, the chain tip and the validation settings into a new detached state.
+// Should be called while holding the mutex.
+func (s *State) copy() *State {
+	newState := &State{}
 	newState.lastBlockHash = s.lastBlockHash
 	newState.lastBlock = s.lastBlock
-	newState.Balances = make(map[common.Address]uint)
-	newState.Account2Nonce = make(map[common.Address]uint)
+	newState.hasGenesisBlock = s.hasGenesisBlock
+	newState.compression = s.compression
+	newState.chainID = s.chainID
+	newState.genesisHash = s.genesisHash
+	newState.clock = s.clock
+	newState.recentBlockTimes = append([]uint64{}, s.recentBlockTimes...)
+	newState.balances = make(map[common.Address]uint, len(s.balances))
+	newState.account2Nonce = make(map[common.Address]uint, len(s.account2Nonce))
 
-	for acc, balance := range s.Balances {
-		newState.Balances[acc] = balance
+	for acc, balance := range s.balances {
+		newState.balances[acc] = balance
+	}
+	for acc, nonce := range s.account2Nonce {
+		newState.account2Nonce[acc] = nonce
 	}
 
 	return newState
 }
 
+// The chain id from the genesis file.
+func (s *State) ChainID() string {
+	return s.chainID
+}
+
+// The hash of the genesis file content. Nodes with different genesis can't share the chain.
+func (s *State) GenesisHash() Hash {
+	return s.genesisHash
+}
+
+// The current time of the state's clock.
+func (s *State) Now() time.Time {
+	return s.clock.Now()
+}
+
 func (s *State) NextBlockNumber() uint64 {
-	lastBlockNum := s.lastBlock.Header.Number
-	return lastBlockNum + 1
+	return s.Snapshot().NextBlockNumber()
 }
 
 func (s *State) NextAccountNonce(acc common.Address) uint {
-	if _, ok := s.Account2Nonce[acc]; !ok {
-		return 1
-	}
-	return s.Account2Nonce[acc] + 1
+	return s.Snapshot().NextAccountNonce(acc)
 }
 
 // Add block to state, and apply all block's transactions to the current state txMempool.
 func applyBlock(b Block, s *State) error {
 	nextExpectedBlockNumber := s.lastBlock.Header.Number + 1
 
+	// validate that next block parent hash equals to state last block hash, the zero hash for the first block.
+	// It's checked first, so a block mined on a replaced tip is reported as such.
+	if s.hasGenesisBlock && b.Header.ParentHash != s.lastBlockHash {
+		return fmt.Errorf("%w, expected to be %x got %x", ErrBlockParent, s.lastBlockHash, b.Header.ParentHash)
+	}
 	// validate for expected next block number. The height should be equal to state last block's number + 1.
 	if s.hasGenesisBlock && b.Header.Number != nextExpectedBlockNumber {
-		return fmt.Errorf("the next block number is incorrect, expected to be %d got %d", nextExpectedBlockNumber, b.Header.Number)
+		return fmt.Errorf("%w, expected to be %d got %d", ErrBlockNumber, nextExpectedBlockNumber, b.Header.Number)
 	}
-	// validate that next block parent hash equals to state last block hash.
-	if s.hasGenesisBlock && s.lastBlock.Header.Number > 0 && !reflect.DeepEqual(b.Header.ParentHash, s.lastBlockHash) {
-		return fmt.Errorf("the next block parent hash is incorrect, expected to be %x got %x", s.lastBlockHash, b.Header.ParentHash)
+
+	if err := ValidateBlockLimits(b); err != nil {
+		return err
+	}
+	if err := ValidateTxRoot(b); err != nil {
+		return err
+	}
+	if err := ValidateBlockTime(b, s.recentBlockTimes, s.Now()); err != nil {
+		return err
 	}
 	return applyTXs(b.Payload, s)
 }
 
+// Credit the block reward and the fees of the block's transactions to the miner.
+func rewardMiner(b Block, s *State) {
+	s.balances[b.Header.Miner] += MinerReward
+	for _, tx := range b.Payload {
+		s.balances[b.Header.Miner] += tx.EffectiveFee()
+	}
+}
+
 func applyTXs(txs []SignedTx, s *State) error {
 	for _, tx := range txs {
 		if err := applyTx(tx, s); err != nil {
@@ -270,7 +413,7 @@ func applyTXs(txs []SignedTx, s *State) error {
 }
 
 func (s *State) IsValidTX(tx Tx) error {
-	if s.Balances[tx.From] < tx.Value {
+	if s.Snapshot().Balance(tx.From) < tx.Value {
 		return fmt.Errorf("wrong TX, cant perform transaction. \n From: %s, To: %s, Value: %d \n", tx.From, tx.To, tx.Value)
 	}
 	return nil
@@ -285,31 +428,26 @@ func applyTx(tx SignedTx, s *State) error {
 		return fmt.Errorf("wrong TX, Sender '%s' is forged", common.Address(tx.From).Hex())
 	}
 	if tx.IsReward() {
-		s.Balances[tx.To] += tx.Value
+		s.balances[tx.To] += tx.Value
 		return nil
 	}
 
-	txCost := tx.Value + TxFee
-
-	if s.Balances[tx.From] < txCost {
-		return fmt.Errorf("wrong TX, cant perform transaction. \n From: %s, To: %s, Value: %d \n", tx.From, tx.To, tx.Value)
+	// the account's transactions are applied in the nonce order, without gaps and replays
+	if expected := s.account2Nonce[tx.From] + 1; tx.Nonce != expected {
+		return fmt.Errorf("%w, From: %s, expected %d got %d", ErrTxNonce, tx.From, expected, tx.Nonce)
 	}
-	s.Balances[tx.From] -= txCost
 
-	if _, ok := s.Balances[tx.To]; !ok {
-		s.Balances[tx.To] = 0
-	}
-	s.Balances[tx.To] += tx.Value
-	fmt.Println(" ---- applyTx")
-	for k, v := range s.Balances {
-		fmt.Printf("%s : %d\n", k.Hex(), v)
+	txCost := tx.Cost()
+
+	if s.balances[tx.From] < txCost {
+		return fmt.Errorf("wrong TX, cant perform transaction. \n From: %s, To: %s, Value: %d \n", tx.From, tx.To, tx.Value)
 	}
+	s.balances[tx.From] -= txCost
 
-	fmt.Println(" \n END ---- applyTx")
-	fmt.Println("is true ---- ", s.Account2Nonce == nil)
-	if _, ok := s.Account2Nonce[tx.From]; !ok {
-		fmt.Println("NO account", tx.From, tx.Nonce)
+	if _, ok := s.balances[tx.To]; !ok {
+		s.balances[tx.To] = 0
 	}
-	s.Account2Nonce[tx.From] = tx.Nonce
+	s.balances[tx.To] += tx.Value
+	s.account2Nonce[tx.From] = tx.Nonce
 	return nil
 }
@@ -0,0 +1,42 @@
+package database
+
+import "github.com/ethereum/go-ethereum/common"
+
+// StateView is an immutable snapshot of the state after a block was applied.
+// The state never mutates the maps of a published view, so it's safe to share
+// a view between goroutines without any locking.
+type StateView struct {
+	balances      map[common.Address]uint
+	account2Nonce map[common.Address]uint
+	lastBlock     Block
+	lastBlockHash Hash
+}
+
+func (v *StateView) Balance(acc common.Address) uint {
+	return v.balances[acc]
+}
+
+// A copy of all account balances.
+func (v *StateView) Balances() map[common.Address]uint {
+	res := make(map[common.Address]uint, len(v.balances))
+	for k, val := range v.balances {
+		res[k] = val
+	}
+	return res
+}
+
+func (v *StateView) NextAccountNonce(acc common.Address) uint {
+	return v.account2Nonce[acc] + 1
+}
+
+func (v *StateView) LastHash() Hash {
+	return v.lastBlockHash
+}
+
+func (v *StateView) LastBlock() Block {
+	return v.lastBlock
+}
+
+func (v *StateView) NextBlockNumber() uint64 {
+	return v.lastBlock.Header.Number + 1
+}
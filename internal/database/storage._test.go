@@ -0,0 +1,108 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestBlockRecordsRoundTrip(t *testing.T) {
+	for _, c := range []Compression{CompressionNone, CompressionSnappy, CompressionZstd} {
+		t.Run(string(c), func(t *testing.T) {
+			var (
+				buf    bytes.Buffer
+				blocks []BlockFS
+			)
+			parent := Hash{}
+			for i := 1; i <= 3; i++ {
+				block := NewBlock(parent, uint64(i), uint32(i), []SignedTx{createTx("from", "to", uint(i*100))}, NewAccount("miner"))
+				hash, err := block.Hash()
+				if err != nil {
+					t.Fatal(err)
+				}
+				blockFS := BlockFS{hash, block}
+				record, err := encodeBlockRecord(c, blockFS)
+				if err != nil {
+					t.Fatal(err)
+				}
+				buf.Write(record)
+				blocks = append(blocks, blockFS)
+				parent = hash
+			}
+
+			scanner := newBlockScanner(&buf, c)
+			var got []BlockFS
+			for scanner.Scan() {
+				got = append(got, scanner.Block())
+			}
+			if scanner.Err() != nil {
+				t.Fatal(scanner.Err())
+			}
+			if !reflect.DeepEqual(got, blocks) {
+				t.Fatalf("expected %d decoded blocks to match the written ones, got %d", len(blocks), len(got))
+			}
+		})
+	}
+}
+
+func TestSetBlocksCompression(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := SetBlocksCompression(dir, CompressionZstd); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadStorageConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Compression != CompressionZstd {
+		t.Fatalf("expected compression to be %s but got %s", CompressionZstd, cfg.Compression)
+	}
+
+	// once the blocks db has records, the codec must not change
+	if err := os.WriteFile(getBlocksDbFile(dir), []byte{0, 0, 0, 1, 0}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetBlocksCompression(dir, CompressionSnappy); err == nil {
+		t.Fatal("expected an error switching the compression of a non empty blocks db")
+	}
+	if err := SetBlocksCompression(dir, CompressionZstd); err != nil {
+		t.Fatalf("expected the same compression to be accepted, got %v", err)
+	}
+}
+
+func TestBlocksDbVersion(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(getDbDir(dir), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewGenesisResource().SaveToFile(getGenesisFile(dir)); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewState(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	cfg, err := loadStorageConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Version != BlocksDbVersion {
+		t.Fatalf("expected a new data dir to get the version %d, got %d", BlocksDbVersion, cfg.Version)
+	}
+
+	// a data dir written before the storage config, with the whole block hashed
+	if err := os.Remove(getStorageFile(dir)); err != nil {
+		t.Fatal(err)
+	}
+	old := `{"hash":"00003730b3f737b25ccb5e8730ab608aa2dc610986ea5418a81776029aa50108","block":{"header":{"parentHash":"0000000000000000000000000000000000000000000000000000000000000000","number":1,"nonce":1590066935,"time":1751298660,"miner":"0xe3e1aff79a367675be32e76b63866ebd565f2b4a"},"payload":[]}}` + "\n"
+	if err := os.WriteFile(getBlocksDbFile(dir), []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewState(dir, true); !errors.Is(err, ErrBlocksDbVersion) {
+		t.Fatalf("expected the old blocks db to be refused, got %v", err)
+	}
+}
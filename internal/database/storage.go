@@ -0,0 +1,295 @@
+package database
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the codec used for the records of the blocks db file.
+type Compression string
+
+const (
+	CompressionNone   Compression = "none"
+	CompressionSnappy Compression = "snappy"
+	CompressionZstd   Compression = "zstd"
+)
+
+// The maximum size of a single (compressed) record in the blocks db file.
+const maxBlockRecordSize = 64 << 20
+
+// The format of the blocks db. Version 1 hashed the whole block, version 2 hashes the header only,
+// which commits to the payload by the TxRoot. The blocks of different versions can't be mixed, as
+// the parent hashes of the stored chain don't match the recomputed ones.
+const BlocksDbVersion = 2
+
+var (
+	storageFile = "storage.json"
+
+	ErrBlocksDbVersion = errors.New("unsupported blocks db version")
+)
+
+// storageConfig is persisted per data directory, so every node keeps reading
+// its blocks db with the same codec and format it was written with.
+type storageConfig struct {
+	Compression Compression `json:"compression"`
+	Version     int         `json:"version"`
+}
+
+func ParseCompression(name string) (Compression, error) {
+	switch c := Compression(name); c {
+	case "":
+		return CompressionNone, nil
+	case CompressionNone, CompressionSnappy, CompressionZstd:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown block compression '%s', expected one of: none, snappy, zstd", name)
+	}
+}
+
+func getStorageFile(dirname string) string {
+	return filepath.Join(getDbDir(dirname), storageFile)
+}
+
+// Read the storage config of the data directory. Directories created before the
+// config was introduced have no file and are treated as uncompressed, of the first version.
+func loadStorageConfig(dirname string) (storageConfig, error) {
+	content, err := os.ReadFile(getStorageFile(dirname))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return storageConfig{CompressionNone, 1}, nil
+		}
+		return storageConfig{}, err
+	}
+	var cfg storageConfig
+	if err := json.Unmarshal(content, &cfg); err != nil {
+		return storageConfig{}, err
+	}
+	if _, err := ParseCompression(string(cfg.Compression)); err != nil {
+		return storageConfig{}, err
+	}
+	if cfg.Compression == "" {
+		cfg.Compression = CompressionNone
+	}
+	if cfg.Version == 0 {
+		cfg.Version = 1
+	}
+	return cfg, nil
+}
+
+func writeStorageConfig(dirname string, cfg storageConfig) error {
+	content, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(getStorageFile(dirname), content, 0644)
+}
+
+// Select the block compression for a data directory. The codec can be changed only
+// while the blocks db is empty, as the existing records can't be mixed with a new codec.
+func SetBlocksCompression(dirname string, c Compression) error {
+	if err := initDbDirStructureIfNotExist(dirname); err != nil {
+		return err
+	}
+	cfg, err := loadStorageConfig(dirname)
+	if err != nil {
+		return err
+	}
+	if cfg.Compression == c {
+		return nil
+	}
+	empty, err := isBlocksDbEmpty(dirname)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("the blocks db is already written with '%s' compression, could not switch to '%s'", cfg.Compression, c)
+	}
+	return writeStorageConfig(dirname, storageConfig{c, BlocksDbVersion})
+}
+
+// Check the format of the blocks db. An empty blocks db is upgraded to the current version, a blocks db
+// of another version is refused: its blocks have to be synced again from the peers.
+func checkBlocksDbVersion(dirname string, cfg storageConfig) error {
+	if cfg.Version == BlocksDbVersion {
+		return nil
+	}
+	empty, err := isBlocksDbEmpty(dirname)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("%w: the blocks db %s is written in the version %d, the node supports the version %d. Remove the blocks db to sync the chain again",
+			ErrBlocksDbVersion, getBlocksDbFile(dirname), cfg.Version, BlocksDbVersion)
+	}
+	cfg.Version = BlocksDbVersion
+	return writeStorageConfig(dirname, cfg)
+}
+
+func isBlocksDbEmpty(dirname string) (bool, error) {
+	info, err := os.Stat(getBlocksDbFile(dirname))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return info.Size() == 0, nil
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+func compress(c Compression, data []byte) ([]byte, error) {
+	switch c {
+	case CompressionSnappy:
+		return snappy.Encode(nil, data), nil
+	case CompressionZstd:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(data, nil), nil
+	default:
+		return data, nil
+	}
+}
+
+func decompress(c Compression, data []byte) ([]byte, error) {
+	switch c {
+	case CompressionSnappy:
+		return snappy.Decode(nil, data)
+	case CompressionZstd:
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return dec.DecodeAll(data, nil)
+	default:
+		return data, nil
+	}
+}
+
+// Encode a block record for the blocks db file. Uncompressed records stay
+// newline delimited JSON, compressed ones are prefixed with their length.
+func encodeBlockRecord(c Compression, blockFS BlockFS) ([]byte, error) {
+	blockFSjson, err := json.Marshal(&blockFS)
+	if err != nil {
+		return nil, err
+	}
+	if c == CompressionNone {
+		return append(blockFSjson, '\n'), nil
+	}
+	compressed, err := compress(c, blockFSjson)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, 4, 4+len(compressed))
+	binary.BigEndian.PutUint32(record, uint32(len(compressed)))
+	return append(record, compressed...), nil
+}
+
+// blockScanner reads the BlockFS records of the blocks db file one by one.
+type blockScanner struct {
+	compression Compression
+	lines       *bufio.Scanner
+	reader      *bufio.Reader
+	block       BlockFS
+	err         error
+}
+
+func newBlockScanner(r io.Reader, c Compression) *blockScanner {
+	s := &blockScanner{compression: c}
+	if c == CompressionNone {
+		s.lines = bufio.NewScanner(r)
+		s.lines.Buffer(make([]byte, 0, 64*1024), maxBlockRecordSize)
+		s.lines.Split(bufio.ScanLines)
+	} else {
+		s.reader = bufio.NewReader(r)
+	}
+	return s
+}
+
+func (s *blockScanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+	record, err := s.next()
+	if err != nil {
+		if err != io.EOF {
+			s.err = err
+		}
+		return false
+	}
+	var blockFS BlockFS
+	if err := json.Unmarshal(record, &blockFS); err != nil {
+		s.err = err
+		return false
+	}
+	s.block = blockFS
+	return true
+}
+
+func (s *blockScanner) next() ([]byte, error) {
+	if s.lines != nil {
+		for s.lines.Scan() {
+			// skip empty lines, e.g. a trailing new line
+			if len(s.lines.Bytes()) > 0 {
+				return s.lines.Bytes(), nil
+			}
+		}
+		if err := s.lines.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(s.reader, size[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("corrupted block record header: %w", err)
+		}
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxBlockRecordSize {
+		return nil, fmt.Errorf("block record of %d bytes exceeds the limit of %d bytes", n, maxBlockRecordSize)
+	}
+	compressed := make([]byte, n)
+	if _, err := io.ReadFull(s.reader, compressed); err != nil {
+		return nil, fmt.Errorf("corrupted block record: %w", err)
+	}
+	return decompress(s.compression, compressed)
+}
+
+func (s *blockScanner) Block() BlockFS {
+	return s.block
+}
+
+func (s *blockScanner) Err() error {
+	return s.err
+}
@@ -0,0 +1,58 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestBlockTemplate_SkipsInvalidTXs(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	to := NewAccount("0x01")
+	dir := setupTestDataDir(t, map[common.Address]uint{from: 1000})
+	s, err := NewState(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	template := s.NewBlockTemplate(time.Now())
+	cases := []struct {
+		name  string
+		tx    SignedTx
+		valid bool
+	}{
+		{"gap", signTestTx(t, *NewTx(from, to, "", 10, 2), key), false},
+		{"first", signTestTx(t, *NewTx(from, to, "", 10, 1), key), true},
+		{"nonce reused", signTestTx(t, *NewTx(from, to, "", 20, 1), key), false},
+		// 1000 - (10 + 50) < 900 + 50
+		{"insufficient funds", signTestTx(t, *NewTx(from, to, "", 900, 2), key), false},
+		{"unsigned", *NewSignedTx(*NewTx(from, to, "", 10, 2), []byte{}), false},
+		{"second", signTestTx(t, *NewTx(from, to, "", 10, 2), key), true},
+	}
+	for _, c := range cases {
+		if err := template.Apply(c.tx); (err == nil) != c.valid {
+			t.Fatalf("%s: unexpected result %v", c.name, err)
+		}
+	}
+	if len(template.TXs()) != 2 || template.Number() != 1 || !template.ParentHash().IsEmpty() {
+		t.Fatalf("expected 2 transactions in the template of the first block, got %d", len(template.TXs()))
+	}
+	// the state isn't changed by the template
+	if s.NextAccountNonce(from) != 1 {
+		t.Fatal("expected the state to be unchanged")
+	}
+
+	block := NewBlock(template.ParentHash(), template.Number(), 0, template.TXs(), NewAccount("miner"))
+	block.Header.Time = uint64(template.Time().Unix())
+	block = mineTestBlock(t, block)
+	if _, err := s.AddBlock(block); err != nil {
+		t.Fatalf("expected the block of the template to be valid, got %v", err)
+	}
+}
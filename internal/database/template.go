@@ -0,0 +1,63 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// BlockTemplate applies the transactions of the next block to a copy of the state, so a block built
+// of the applied transactions is valid against the state the template is started on, the transactions,
+// which don't apply, are skipped.
+type BlockTemplate struct {
+	state *State
+	time  time.Time
+	txs   []SignedTx
+}
+
+// Start the template of the next block with the given block time.
+func (s *State) NewBlockTemplate(blockTime time.Time) *BlockTemplate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &BlockTemplate{state: s.copy(), time: blockTime}
+}
+
+// Apply the transaction to the template's state. The state is left unchanged, if the transaction
+// doesn't apply. The transactions of a sender should follow the nonces without gaps.
+func (t *BlockTemplate) Apply(tx SignedTx) error {
+	if tx.IsReward() {
+		return errors.New("reward transactions can't be included into a block template")
+	}
+	if err := ValidateTxLimits(tx.Tx); err != nil {
+		return err
+	}
+	if err := ValidateTxTime(tx.Tx, t.time); err != nil {
+		return err
+	}
+	if next := t.state.account2Nonce[tx.From] + 1; tx.Nonce != next {
+		return fmt.Errorf("the transaction nonce %d doesn't follow the nonce %d of the sender %s", tx.Nonce, next-1, tx.From)
+	}
+	if err := applyTx(tx, t.state); err != nil {
+		return err
+	}
+	t.txs = append(t.txs, tx)
+	return nil
+}
+
+// The applied transactions, in the order they were applied.
+func (t *BlockTemplate) TXs() []SignedTx {
+	return t.txs
+}
+
+// The hash of the block the template extends.
+func (t *BlockTemplate) ParentHash() Hash {
+	return t.state.lastBlockHash
+}
+
+func (t *BlockTemplate) Number() uint64 {
+	return t.state.lastBlock.Header.Number + 1
+}
+
+func (t *BlockTemplate) Time() time.Time {
+	return t.time
+}
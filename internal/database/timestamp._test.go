@@ -0,0 +1,74 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+type fixedClock struct {
+	now time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.now
+}
+
+func TestMedianTime(t *testing.T) {
+	if m := medianTime(nil); m != 0 {
+		t.Fatalf("expected zero median for no blocks, got %d", m)
+	}
+	if m := medianTime([]uint64{50, 10, 30, 20, 40}); m != 30 {
+		t.Fatalf("expected median to be 30, got %d", m)
+	}
+
+	var times []uint64
+	for i := 1; i <= MedianTimeBlocks+5; i++ {
+		times = appendBlockTime(times, uint64(i))
+	}
+	if len(times) != MedianTimeBlocks || times[0] != 6 {
+		t.Fatalf("expected only the latest %d block times to be kept, got %v", MedianTimeBlocks, times)
+	}
+}
+
+func TestValidateBlockTime(t *testing.T) {
+	clock := fixedClock{time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)}
+	now := uint64(clock.Now().Unix())
+	prevTimes := []uint64{now - 300, now - 200, now - 100}
+
+	newBlockAt := func(blockTime uint64, createdAt time.Time) Block {
+		tx := createTx("from", "to", 1)
+		tx.CreatedAt = createdAt.Format(time.RFC3339)
+		b := NewBlock(Hash{}, 1, 0, []SignedTx{tx}, NewAccount("miner"))
+		b.Header.Time = blockTime
+		return b
+	}
+
+	cases := []struct {
+		name    string
+		block   Block
+		isValid bool
+	}{
+		{"current time", newBlockAt(now, clock.Now()), true},
+		{"equal to median", newBlockAt(now-200, clock.Now().Add(-time.Hour)), false},
+		{"too far in future", newBlockAt(now+uint64((MaxFutureBlockTime+time.Minute).Seconds()), clock.Now()), false},
+		{"tx from future", newBlockAt(now, clock.Now().Add(MaxTxClockDrift+time.Minute)), false},
+		{"expired tx", newBlockAt(now, clock.Now().Add(-MaxTxAge-time.Minute)), false},
+	}
+	for _, c := range cases {
+		err := ValidateBlockTime(c.block, prevTimes, clock.Now())
+		if c.isValid && err != nil {
+			t.Fatalf("%s: expected the block to be valid, got %v", c.name, err)
+		}
+		if !c.isValid && err == nil {
+			t.Fatalf("%s: expected the block to be invalid", c.name)
+		}
+	}
+}
+
+func TestValidateTxTime_NotParsable(t *testing.T) {
+	tx := createTx("from", "to", 1)
+	tx.CreatedAt = "yesterday"
+	if err := ValidateTxTime(tx.Tx, time.Now()); err == nil {
+		t.Fatal("expected an error for not parsable creation time")
+	}
+}
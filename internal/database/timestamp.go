@@ -0,0 +1,75 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Consensus rules for the block and transaction timestamps.
+const (
+	// The number of previous blocks used to calculate the median time.
+	MedianTimeBlocks = 11
+	// How far a block's time may be ahead of the local clock.
+	MaxFutureBlockTime = 2 * time.Hour
+	// How far a transaction's creation time may be ahead of the block's time or the local clock.
+	MaxTxClockDrift = 10 * time.Minute
+	// How old a transaction may be, relatively to the block's time, to be included into the block.
+	MaxTxAge = 24 * time.Hour
+)
+
+// The median of the given block times. Returns zero for an empty list.
+func medianTime(times []uint64) uint64 {
+	if len(times) == 0 {
+		return 0
+	}
+	sorted := make([]uint64, len(times))
+	copy(sorted, times)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
+
+// Keep the times of the latest MedianTimeBlocks blocks.
+func appendBlockTime(times []uint64, t uint64) []uint64 {
+	res := append(times, t)
+	if len(res) > MedianTimeBlocks {
+		res = res[len(res)-MedianTimeBlocks:]
+	}
+	return res
+}
+
+// Validate the block's time against the median time of the previous blocks and the local clock.
+func ValidateBlockTime(b Block, prevTimes []uint64, now time.Time) error {
+	if len(prevTimes) > 0 {
+		median := medianTime(prevTimes)
+		if b.Header.Time <= median {
+			return fmt.Errorf("the block time %d should be greater than the median time %d of the previous %d blocks", b.Header.Time, median, len(prevTimes))
+		}
+	}
+	maxTime := now.Add(MaxFutureBlockTime).Unix()
+	if int64(b.Header.Time) > maxTime {
+		return fmt.Errorf("the block time %d is too far in the future, the maximum allowed is %d", b.Header.Time, maxTime)
+	}
+	for _, tx := range b.Payload {
+		if err := ValidateTxTime(tx.Tx, time.Unix(int64(b.Header.Time), 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate the transaction's creation time relatively to the given time, which is the block's
+// time for the mined transactions or the local clock for the pending ones.
+func ValidateTxTime(tx Tx, at time.Time) error {
+	createdAt, err := tx.CreatedTime()
+	if err != nil {
+		return err
+	}
+	if createdAt.After(at.Add(MaxTxClockDrift)) {
+		return fmt.Errorf("the transaction is created at %s, which is too far in the future", tx.CreatedAt)
+	}
+	if createdAt.Before(at.Add(-MaxTxAge)) {
+		return fmt.Errorf("the transaction is created at %s, which is older than %s", tx.CreatedAt, MaxTxAge)
+	}
+	return nil
+}
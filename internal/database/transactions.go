@@ -4,6 +4,7 @@ import (
 	"crypto/elliptic"
 	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -23,12 +24,14 @@ type Tx struct {
 	Data      string         `json:"data"`
 	CreatedAt string         `json:"createdAt"`
 	Nonce     uint           `json:"nonce"`
+	// the fee paid to the miner, TxFee if it's not set
+	Fee uint `json:"fee,omitempty"`
 }
 
 func NewTx(from, to common.Address, data string, value uint, nonce uint) *Tx {
 	createdAt := time.Now().Format(time.RFC3339)
 
-	return &Tx{from, to, value, data, createdAt, nonce}
+	return &Tx{From: from, To: to, Value: value, Data: data, CreatedAt: createdAt, Nonce: nonce}
 }
 
 func (t *Tx) Hash() (Hash, error) {
@@ -43,6 +46,28 @@ func (t *Tx) Encode() ([]byte, error) {
 	return json.Marshal(t)
 }
 
+// Parse the transaction's creation time.
+func (t *Tx) CreatedTime() (time.Time, error) {
+	createdAt, err := time.Parse(time.RFC3339, t.CreatedAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("the transaction creation time '%s' is not a valid RFC3339 time", t.CreatedAt)
+	}
+	return createdAt, nil
+}
+
+// The fee paid to the miner of the block.
+func (t *Tx) EffectiveFee() uint {
+	if t.Fee == 0 {
+		return TxFee
+	}
+	return t.Fee
+}
+
+// The amount charged from the sender.
+func (t *Tx) Cost() uint {
+	return t.Value + t.EffectiveFee()
+}
+
 func (t *Tx) IsReward() bool {
 	return t.Data == "reward"
 }
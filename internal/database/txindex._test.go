@@ -0,0 +1,131 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestState_TxIndex(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	dir := setupTestDataDir(t, map[common.Address]uint{from: 100000})
+	s, err := NewState(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		blockHashes []Hash
+		txHashes    []Hash
+	)
+	startTime := time.Now().Add(-5 * time.Minute)
+	for i := 1; i <= 5; i++ {
+		tx := signTestTx(t, *NewTx(from, NewAccount("0x01"), "", 1, s.NextAccountNonce(from)), key)
+		block := NewBlock(*s.GetLastHash(), s.NextBlockNumber(), 0, []SignedTx{tx}, NewAccount("miner"))
+		block.Header.Time = uint64(startTime.Add(time.Duration(i) * time.Second).Unix())
+		block = mineTestBlock(t, block)
+		hash, err := s.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txHash, err := tx.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		blockHashes, txHashes = append(blockHashes, hash), append(txHashes, txHash)
+	}
+
+	if number, ok, err := s.TxBlockNumber(txHashes[2]); err != nil || !ok || number != 3 {
+		t.Fatalf("expected the transaction in the block 3, got %d %v %v", number, ok, err)
+	}
+	if _, ok, err := s.TxBlockNumber(Hash{9}); err != nil || ok {
+		t.Fatalf("expected an unknown transaction, got %v %v", ok, err)
+	}
+
+	// the transactions of the removed blocks are dropped
+	if _, err := s.RewindTo(blockHashes[1], dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := s.TxBlockNumber(txHashes[2]); ok {
+		t.Fatal("expected the transaction of the removed block to be dropped")
+	}
+	if number, ok, _ := s.TxBlockNumber(txHashes[1]); !ok || number != 2 {
+		t.Fatalf("expected the transaction in the block 2, got %d", number)
+	}
+	s.Close()
+
+	// a broken index is rebuilt from the blocks on start
+	if err := os.WriteFile(filepath.Join(getTxIndexDir(dir), txIndexHeightFile), []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewState(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if number, ok, _ := s.TxBlockNumber(txHashes[0]); !ok || number != 1 {
+		t.Fatalf("expected the rebuilt index to find the transaction in the block 1, got %d", number)
+	}
+	if _, ok, _ := s.TxBlockNumber(txHashes[3]); ok {
+		t.Fatal("expected the rebuilt index to skip the removed blocks")
+	}
+}
+
+// The index reports the numbers of the blocks, even if they don't follow the positions in the chain.
+func TestState_TxIndexBlockNumbers(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	dir := setupTestDataDir(t, map[common.Address]uint{from: 100000})
+	s, err := NewState(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var (
+		blockHashes []Hash
+		txHashes    []Hash
+	)
+	startTime := time.Now().Add(-5 * time.Minute)
+	for i := 0; i < 3; i++ {
+		tx := signTestTx(t, *NewTx(from, NewAccount("0x01"), "", 1, s.NextAccountNonce(from)), key)
+		block := NewBlock(Hash{}, uint64(10+i), 0, []SignedTx{tx}, NewAccount("miner"))
+		block.Header.Time = uint64(startTime.Add(time.Duration(i) * time.Second).Unix())
+		block = mineTestBlock(t, block)
+		hash, err := s.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txHash, err := tx.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		blockHashes, txHashes = append(blockHashes, hash), append(txHashes, txHash)
+	}
+
+	for i, txHash := range txHashes {
+		if number, ok, err := s.TxBlockNumber(txHash); err != nil || !ok || number != uint64(10+i) {
+			t.Fatalf("expected the transaction in the block %d, got %d %v %v", 10+i, number, ok, err)
+		}
+	}
+	if _, err := s.RewindTo(blockHashes[1], dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := s.TxBlockNumber(txHashes[2]); ok {
+		t.Fatal("expected the transaction of the removed block to be dropped")
+	}
+	if number, ok, _ := s.TxBlockNumber(txHashes[1]); !ok || number != 11 {
+		t.Fatalf("expected the transaction in the block 11, got %d", number)
+	}
+}
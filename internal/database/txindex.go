@@ -0,0 +1,169 @@
+package database
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	txIndexDir        = "txindex"
+	txIndexHeightFile = "height"
+	// a record is the transaction hash and the number of its block
+	txIndexRecordSize = 32 + 8
+)
+
+// txIndex maps the hashes of the mined transactions to the numbers of their blocks. The blocks are indexed
+// in the chain order, the height is the position of the last indexed one, starting from 1. The records
+// are kept on disk in 256 bucket files by the first byte of the hash, so a lookup reads a single small file
+// and the index takes no memory.
+type txIndex struct {
+	dir string
+	// the number of the indexed blocks
+	height uint64
+}
+
+func getTxIndexDir(dirname string) string {
+	return filepath.Join(getDbDir(dirname), txIndexDir)
+}
+
+// Open the index of the data directory. A missing or unreadable height starts the index from scratch.
+func openTxIndex(dirname string) (*txIndex, error) {
+	ix := &txIndex{dir: getTxIndexDir(dirname)}
+	content, err := os.ReadFile(filepath.Join(ix.dir, txIndexHeightFile))
+	if err == nil {
+		if ix.height, err = strconv.ParseUint(string(content), 10, 64); err == nil {
+			return ix, nil
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logger.Printf("rebuilding the transaction index: %v\n", err)
+	}
+	if err := os.RemoveAll(ix.dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(ix.dir, 0700); err != nil {
+		return nil, err
+	}
+	return ix, nil
+}
+
+func (ix *txIndex) bucket(hash Hash) string {
+	return filepath.Join(ix.dir, hex.EncodeToString(hash[:1]))
+}
+
+// Index the transactions of the block at the height. The blocks are indexed in order,
+// the already indexed ones are skipped.
+func (ix *txIndex) add(b Block, height uint64) error {
+	if height <= ix.height {
+		return nil
+	}
+	if height != ix.height+1 {
+		return fmt.Errorf("the transaction index is at the height %d, could not index the block at %d", ix.height, height)
+	}
+	buckets := make(map[string][]byte)
+	for _, tx := range b.Payload {
+		hash, err := tx.Hash()
+		if err != nil {
+			return err
+		}
+		record := make([]byte, txIndexRecordSize)
+		copy(record, hash[:])
+		binary.BigEndian.PutUint64(record[32:], b.Header.Number)
+		path := ix.bucket(hash)
+		buckets[path] = append(buckets[path], record...)
+	}
+	for path, records := range buckets {
+		if err := appendFile(path, records); err != nil {
+			return err
+		}
+	}
+	return ix.setHeight(height)
+}
+
+// The number of the block, which includes the transaction.
+func (ix *txIndex) lookup(hash Hash) (uint64, bool, error) {
+	content, err := os.ReadFile(ix.bucket(hash))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if len(content)%txIndexRecordSize != 0 {
+		return 0, false, errors.New("corrupted transaction index bucket")
+	}
+	// the latest record wins
+	for i := len(content) - txIndexRecordSize; i >= 0; i -= txIndexRecordSize {
+		if Hash(content[i:i+32]) == hash {
+			return binary.BigEndian.Uint64(content[i+32 : i+txIndexRecordSize]), true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// Drop the records of the blocks above the height, the last kept block has the number.
+func (ix *txIndex) truncate(height, number uint64) error {
+	entries, err := os.ReadDir(ix.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == txIndexHeightFile || len(entry.Name()) != 2 {
+			continue
+		}
+		path := filepath.Join(ix.dir, entry.Name())
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		kept := content[:0]
+		for i := 0; i+txIndexRecordSize <= len(content); i += txIndexRecordSize {
+			if binary.BigEndian.Uint64(content[i+32:i+txIndexRecordSize]) <= number {
+				kept = append(kept, content[i:i+txIndexRecordSize]...)
+			}
+		}
+		if err := os.WriteFile(path, kept, 0600); err != nil {
+			return err
+		}
+	}
+	return ix.setHeight(min(ix.height, height))
+}
+
+func (ix *txIndex) setHeight(height uint64) error {
+	path := filepath.Join(ix.dir, txIndexHeightFile)
+	if err := os.WriteFile(path+".tmp", []byte(strconv.FormatUint(height, 10)), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	ix.height = height
+	return nil
+}
+
+func appendFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// The number of the block, which includes the transaction with the hash, if it's mined.
+func (s *State) TxBlockNumber(hash Hash) (uint64, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.txIndex == nil {
+		return 0, false, fmt.Errorf("the transaction index isn't open")
+	}
+	return s.txIndex.lookup(hash)
+}
@@ -0,0 +1,321 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"time"
+)
+
+var (
+	// The number of peers the blocks are downloaded from at once.
+	SYNC_MAX_DOWNLOAD_PEERS = 4
+	// The number of block ranges downloaded before they are applied.
+	SYNC_DOWNLOAD_WINDOW = 16
+	// How many times a range is re-requested from another peer, before the sync is aborted.
+	SYNC_MAX_RETRIES = 3
+)
+
+// syncPeer is a peer, which is ahead of the local chain.
+type syncPeer struct {
+	peer   PeerNode
+	client peerClient
+	status GetPeerNodeStatusResponse
+}
+
+// blockRange is a range of the validated headers, whose blocks are requested from a single peer.
+type blockRange struct {
+	start, end int
+	attempts   int
+}
+
+type rangeResult struct {
+	start  int
+	blocks []database.Block
+	// the node id of the peer, which served the blocks
+	from string
+	err  error
+}
+
+// syncProgress is the progress of the current sync, reported in the node's status.
+type syncProgress struct {
+	mu           sync.Mutex
+	syncing      bool
+	startedAt    time.Time
+	startBlock   uint64
+	currentBlock uint64
+	headersBlock uint64
+	targetBlock  uint64
+	peers        int
+	// how many local blocks the peers' chain diverged from, reported until the next sync
+	divergence uint64
+}
+
+type SyncProgressRes struct {
+	Syncing      bool   `json:"syncing"`
+	StartedAt    int64  `json:"started_at,omitempty"`
+	StartBlock   uint64 `json:"start_block"`
+	CurrentBlock uint64 `json:"current_block"`
+	HeadersBlock uint64 `json:"headers_block"`
+	TargetBlock  uint64 `json:"target_block"`
+	Peers        int    `json:"peers"`
+	// the depth of the local blocks replaced by the peers' chain, or of a shorter fork
+	DivergenceDepth uint64 `json:"divergence_depth"`
+}
+
+func (p *syncProgress) start(now time.Time, current, target uint64, peers int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.syncing, p.startedAt = true, now
+	p.startBlock, p.currentBlock, p.headersBlock, p.targetBlock, p.peers = current, current, current, target, peers
+	p.divergence = 0
+}
+
+func (p *syncProgress) setCurrent(current uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.currentBlock = current
+}
+
+func (p *syncProgress) setHeaders(headers uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.headersBlock = headers
+}
+
+func (p *syncProgress) setDivergence(depth uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.divergence = depth
+}
+
+func (p *syncProgress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.syncing, p.peers = false, 0
+}
+
+func (p *syncProgress) view() SyncProgressRes {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := SyncProgressRes{
+		Syncing:      p.syncing,
+		StartBlock:   p.startBlock,
+		CurrentBlock: p.currentBlock,
+		HeadersBlock: p.headersBlock,
+		TargetBlock:  p.targetBlock,
+		Peers:        p.peers,
+
+		DivergenceDepth: p.divergence,
+	}
+	if !p.startedAt.IsZero() {
+		res.StartedAt = p.startedAt.Unix()
+	}
+	return res
+}
+
+// Sync the local chain with the peers, which are ahead of it. The headers are downloaded
+// from the best peer, the blocks are downloaded from all of them concurrently.
+func (n *Node) syncChain(ctx context.Context, peers []syncPeer) error {
+	var ahead []syncPeer
+	for _, sp := range peers {
+		if sp.status.BlockNumber >= n.state.NextBlockNumber() {
+			ahead = append(ahead, sp)
+		}
+	}
+	if len(ahead) == 0 {
+		return nil
+	}
+	sort.SliceStable(ahead, func(i, j int) bool {
+		return ahead[i].status.BlockNumber > ahead[j].status.BlockNumber
+	})
+
+	current := n.state.GetLastBlock().Header.Number
+	n.progress.start(n.clock.Now(), current, ahead[0].status.BlockNumber, min(len(ahead), SYNC_MAX_DOWNLOAD_PEERS))
+	defer n.progress.finish()
+
+	var err error
+	for _, sp := range ahead {
+		if err = n.syncHeaders(ctx, sp.peer, sp.client, sp.status.BlockNumber); err == nil {
+			break
+		}
+		logger.Printf(".syncChain() could not sync the headers from peer %s: %v\n", sp.peer.TcpAddress(), err)
+	}
+	if err != nil {
+		return err
+	}
+	fork, err := n.switchFork()
+	if err != nil {
+		return err
+	}
+	_, tip := n.headers.tip()
+	n.progress.setHeaders(tip)
+
+	synced, err := n.downloadBlocks(ctx, ahead)
+	if err != nil && fork != nil {
+		reverted, revertErr := n.revertFork(fork)
+		if reverted {
+			synced = nil
+		}
+		err = errors.Join(err, revertErr)
+	}
+	if synced != nil {
+		// announce the new tip only, the peers request the rest of the blocks themselves
+		n.announceBlock(*synced, "")
+	}
+	return err
+}
+
+// Download the blocks of the validated headers, window by window. Returns the last added block.
+func (n *Node) downloadBlocks(ctx context.Context, peers []syncPeer) (*database.Block, error) {
+	var last *database.Block
+	for n.headers.len() > 0 {
+		hashes := n.headers.next(SYNC_BLOCKS_BATCH * SYNC_DOWNLOAD_WINDOW)
+		synced, err := n.downloadWindow(ctx, peers, hashes)
+		if synced != nil {
+			last = synced
+		}
+		if err != nil {
+			return last, err
+		}
+	}
+	return last, nil
+}
+
+// Download the blocks of the hashes concurrently from the peers, and add them to the state in order.
+// A range, which a peer fails to serve, is re-requested from another peer.
+func (n *Node) downloadWindow(ctx context.Context, peers []syncPeer, hashes []database.Hash) (*database.Block, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	from := *n.state.GetLastHash()
+	ranges := (len(hashes) + SYNC_BLOCKS_BATCH - 1) / SYNC_BLOCKS_BATCH
+	work := make(chan *blockRange, ranges)
+	for start := 0; start < len(hashes); start += SYNC_BLOCKS_BATCH {
+		work <- &blockRange{start: start, end: min(start+SYNC_BLOCKS_BATCH, len(hashes))}
+	}
+	results := make(chan rangeResult)
+	var wg sync.WaitGroup
+	for _, sp := range peers[:min(len(peers), SYNC_MAX_DOWNLOAD_PEERS)] {
+		wg.Add(1)
+		go func(sp syncPeer) {
+			defer wg.Done()
+			n.downloadWorker(ctx, sp, from, hashes, work, results)
+		}(sp)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var (
+		last    *database.Block
+		next    int
+		pending = make(map[int]rangeResult)
+	)
+	for res := range results {
+		if res.err != nil {
+			return last, res.err
+		}
+		pending[res.start] = res
+		// add the downloaded blocks, which follow the local chain
+		for r, ok := pending[next]; ok; r, ok = pending[next] {
+			delete(pending, next)
+			for _, block := range r.blocks {
+				if _, err := n.state.AddBlock(block); err != nil {
+					// the block matches the validated header, so the chain itself is invalid
+					n.headers.reset()
+					n.adjustPeerScore(r.from, PEER_SCORE_INVALID_DATA, err.Error())
+					return last, err
+				}
+				n.headers.pop()
+				// Need to notify the Miner logic, in order to stop processing pending transactions,
+				// due to incommed new block
+				n.notifyNewBlock(block)
+				last = &block
+			}
+			next += len(r.blocks)
+			n.progress.setCurrent(last.Header.Number)
+		}
+		if next == len(hashes) {
+			logger.Printf(".downloadWindow() synced blocks up to %d\n", last.Header.Number)
+			return last, nil
+		}
+	}
+	return last, fmt.Errorf("no peer could serve the blocks after %d", n.state.GetLastBlock().Header.Number)
+}
+
+// Download the ranges from the peer, until the work is done. A failed range is put back for
+// another peer, and the worker stops, so the peer isn't asked again during this window.
+func (n *Node) downloadWorker(ctx context.Context, sp syncPeer, from database.Hash, hashes []database.Hash, work chan *blockRange, results chan<- rangeResult) {
+	for {
+		var r *blockRange
+		select {
+		case r = <-work:
+		case <-ctx.Done():
+			return
+		}
+		blocks, err := n.fetchRange(ctx, sp, from, hashes, r)
+		if err != nil {
+			logger.Printf(".downloadWorker() peer %s failed the blocks %d..%d: %v\n", sp.peer.TcpAddress(), r.start, r.end, err)
+			r.attempts++
+			if r.attempts > SYNC_MAX_RETRIES {
+				select {
+				case results <- rangeResult{start: r.start, err: fmt.Errorf("the blocks range failed %d times: %w", r.attempts, err)}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			work <- r
+			return
+		}
+		if r.start+len(blocks) < r.end {
+			// the rest of the range didn't fit into the response
+			work <- &blockRange{start: r.start + len(blocks), end: r.end, attempts: r.attempts}
+		}
+		select {
+		case results <- rangeResult{start: r.start, blocks: blocks, from: sp.peer.ID}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Request the blocks of the range and validate them against the headers.
+func (n *Node) fetchRange(ctx context.Context, sp syncPeer, from database.Hash, hashes []database.Hash, r *blockRange) ([]database.Block, error) {
+	after := from
+	if r.start > 0 {
+		after = hashes[r.start-1]
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, SYNC_REQUEST_TIMEOUT)
+	res, err := sp.client.getBlocks(reqCtx, after, r.end-r.start)
+	cancel()
+	if err != nil {
+		if ctx.Err() == nil {
+			n.adjustPeerScore(sp.peer.ID, PEER_SCORE_TIMEOUT, err.Error())
+		}
+		return nil, err
+	}
+	if len(res.Blocks) == 0 {
+		return nil, errors.New("the peer returned no blocks")
+	}
+	blocks := res.Blocks[:min(len(res.Blocks), r.end-r.start)]
+	for i, block := range blocks {
+		hash, err := block.Hash()
+		if err != nil {
+			return nil, err
+		}
+		if hash != hashes[r.start+i] {
+			// the peer may follow another chain
+			return nil, fmt.Errorf("%w: block %d is %s, expected %s", errSyncMismatch, block.Header.Number, hash, hashes[r.start+i])
+		}
+		if err := database.ValidateTxRoot(block); err != nil {
+			n.adjustPeerScore(sp.peer.ID, PEER_SCORE_INVALID_DATA, err.Error())
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
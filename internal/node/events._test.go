@@ -0,0 +1,120 @@
+package node
+
+import (
+	"context"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"testing"
+	"time"
+)
+
+func TestEventBus_NonBlocking(t *testing.T) {
+	bus := newEventBus()
+	blocks := bus.subscribe(1, EventNewBlock)
+	all := bus.subscribe(10)
+
+	bus.publish(Event{Type: EventNewBlock})
+	bus.publish(Event{Type: EventTxAdmitted})
+	// the buffer of the blocks subscriber is full, the publisher doesn't wait for it
+	bus.publish(Event{Type: EventNewBlock})
+
+	if e := <-blocks.Events(); e.Type != EventNewBlock {
+		t.Fatalf("expected a new block event, got %s", e.Type)
+	}
+	if blocks.Dropped() != 1 {
+		t.Fatalf("expected one event to be dropped, got %d", blocks.Dropped())
+	}
+	if len(all.Events()) != 3 || all.Dropped() != 0 {
+		t.Fatalf("expected all the events to be delivered, got %d", len(all.Events()))
+	}
+
+	blocks.Close()
+	if _, ok := <-blocks.Events(); ok {
+		t.Fatal("expected the subscription to be closed")
+	}
+	bus.close()
+	for range all.Events() {
+	}
+	if _, ok := <-bus.subscribe(1).Events(); ok {
+		t.Fatal("expected the subscriptions of a closed bus to be closed")
+	}
+}
+
+func TestNode_PublishesEvents(t *testing.T) {
+	key := newTestKey(t)
+	s := setupMempoolTestState(t, key)
+	n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+	n.state, n.opened = s, true
+	sub := n.Subscribe(EventTxAdmitted, EventTxDropped, EventNewBlock)
+	defer sub.Close()
+
+	original := signTestTx(t, key, 1, 800, 100)
+	replacement := signTestTx(t, key, 1, 800, 150)
+	for _, tx := range []database.SignedTx{original, replacement} {
+		if err := n.AddPendingTX(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pending := newPendingBlockAt(*s.GetLastHash(), s.NextBlockNumber(), []database.SignedTx{replacement}, database.NewAccount("miner"), time.Now())
+	block, err := Mine(context.Background(), pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	n.notifyNewBlock(block)
+
+	originalHash, _ := original.Hash()
+	replacementHash, _ := replacement.Hash()
+	blockHash, _ := block.Hash()
+	var got []Event
+	for len(sub.Events()) > 0 {
+		got = append(got, <-sub.Events())
+	}
+	if len(got) != 4 {
+		t.Fatalf("expected 4 events, got %+v", got)
+	}
+	if got[0].Type != EventTxAdmitted || got[0].Tx.Hash != originalHash.String() {
+		t.Fatalf("expected the original transaction to be admitted, got %+v", got[0])
+	}
+	if got[1].Type != EventTxDropped || got[1].Tx.Hash != originalHash.String() || got[1].Tx.ReplacedBy != replacementHash.String() {
+		t.Fatalf("expected the original transaction to be replaced, got %+v", got[1])
+	}
+	if got[2].Type != EventTxAdmitted || got[2].Tx.Hash != replacementHash.String() {
+		t.Fatalf("expected the replacement to be admitted, got %+v", got[2])
+	}
+	if got[3].Type != EventNewBlock || got[3].Block.Hash != blockHash || got[3].Block.TXs != 1 {
+		t.Fatalf("expected the new block, got %+v", got[3])
+	}
+}
+
+func TestNode_MinerCancelsOnNewBlock(t *testing.T) {
+	defer func(interval time.Duration) { MINE_PENDING_INTERVAL = interval }(MINE_PENDING_INTERVAL)
+	MINE_PENDING_INTERVAL = time.Hour
+
+	n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		n.mine(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	miningCtx, _ := n.mining.tryBegin(ctx)
+	defer n.mining.end()
+	// the mine loop subscribes asynchronously, publish until it's canceled
+	deadline := time.After(5 * time.Second)
+	for miningCtx.Err() == nil {
+		n.publishNewBlock(database.Block{})
+		select {
+		case <-miningCtx.Done():
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("expected a new block to cancel the mining")
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package node
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"time"
+)
+
+// The default buffer of a subscription. The events, which don't fit the buffer of a slow subscriber,
+// are dropped for it, so the publishers never block.
+var EVENTS_BUFFER = 256
+
+type EventType string
+
+const (
+	EventNewBlock         EventType = "new_block"
+	EventReorg            EventType = "reorg"
+	EventTxAdmitted       EventType = "tx_admitted"
+	EventTxDropped        EventType = "tx_dropped"
+	EventPeerConnected    EventType = "peer_connected"
+	EventPeerDisconnected EventType = "peer_disconnected"
+	EventMiningStarted    EventType = "mining_started"
+	EventMiningStopped    EventType = "mining_stopped"
+)
+
+// All the event types, in the order they're reported by the metrics.
+var EventTypes = []EventType{
+	EventNewBlock, EventReorg, EventTxAdmitted, EventTxDropped,
+	EventPeerConnected, EventPeerDisconnected, EventMiningStarted, EventMiningStopped,
+}
+
+// Event is published by the node on the changes of the chain, the mempool, the peers and the miner.
+// Only the payload of the event's type is set.
+type Event struct {
+	Type   EventType    `json:"type"`
+	Time   time.Time    `json:"time"`
+	Block  *BlockEvent  `json:"block,omitempty"`
+	Reorg  *ReorgEvent  `json:"reorg,omitempty"`
+	Tx     *TxEvent     `json:"tx,omitempty"`
+	Peer   *PeerEvent   `json:"peer,omitempty"`
+	Mining *MiningEvent `json:"mining,omitempty"`
+}
+
+// A block added to the local chain, either mined by the node or received from the peers.
+type BlockEvent struct {
+	Hash   database.Hash `json:"hash"`
+	Number uint64        `json:"number"`
+	TXs    int           `json:"txs"`
+	Miner  string        `json:"miner"`
+}
+
+// The local chain was rewound to the common block with a longer fork.
+type ReorgEvent struct {
+	CommonHash   database.Hash `json:"common_hash"`
+	CommonNumber uint64        `json:"common_number"`
+	// the number of the local blocks removed from the chain
+	Removed int `json:"removed"`
+}
+
+type TxEvent struct {
+	Hash  string `json:"hash"`
+	From  string `json:"from"`
+	Nonce uint   `json:"nonce"`
+	// why the transaction was dropped
+	Reason     string `json:"reason,omitempty"`
+	ReplacedBy string `json:"replaced_by,omitempty"`
+}
+
+type PeerEvent struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	// why the peer was disconnected
+	Reason string `json:"reason,omitempty"`
+}
+
+// The miner started or stopped mining a block.
+type MiningEvent struct {
+	Number uint64 `json:"number"`
+	TXs    int    `json:"txs"`
+	// the hash of the mined block, empty if the mining was stopped before a block was found
+	Hash  string `json:"hash,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Subscription receives the events of the subscribed types, until it's closed.
+type Subscription struct {
+	bus   *eventBus
+	ch    chan Event
+	types map[EventType]bool
+	// the events dropped, because the buffer was full
+	dropped atomic.Uint64
+}
+
+// The channel of the events. It's closed, when the subscription or the node is closed.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// The number of the events dropped, because the subscriber didn't keep up with them.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+func (s *Subscription) Close() {
+	s.bus.unsubscribe(s)
+}
+
+func (s *Subscription) wants(t EventType) bool {
+	return len(s.types) == 0 || s.types[t]
+}
+
+// eventBus delivers the published events to the subscribers without blocking the publisher.
+type eventBus struct {
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe to the events of the given types, or to all the events if no types are given.
+// The buffer should fit the bursts of the events, e.g. a mined block drops many transactions.
+func (b *eventBus) subscribe(buffer int, types ...EventType) *Subscription {
+	s := &Subscription{bus: b, ch: make(chan Event, buffer), types: make(map[EventType]bool, len(types))}
+	for _, t := range types {
+		s.types[t] = true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(s.ch)
+		return s
+	}
+	b.subs[s] = struct{}{}
+	return s
+}
+
+func (b *eventBus) unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+}
+
+func (b *eventBus) publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subs {
+		if !s.wants(e.Type) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Close the subscriptions, the later ones are closed right away.
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		close(s.ch)
+	}
+	b.subs = make(map[*Subscription]struct{})
+	b.closed = true
+}
+
+// Subscribe to the node events of the given types, or to all the events if no types are given.
+// The subscription should be closed, when it's not needed anymore.
+func (n *Node) Subscribe(types ...EventType) *Subscription {
+	return n.events.subscribe(EVENTS_BUFFER, types...)
+}
+
+func (n *Node) publish(e Event) {
+	e.Time = n.clock.Now()
+	n.events.publish(e)
+}
+
+func (n *Node) publishNewBlock(block database.Block) {
+	hash, err := block.Hash()
+	if err != nil {
+		return
+	}
+	n.publish(Event{Type: EventNewBlock, Block: &BlockEvent{
+		Hash:   hash,
+		Number: block.Header.Number,
+		TXs:    len(block.Payload),
+		Miner:  block.Header.Miner.Hex(),
+	}})
+}
+
+func (n *Node) publishTxDropped(tx database.SignedTx, dropped droppedTx) {
+	n.publish(Event{Type: EventTxDropped, Tx: &TxEvent{
+		Hash:       dropped.hash,
+		From:       tx.From.Hex(),
+		Nonce:      tx.Nonce,
+		Reason:     dropped.reason,
+		ReplacedBy: dropped.replacedBy,
+	}})
+}
+
+// eventMetrics counts the node events by type.
+type eventMetrics struct {
+	mu     sync.Mutex
+	counts map[EventType]uint64
+	// the events the metrics didn't keep up with
+	dropped uint64
+}
+
+// Count the events of the subscription, until the context is done.
+func (m *eventMetrics) run(ctx context.Context, sub *Subscription) {
+	defer sub.Close()
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			m.mu.Lock()
+			m.counts[e.Type]++
+			m.dropped = sub.Dropped()
+			m.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type EventMetricsRes struct {
+	Counts  map[EventType]uint64 `json:"counts"`
+	Dropped uint64               `json:"dropped"`
+}
+
+func (m *eventMetrics) view() EventMetricsRes {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := EventMetricsRes{Counts: make(map[EventType]uint64, len(EventTypes)), Dropped: m.dropped}
+	for _, t := range EventTypes {
+		res.Counts[t] = m.counts[t]
+	}
+	return res
+}
+
+// The number of the events published since the node was started, by type.
+func (n *Node) EventMetrics() EventMetricsRes {
+	return n.metrics.view()
+}
@@ -0,0 +1,133 @@
+package node
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"testing"
+	"time"
+)
+
+func TestSeenCache(t *testing.T) {
+	c := newSeenCache(time.Minute)
+	now := time.Now()
+	if !c.markSeen("a", now) {
+		t.Fatal("expected a new hash to be marked")
+	}
+	if c.markSeen("a", now.Add(time.Second)) {
+		t.Fatal("expected an already seen hash to be rejected")
+	}
+	if !c.markSeen("a", now.Add(2*time.Minute)) {
+		t.Fatal("expected an expired hash to be marked again")
+	}
+	c.forget("a")
+	if !c.markSeen("a", now.Add(2*time.Minute)) {
+		t.Fatal("expected a forgotten hash to be marked again")
+	}
+	// the expired entries are swept once per ttl
+	c.markSeen("b", now.Add(4*time.Minute))
+	if _, ok := c.items["a"]; ok {
+		t.Fatal("expected the expired hash to be swept")
+	}
+}
+
+func TestNode_AnnouncedBlockRetried(t *testing.T) {
+	n, client := setupSyncTest(t, 2)
+	blocks, err := client.src.GetBlocksAfter(database.Hash{}, client.dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second block arrives before the first one and is skipped
+	if err := n.HandleAnnouncedBlock(blocks[1], "peer"); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range blocks {
+		if err := n.HandleAnnouncedBlock(b, "peer"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := n.state.NextBlockNumber(); got != blocks[1].Header.Number+1 {
+		t.Fatalf("expected the announced blocks to be applied, got the next block number %d", got)
+	}
+}
+
+// Start a fake peer, which counts the announced transactions.
+func startAnnounceTxPeer(t *testing.T, received *atomic.Int32) *PeerNode {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/node/announce/tx" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var req AnnounceTxReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received.Add(1)
+		json.NewEncoder(w).Encode(GetAddingPeerResponse{Success: true})
+	}))
+	t.Cleanup(srv.Close)
+
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerPort, _ := strconv.Atoi(port)
+	return NewPeerNode(host, uint(peerPort), false, true)
+}
+
+func TestNode_AnnounceTXOnce(t *testing.T) {
+	var received atomic.Int32
+	peer := startAnnounceTxPeer(t, &received)
+	n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+	peer.ID = "peer"
+	if err := n.AddPeer(peer); err != nil {
+		t.Fatal(err)
+	}
+
+	key := newTestKey(t)
+	n.state, n.opened = setupMempoolTestState(t, key), true
+	tx := signTestTx(t, key, 1, 3, 0)
+	if err := n.HandleAnnouncedTX(tx, "other-peer"); err != nil {
+		t.Fatal(err)
+	}
+	// the same transaction announced again, e.g. by another peer
+	if err := n.HandleAnnouncedTX(tx, "another-peer"); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(ANNOUNCE_TIMEOUT)
+	for received.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := received.Load(); got != 1 {
+		t.Fatalf("expected the transaction to be announced once, got %d", got)
+	}
+}
+
+func TestNode_AnnounceSkipsSender(t *testing.T) {
+	var received atomic.Int32
+	peer := startAnnounceTxPeer(t, &received)
+	n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+	peer.ID = "peer"
+	if err := n.AddPeer(peer); err != nil {
+		t.Fatal(err)
+	}
+
+	key := newTestKey(t)
+	n.state, n.opened = setupMempoolTestState(t, key), true
+	tx := signTestTx(t, key, 1, 3, 0)
+	if err := n.HandleAnnouncedTX(tx, peer.ID); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := received.Load(); got != 0 {
+		t.Fatalf("expected no announcement back to the sender, got %d", got)
+	}
+}
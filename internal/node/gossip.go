@@ -0,0 +1,178 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"time"
+)
+
+var (
+	// How long a gossiped block or transaction hash is remembered, in order to not
+	// process and re-announce it again.
+	GOSSIP_SEEN_TTL = 10 * time.Minute
+	// Timeout of a single announcement to a peer.
+	ANNOUNCE_TIMEOUT = 2 * time.Second
+
+	// The announced block fails the validation, which doesn't depend on the local chain.
+	ErrInvalidBlock = errors.New("invalid block")
+)
+
+// seenCache remembers the hashes of the announced blocks and transactions.
+// The expired entries are swept once per TTL.
+type seenCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	items     map[string]time.Time
+	lastSweep time.Time
+}
+
+func newSeenCache(ttl time.Duration) *seenCache {
+	return &seenCache{ttl: ttl, items: make(map[string]time.Time)}
+}
+
+// Mark the hash as seen. Returns false, if the hash was already seen.
+func (c *seenCache) markSeen(hash string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seenAt, ok := c.items[hash]; ok && now.Sub(seenAt) < c.ttl {
+		return false
+	}
+	c.items[hash] = now
+	if now.Sub(c.lastSweep) >= c.ttl {
+		c.lastSweep = now
+		for h, seenAt := range c.items {
+			if now.Sub(seenAt) >= c.ttl {
+				delete(c.items, h)
+			}
+		}
+	}
+	return true
+}
+
+// Forget the hash, e.g. of a block which couldn't be applied yet, so it's processed when it's announced again.
+func (c *seenCache) forget(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.items, hash)
+}
+
+type AnnounceBlockReq struct {
+	Block database.Block `json:"block"`
+	// the node id of the announcing node
+	From string `json:"from"`
+}
+
+type AnnounceTxReq struct {
+	Tx   database.SignedTx `json:"tx"`
+	From string            `json:"from"`
+}
+
+// Announce a new block to the known peers, except the one it was received from.
+func (n *Node) announceBlock(block database.Block, except string) {
+	hash, err := block.Hash()
+	if err != nil {
+		return
+	}
+	n.seen.markSeen(hash.String(), n.clock.Now())
+	req := AnnounceBlockReq{block, n.nodeID}
+	for _, peer := range n.announceTargets(except) {
+		send := func(p PeerNode) {
+			ctx, cancel := context.WithTimeout(context.Background(), ANNOUNCE_TIMEOUT)
+			defer cancel()
+			if err := n.announceClientFor(p).announceBlock(ctx, req); err != nil {
+				logger.Printf(".announceBlock() to peer %s failed %v\n", p.TcpAddress(), err)
+			}
+		}
+		// the transport doesn't block, the announcements are sent in order
+		if n.transport != nil {
+			send(peer)
+		} else {
+			go send(peer)
+		}
+	}
+}
+
+// Announce a new pending transaction to the known peers, except the one it was received from.
+func (n *Node) announceTX(tx database.SignedTx, except string) {
+	req := AnnounceTxReq{tx, n.nodeID}
+	for _, peer := range n.announceTargets(except) {
+		send := func(p PeerNode) {
+			ctx, cancel := context.WithTimeout(context.Background(), ANNOUNCE_TIMEOUT)
+			defer cancel()
+			if err := n.announceClientFor(p).announceTX(ctx, req); err != nil {
+				logger.Printf(".announceTX() to peer %s failed %v\n", p.TcpAddress(), err)
+			}
+		}
+		if n.transport != nil {
+			send(peer)
+		} else {
+			go send(peer)
+		}
+	}
+}
+
+func (n *Node) announceTargets(except string) []PeerNode {
+	var res []PeerNode
+	for _, peer := range n.knownPeersList() {
+		if (except != "" && peer.ID == except) || n.isSelf(peer) {
+			continue
+		}
+		res = append(res, peer)
+	}
+	return res
+}
+
+// Handle a block announced by a peer. The block is validated first, an invalid one fails with ErrInvalidBlock.
+// The block is applied only if it extends the local chain, otherwise it's left for the regular sync.
+// A block, which is not applied, is not remembered as seen, so it's handled again when it's announced after the sync.
+func (n *Node) HandleAnnouncedBlock(block database.Block, from string) error {
+	if err := validateAnnouncedBlock(block); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+	hash, err := block.Hash()
+	if err != nil {
+		return err
+	}
+	if !n.seen.markSeen(hash.String(), n.clock.Now()) {
+		return nil
+	}
+	snapshot := n.state.Snapshot()
+	if block.Header.Number != snapshot.NextBlockNumber() || block.Header.ParentHash != snapshot.LastHash() {
+		n.seen.forget(hash.String())
+		logger.Printf(".HandleAnnouncedBlock() block %d from %s doesn't extend the local chain, skipping\n", block.Header.Number, from)
+		return nil
+	}
+	if _, err := n.state.AddBlock(block); err != nil {
+		n.seen.forget(hash.String())
+		return err
+	}
+	n.notifyNewBlock(block)
+	n.announceBlock(block, from)
+	return nil
+}
+
+// Handle a transaction announced by a peer.
+func (n *Node) HandleAnnouncedTX(tx database.SignedTx, from string) error {
+	hash, err := tx.Hash()
+	if err != nil {
+		return err
+	}
+	if !n.seen.markSeen(hash.String(), n.clock.Now()) {
+		return nil
+	}
+	if err := n.addPendingTX(tx, from); err != nil {
+		n.seen.forget(hash.String())
+		return err
+	}
+	return nil
+}
+
+// Remove the block's transactions from the pending ones and publish the new block, the miner
+// stops mining the same transactions.
+func (n *Node) notifyNewBlock(block database.Block) {
+	n.updateMempool(block)
+	n.publishNewBlock(block)
+}
@@ -0,0 +1,104 @@
+package node
+
+import (
+	"context"
+	"sync"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"testing"
+	"time"
+)
+
+func TestNode_TxJournalRestoresPendingTXs(t *testing.T) {
+	key := newTestKey(t)
+	s := setupMempoolTestState(t, key)
+	dir := t.TempDir()
+
+	n := NewNode(dir, 8085, "localhost", nil, database.NewAccount("miner"), true)
+	n.state, n.opened = s, true
+	tx1, tx2 := signTestTx(t, key, 1, 10, 0), signTestTx(t, key, 2, 20, 0)
+	for _, tx := range []database.SignedTx{tx1, tx2} {
+		if err := n.AddPendingTX(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n.journal.close()
+
+	// the first transaction is mined before the restart
+	pending := newPendingBlockAt(*s.GetLastHash(), s.NextBlockNumber(), []database.SignedTx{tx1}, database.NewAccount("miner"), time.Now())
+	block, err := Mine(context.Background(), pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewNode(dir, 8085, "localhost", nil, database.NewAccount("miner"), true)
+	restarted.state, restarted.opened = s, true
+	if err := restarted.loadTxJournal(); err != nil {
+		t.Fatal(err)
+	}
+	hash2, _ := tx2.Hash()
+	if restarted.mempool.len() != 1 || !restarted.mempool.has(hash2.String()) {
+		t.Fatalf("expected only the second transaction to be restored, got %d", restarted.mempool.len())
+	}
+	// the journal is rewritten without the mined transaction
+	journaled, err := restarted.journal.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journaled) != 1 || journaled[0].Nonce != 2 {
+		t.Fatalf("expected the journal to keep the pending transaction only, got %d", len(journaled))
+	}
+}
+
+func TestNode_TxJournalRotationKeepsAdmittedTXs(t *testing.T) {
+	key := newTestKey(t)
+	n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+	n.state, n.opened = setupMempoolTestState(t, key), true
+	defer n.journal.close()
+
+	// the journal is rotated while the transactions are admitted
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := n.journal.rotate(n.mempool.all); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	const count = 15
+	for nonce := uint(1); nonce <= count; nonce++ {
+		if err := n.AddPendingTX(signTestTx(t, key, nonce, 1, 0)); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	journaled, err := n.journal.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journaled) != count {
+		t.Fatalf("expected all %d admitted transactions to be journaled once, got %d", count, len(journaled))
+	}
+	for i, tx := range journaled {
+		if tx.Nonce != uint(i+1) {
+			t.Fatalf("expected the transaction with nonce %d, got %d", i+1, tx.Nonce)
+		}
+	}
+}
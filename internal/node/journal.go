@@ -0,0 +1,157 @@
+package node
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"time"
+)
+
+const txJournalFile = "transactions.journal"
+
+// How often the journal is rewritten with the pending transactions only.
+var TX_JOURNAL_ROTATION = time.Hour
+
+func GetTxJournalFile(dataDir string) string {
+	return filepath.Join(dataDir, txJournalFile)
+}
+
+// txJournal is the append only file of the admitted transactions, one JSON encoded transaction
+// per line. The pending transactions are restored from it on start.
+type txJournal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func newTxJournal(path string) *txJournal {
+	return &txJournal{path: path}
+}
+
+// Read the journaled transactions. A truncated last line, e.g. after a crash, is skipped, and so
+// is a transaction appended again after a rotation already wrote it.
+func (j *txJournal) load() ([]database.SignedTx, error) {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var txs []database.SignedTx
+	loaded := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var tx database.SignedTx
+		if err := json.Unmarshal(scanner.Bytes(), &tx); err != nil {
+			logger.Printf(".txJournal.load() skipping a corrupted record: %v\n", err)
+			continue
+		}
+		hash, err := tx.Hash()
+		if err != nil {
+			logger.Printf(".txJournal.load() skipping a corrupted record: %v\n", err)
+			continue
+		}
+		if loaded[hash.String()] {
+			continue
+		}
+		loaded[hash.String()] = true
+		txs = append(txs, tx)
+	}
+	return txs, scanner.Err()
+}
+
+func (j *txJournal) insert(tx database.SignedTx) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		f, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		j.file = f
+	}
+	record, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(record, '\n'))
+	return err
+}
+
+// Replace the journal with the pending transactions, dropping the mined and the dropped ones.
+// The pending ones are taken with the journal locked, so a transaction admitted meanwhile is
+// either in them or appended after the rotation, never lost with the old file.
+func (j *txJournal) rotate(pending func() []database.SignedTx) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var content []byte
+	for _, tx := range pending() {
+		record, err := json.Marshal(tx)
+		if err != nil {
+			return err
+		}
+		content = append(append(content, record...), '\n')
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	return os.Rename(tmp, j.path)
+}
+
+func (j *txJournal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// Restore the journaled transactions into the mempool. The ones, which aren't valid against
+// the current state anymore, are dropped, and the journal is rewritten.
+func (n *Node) loadTxJournal() error {
+	txs, err := n.journal.load()
+	if err != nil {
+		return err
+	}
+	restored := 0
+	for _, tx := range txs {
+		if _, err := n.mempool.add(tx, n.state.Snapshot(), n.clock.Now()); err != nil {
+			logger.Printf(".loadTxJournal() dropped tx from %s with nonce %d: %v\n", tx.From, tx.Nonce, err)
+			continue
+		}
+		restored++
+	}
+	logger.Printf(".loadTxJournal() restored %d of %d transactions\n", restored, len(txs))
+	return n.journal.rotate(n.mempool.all)
+}
+
+// Rewrite the journal with the pending transactions periodically.
+func (n *Node) rotateTxJournal(ctx context.Context) {
+	t := time.NewTicker(n.journalRotation)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := n.journal.rotate(n.mempool.all); err != nil {
+				logger.Printf(".rotateTxJournal() %v\n", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"testing"
+	"time"
+)
+
+func TestNode_StartAndClose(t *testing.T) {
+	key := newTestKey(t)
+	dir := setupGenesisDir(t, key)
+	n := NewNode(dir, 8085, "localhost", nil, database.NewAccount("miner"), true)
+	if err := n.AddPendingTX(signTestTx(t, key, 1, 10, 0)); !errors.Is(err, ErrNodeNotOpen) {
+		t.Fatalf("expected the transaction to be rejected before the node is open, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := n.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.AddPendingTX(signTestTx(t, key, 1, 10, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatalf("expected the repeated close to succeed, got %v", err)
+	}
+	// the pending transaction is persisted on close
+	journaled, err := newTxJournal(GetTxJournalFile(dir)).load()
+	if err != nil || len(journaled) != 1 {
+		t.Fatalf("expected the pending transaction to be journaled, got %d %v", len(journaled), err)
+	}
+
+	// the restarted node stops, when the context is canceled
+	restarted := NewNode(dir, 8085, "localhost", nil, database.NewAccount("miner"), true)
+	runCtx, stop := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- restarted.Run(runCtx) }()
+	time.Sleep(100 * time.Millisecond)
+	stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the node to stop on the canceled context")
+	}
+	if restarted.mempool.len() != 1 {
+		t.Fatalf("expected the journaled transaction to be restored, got %d", restarted.mempool.len())
+	}
+}
@@ -0,0 +1,134 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"taraskrasiuk/blockchain_l/internal/p2p"
+)
+
+// The node's state is loaded by Open, the methods depending on it fail until then.
+var ErrNodeNotOpen = errors.New("the node isn't open")
+
+// Start the node services in order: the state, the p2p server, then the sync and the miner.
+// The services run until the context is canceled or the node is closed. Returns without blocking.
+func (n *Node) Start(ctx context.Context) error {
+	logger.Printf(".Start() running node on port %d\n", n.port)
+	if err := n.Open(); err != nil {
+		return err
+	}
+
+	ctx, n.cancel = context.WithCancel(ctx)
+	events := n.Subscribe()
+	n.goService(func() { n.metrics.run(ctx, events) })
+	n.goService(func() { n.rotateTxJournal(ctx) })
+	n.goService(func() { n.sync(ctx) })
+	n.goService(func() { n.mine(ctx) })
+	return nil
+}
+
+// Load the node key, the state and the pending transactions, and start the p2p server. The sync and
+// the mining don't run, the opened node is driven by SyncOnce and MineOnce, e.g. by the simulator.
+func (n *Node) Open() error {
+	key, err := p2p.LoadOrCreateNodeKey(n.dirname)
+	if err != nil {
+		return err
+	}
+	nodeID := p2p.NodeID(&key.PublicKey)
+	logger.Printf(".Open() node id %s\n", nodeID)
+	state, err := database.NewStateWithClock(n.dirname, n.hasGenesisFile, n.clock)
+	if err != nil {
+		return err
+	}
+	// the API may be called concurrently with Open, it reads the fields once isOpen reports the node is open
+	n.mu.Lock()
+	n.key, n.nodeID, n.state, n.opened = key, nodeID, state, true
+	n.mu.Unlock()
+	if err := n.loadTxJournal(); err != nil {
+		return errors.Join(err, n.Close())
+	}
+	if err := n.startP2P(); err != nil {
+		return errors.Join(err, n.Close())
+	}
+	return nil
+}
+
+// Start the node and block, until the context is canceled or the node is closed.
+// Returns the errors of the shutdown.
+func (n *Node) Run(ctx context.Context) error {
+	if err := n.Start(ctx); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return n.Close()
+	case <-n.stopped:
+		return n.closeErr
+	}
+}
+
+// Whether the state is loaded by Open. The fields set by Open are safe to read, once it reports true.
+func (n *Node) isOpen() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.opened
+}
+
+// Run the function as a service of the node, which is waited for on close.
+func (n *Node) goService(f func()) {
+	n.services.Add(1)
+	go func() {
+		defer n.services.Done()
+		f()
+	}()
+}
+
+// Stop the node in the reverse order: cancel the sync and the mining and wait for them to finish,
+// stop the p2p server, persist the peers and the pending transactions, close the state and the event
+// subscriptions last.
+// It's safe to call Close more than once, the later calls return the result of the first one.
+func (n *Node) Close() error {
+	n.closeOnce.Do(func() {
+		fmt.Println("Closing node...")
+		if n.cancel != nil {
+			n.cancel()
+		}
+		n.services.Wait()
+
+		n.mu.Lock()
+		opened, server := n.opened, n.p2p
+		n.mu.Unlock()
+
+		var errs []error
+		if server != nil {
+			if err := server.Stop(); err != nil {
+				errs = append(errs, fmt.Errorf("stopping the p2p server: %w", err))
+			}
+		}
+		if err := n.savePeers(); err != nil {
+			errs = append(errs, fmt.Errorf("saving the peers: %w", err))
+		}
+		if opened {
+			if err := n.journal.rotate(n.mempool.all); err != nil {
+				errs = append(errs, fmt.Errorf("rotating the transactions journal: %w", err))
+			}
+		}
+		if err := n.journal.close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing the transactions journal: %w", err))
+		}
+		if opened {
+			if err := n.state.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("closing the state: %w", err))
+			}
+		}
+		// the subscribers, e.g. the event streams of the API, are done
+		n.events.close()
+		n.closeErr = errors.Join(errs...)
+		if n.closeErr != nil {
+			logger.Printf(".Close() %v\n", n.closeErr)
+		}
+		close(n.stopped)
+	})
+	return n.closeErr
+}
@@ -0,0 +1,235 @@
+package node
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"os"
+	"path/filepath"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"taraskrasiuk/blockchain_l/internal/wallet"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// The state with the accounts of the keys funded by the genesis.
+func setupMempoolTestState(t *testing.T, keys ...*ecdsa.PrivateKey) *database.State {
+	s, err := database.NewState(setupGenesisDir(t, keys...), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// The data directory with the genesis funding the accounts of the keys.
+func setupGenesisDir(t *testing.T, keys ...*ecdsa.PrivateKey) string {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "database"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	gen := database.NewGenesisResource()
+	for _, key := range keys {
+		gen.AddAccount(crypto.PubkeyToAddress(key.PublicKey).Hex(), 1000)
+	}
+	if err := gen.SaveToFile(filepath.Join(dir, "database", "genesis.json")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func signTestTx(t *testing.T, key *ecdsa.PrivateKey, nonce, value, fee uint) database.SignedTx {
+	tx := database.NewTx(crypto.PubkeyToAddress(key.PublicKey), database.NewAccount("0x01"), "", value, nonce)
+	tx.Fee = fee
+	signed, err := wallet.SignTx(*tx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestMempool_Admission(t *testing.T) {
+	key := newTestKey(t)
+	s := setupMempoolTestState(t, key)
+	m := newMempool()
+	now := time.Now()
+
+	first := signTestTx(t, key, 1, 100, 0)
+	if _, err := m.add(first, s.Snapshot(), now); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		tx   database.SignedTx
+		err  error
+	}{
+		{"known", first, ErrTxKnown},
+		{"nonce taken", signTestTx(t, key, 1, 200, 0), ErrTxNonceTaken},
+		{"nonce too low", signTestTx(t, key, 0, 100, 0), ErrTxNonceTooLow},
+		{"nonce too high", signTestTx(t, key, 1000, 100, 0), ErrTxNonceTooHigh},
+		// 1000 - (100 + 50) < 900 + 50
+		{"insufficient funds", signTestTx(t, key, 2, 900, 0), ErrTxInsufficientFunds},
+	}
+	for _, c := range cases {
+		if _, err := m.add(c.tx, s.Snapshot(), now); !errors.Is(err, c.err) {
+			t.Fatalf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	forged := signTestTx(t, key, 2, 10, 0)
+	forged.Value++
+	if _, err := m.add(forged, s.Snapshot(), now); !errors.Is(err, ErrTxForged) {
+		t.Fatalf("expected the forged transaction to be rejected, got %v", err)
+	}
+	if m.len() != 1 {
+		t.Fatalf("expected a single pending transaction, got %d", m.len())
+	}
+}
+
+func TestMempool_PendingOrder(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	s := setupMempoolTestState(t, alice, bob)
+	m := newMempool()
+	now := time.Now()
+
+	txs := []database.SignedTx{
+		signTestTx(t, alice, 2, 1, 500),
+		signTestTx(t, alice, 1, 1, 60),
+		signTestTx(t, bob, 1, 1, 100),
+		// waits for the missing nonce 3
+		signTestTx(t, bob, 4, 1, 400),
+	}
+	for _, tx := range txs {
+		if _, err := m.add(tx, s.Snapshot(), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pending := m.pending(s.Snapshot())
+	expected := []database.SignedTx{txs[2], txs[1], txs[0]}
+	if len(pending) != len(expected) {
+		t.Fatalf("expected %d executable transactions, got %d", len(expected), len(pending))
+	}
+	for i := range expected {
+		if pending[i].From != expected[i].From || pending[i].Nonce != expected[i].Nonce {
+			t.Fatalf("unexpected transaction %d: %s nonce %d", i, pending[i].From, pending[i].Nonce)
+		}
+	}
+	if next := m.nextNonce(crypto.PubkeyToAddress(bob.PublicKey), s.Snapshot()); next != 2 {
+		t.Fatalf("expected the next nonce of bob to fill the gap, got %d", next)
+	}
+}
+
+func TestMempool_LimitsAndExpiry(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	s := setupMempoolTestState(t, alice, bob)
+	m := newMempool()
+	m.maxTxs, m.maxTxsPerSender = 2, 2
+	now := time.Now()
+
+	for nonce := uint(1); nonce <= 2; nonce++ {
+		if _, err := m.add(signTestTx(t, alice, nonce, 1, 60), s.Snapshot(), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.add(signTestTx(t, alice, 3, 1, 60), s.Snapshot(), now); !errors.Is(err, ErrTxNonceTooHigh) {
+		t.Fatalf("expected the sender limit, got %v", err)
+	}
+	if _, err := m.add(signTestTx(t, bob, 1, 1, 60), s.Snapshot(), now); !errors.Is(err, ErrMempoolFull) {
+		t.Fatalf("expected the full mempool to reject the same fee, got %v", err)
+	}
+	// the higher fee evicts the last transaction of alice
+	if _, err := m.add(signTestTx(t, bob, 1, 1, 70), s.Snapshot(), now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if pending := m.pending(s.Snapshot()); len(pending) != 2 || pending[0].From != crypto.PubkeyToAddress(bob.PublicKey) {
+		t.Fatal("expected the transactions of bob and alice's first one")
+	}
+
+	if dropped := m.expire(now.Add(m.ttl + time.Second)); len(dropped) != 1 {
+		t.Fatalf("expected the older transaction to expire, got %d", len(dropped))
+	}
+	if m.len() != 1 {
+		t.Fatalf("expected a single pending transaction, got %d", m.len())
+	}
+}
+
+// The sender's own transaction isn't evicted for its next nonce, the evicted nonce would leave a gap.
+func TestMempool_EvictionSkipsIncomingSender(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	s := setupMempoolTestState(t, alice, bob)
+	m := newMempool()
+	m.maxTxs = 2
+	now := time.Now()
+
+	if _, err := m.add(signTestTx(t, alice, 1, 1, 50), s.Snapshot(), now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.add(signTestTx(t, bob, 1, 1, 100), s.Snapshot(), now); err != nil {
+		t.Fatal(err)
+	}
+	// the cheapest transaction is alice's own, bob's one is evicted instead
+	if _, err := m.add(signTestTx(t, alice, 2, 1, 200), s.Snapshot(), now); err != nil {
+		t.Fatal(err)
+	}
+	if pending := m.pending(s.Snapshot()); len(pending) != 2 || pending[0].From != crypto.PubkeyToAddress(alice.PublicKey) {
+		t.Fatalf("expected both transactions of alice to be minable, got %d", len(pending))
+	}
+
+	// the full mempool of the sender's own transactions rejects its next one
+	m = newMempool()
+	m.maxTxs = 1
+	if _, err := m.add(signTestTx(t, alice, 1, 1, 50), s.Snapshot(), now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.add(signTestTx(t, alice, 2, 1, 200), s.Snapshot(), now); !errors.Is(err, ErrMempoolFull) {
+		t.Fatalf("expected the full mempool, got %v", err)
+	}
+}
+
+func TestMempool_ReplaceByFee(t *testing.T) {
+	key := newTestKey(t)
+	s := setupMempoolTestState(t, key)
+	n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+	n.state, n.opened = s, true
+
+	original := signTestTx(t, key, 1, 800, 100)
+	if err := n.AddPendingTX(original); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.AddPendingTX(signTestTx(t, key, 1, 800, 105)); !errors.Is(err, ErrTxNonceTaken) {
+		t.Fatalf("expected the fee bump to be required, got %v", err)
+	}
+	// the cost of the replaced transaction isn't counted against the balance
+	replacement := signTestTx(t, key, 1, 800, 150)
+	if err := n.AddPendingTX(replacement); err != nil {
+		t.Fatal(err)
+	}
+	originalHash, _ := original.Hash()
+	replacementHash, _ := replacement.Hash()
+	if status := n.TxStatus(originalHash); status.Status != "replaced" || status.ReplacedBy != replacementHash.String() {
+		t.Fatalf("expected the original transaction to be replaced, got %+v", status)
+	}
+	if status := n.TxStatus(replacementHash); status.Status != "pending" {
+		t.Fatalf("expected the replacement to be pending, got %+v", status)
+	}
+	// the replaced transaction re-announced by a peer is ignored
+	if err := n.AddPendingTX(original); err != nil || n.mempool.len() != 1 || !n.mempool.has(replacementHash.String()) {
+		t.Fatalf("expected the replacement only to be pending, got %v", err)
+	}
+
+	if dropped := n.mempool.expire(time.Now().Add(n.mempool.ttl + time.Second)); len(dropped) != 1 {
+		t.Fatalf("expected the replacement to expire, got %d", len(dropped))
+	}
+	if status := n.TxStatus(replacementHash); status.Status != "dropped" || status.Reason != dropExpired {
+		t.Fatalf("expected the replacement to be dropped, got %+v", status)
+	}
+}
@@ -0,0 +1,415 @@
+package node
+
+import (
+	"container/heap"
+	"container/list"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	// The limit of the pending transactions. A new transaction evicts the one with the lowest fee.
+	MEMPOOL_MAX_TXS = 5000
+	// The limit of the pending transactions of a single sender: the nonces must follow the next nonce
+	// of the sender within the limit.
+	MEMPOOL_MAX_TXS_PER_SENDER = 64
+	// How long a transaction stays pending, before it's dropped.
+	MEMPOOL_TX_TTL = 3 * time.Hour
+	// How much higher in percent the fee of a transaction must be to replace the pending one
+	// with the same sender and nonce.
+	MEMPOOL_REPLACE_FEE_BUMP uint = 10
+	// The limit of the remembered replaced and dropped transactions, reported by their status.
+	MEMPOOL_MAX_DROPPED = 1000
+
+	ErrTxKnown             = errors.New("transaction is already pending")
+	ErrTxForged            = errors.New("transaction signature doesn't match the sender")
+	ErrTxReward            = errors.New("reward transactions can't be pending")
+	ErrTxNonceTooLow       = errors.New("transaction nonce is too low")
+	ErrTxNonceTooHigh      = errors.New("transaction nonce is too far ahead")
+	ErrTxNonceTaken        = errors.New("another transaction with the same nonce is pending, the replacement must pay a higher fee")
+	ErrTxReplaced          = errors.New("transaction is replaced by another one")
+	ErrTxInsufficientFunds = errors.New("insufficient funds for the pending transactions")
+	ErrMempoolFull         = errors.New("mempool is full")
+)
+
+// The reasons a transaction is dropped from the mempool.
+const (
+	dropReplaced     = "replaced"
+	dropEvicted      = "evicted"
+	dropStale        = "stale"
+	dropUnaffordable = "unaffordable"
+	dropExpired      = "expired"
+)
+
+// droppedTx is a transaction removed from the mempool before being mined.
+type droppedTx struct {
+	hash   string
+	reason string
+	// the hash of the replacement
+	replacedBy string
+	at         time.Time
+}
+
+type mempoolTx struct {
+	tx      database.SignedTx
+	hash    string
+	addedAt time.Time
+}
+
+// mempool keeps the pending transactions, validated against the latest state. The transactions
+// of a sender are ordered by nonce, the ones, which can be included into the next block, are
+// ordered by fee.
+type mempool struct {
+	mu  sync.Mutex
+	txs map[string]*mempoolTx
+	// sender -> nonce -> tx
+	bySender map[common.Address]map[uint]*mempoolTx
+
+	// the recently dropped transactions, the oldest first
+	dropped      map[string]*list.Element
+	droppedOrder *list.List
+
+	maxTxs          int
+	maxTxsPerSender int
+	ttl             time.Duration
+	feeBump         uint
+	maxDropped      int
+	// called for every dropped transaction, with m.mu held
+	onDrop func(tx database.SignedTx, dropped droppedTx)
+}
+
+func newMempool() *mempool {
+	return &mempool{
+		txs:             make(map[string]*mempoolTx),
+		bySender:        make(map[common.Address]map[uint]*mempoolTx),
+		maxTxs:          MEMPOOL_MAX_TXS,
+		maxTxsPerSender: MEMPOOL_MAX_TXS_PER_SENDER,
+		ttl:             MEMPOOL_TX_TTL,
+		dropped:         make(map[string]*list.Element),
+		droppedOrder:    list.New(),
+		feeBump:         MEMPOOL_REPLACE_FEE_BUMP,
+		maxDropped:      MEMPOOL_MAX_DROPPED,
+	}
+}
+
+// Validate the transaction against the state and add it. A transaction with the nonce of a pending one
+// replaces it, if it pays a fee higher by the fee bump. Returns the hash of the transaction.
+func (m *mempool) add(tx database.SignedTx, view *database.StateView, now time.Time) (string, error) {
+	hash, err := tx.Hash()
+	if err != nil {
+		return "", err
+	}
+	if tx.IsReward() {
+		return "", ErrTxReward
+	}
+	ok, err := tx.IsAuthentic()
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrTxForged, err)
+	}
+	if !ok {
+		return "", ErrTxForged
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.txs[hash.String()]; ok {
+		return hash.String(), ErrTxKnown
+	}
+	if el, ok := m.dropped[hash.String()]; ok && el.Value.(droppedTx).replacedBy != "" {
+		return hash.String(), ErrTxReplaced
+	}
+	next := view.NextAccountNonce(tx.From)
+	if tx.Nonce < next {
+		return "", fmt.Errorf("%w: %d, the next nonce is %d", ErrTxNonceTooLow, tx.Nonce, next)
+	}
+	if tx.Nonce >= next+uint(m.maxTxsPerSender) {
+		return "", fmt.Errorf("%w: %d, the next nonce is %d", ErrTxNonceTooHigh, tx.Nonce, next)
+	}
+	senderTxs := m.bySender[tx.From]
+	replaced, ok := senderTxs[tx.Nonce]
+	if ok && !m.canReplace(replaced.tx, tx) {
+		return "", fmt.Errorf("%w: %d, the pending fee %d", ErrTxNonceTaken, tx.Nonce, replaced.tx.EffectiveFee())
+	}
+	cost := tx.Cost()
+	for _, pending := range senderTxs {
+		if pending != replaced {
+			cost += pending.tx.Cost()
+		}
+	}
+	if balance := view.Balance(tx.From); cost > balance {
+		return "", fmt.Errorf("%w: the balance %d, the cost %d", ErrTxInsufficientFunds, balance, cost)
+	}
+	if replaced == nil && len(m.txs) >= m.maxTxs && !m.evictFor(tx, now) {
+		return "", ErrMempoolFull
+	}
+
+	mtx := &mempoolTx{tx: tx, hash: hash.String(), addedAt: now}
+	if replaced != nil {
+		logger.Printf(".mempool.add() tx %s replaced tx %s with fee %d\n", mtx.hash, replaced.hash, replaced.tx.EffectiveFee())
+		m.dropLocked(replaced, dropReplaced, mtx.hash, now)
+	}
+	m.forgetDroppedLocked(mtx.hash)
+	m.txs[mtx.hash] = mtx
+	if senderTxs == nil {
+		senderTxs = make(map[uint]*mempoolTx)
+		m.bySender[tx.From] = senderTxs
+	}
+	senderTxs[tx.Nonce] = mtx
+	return mtx.hash, nil
+}
+
+// Whether the transaction pays enough to replace the pending one.
+func (m *mempool) canReplace(pending, tx database.SignedTx) bool {
+	fee, pendingFee := tx.EffectiveFee(), pending.EffectiveFee()
+	return fee > pendingFee && fee*100 >= pendingFee*(100+m.feeBump)
+}
+
+// Make room for the transaction by evicting the transaction with the lowest fee, which is the last
+// of its sender, so no nonce gap is left. The transactions of the incoming sender aren't evicted,
+// the new one would follow the evicted nonce. Should be called with m.mu held.
+func (m *mempool) evictFor(tx database.SignedTx, now time.Time) bool {
+	var worst *mempoolTx
+	for sender, senderTxs := range m.bySender {
+		if sender == tx.From {
+			continue
+		}
+		last := senderTxs[maxNonce(senderTxs)]
+		if worst == nil || last.tx.EffectiveFee() < worst.tx.EffectiveFee() ||
+			(last.tx.EffectiveFee() == worst.tx.EffectiveFee() && last.addedAt.After(worst.addedAt)) {
+			worst = last
+		}
+	}
+	if worst == nil || worst.tx.EffectiveFee() >= tx.EffectiveFee() {
+		return false
+	}
+	logger.Printf(".mempool.evictFor() evicted tx %s with fee %d\n", worst.hash, worst.tx.EffectiveFee())
+	m.dropLocked(worst, dropEvicted, "", now)
+	return true
+}
+
+// Remove the transaction and remember why it was dropped. Should be called with m.mu held.
+func (m *mempool) dropLocked(mtx *mempoolTx, reason, replacedBy string, now time.Time) {
+	m.removeLocked(mtx)
+	m.forgetDroppedLocked(mtx.hash)
+	dropped := droppedTx{hash: mtx.hash, reason: reason, replacedBy: replacedBy, at: now}
+	m.dropped[mtx.hash] = m.droppedOrder.PushBack(dropped)
+	if m.onDrop != nil {
+		m.onDrop(mtx.tx, dropped)
+	}
+	for m.droppedOrder.Len() > m.maxDropped {
+		m.forgetDroppedLocked(m.droppedOrder.Front().Value.(droppedTx).hash)
+	}
+}
+
+// Should be called with m.mu held.
+func (m *mempool) forgetDroppedLocked(hash string) {
+	if el, ok := m.dropped[hash]; ok {
+		m.droppedOrder.Remove(el)
+		delete(m.dropped, hash)
+	}
+}
+
+// The reason the transaction was dropped, if it was dropped recently.
+func (m *mempool) droppedTx(hash string) (droppedTx, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.dropped[hash]
+	if !ok {
+		return droppedTx{}, false
+	}
+	return el.Value.(droppedTx), true
+}
+
+func maxNonce(txs map[uint]*mempoolTx) uint {
+	var res uint
+	for nonce := range txs {
+		res = max(res, nonce)
+	}
+	return res
+}
+
+// Should be called with m.mu held.
+func (m *mempool) removeLocked(mtx *mempoolTx) {
+	delete(m.txs, mtx.hash)
+	senderTxs := m.bySender[mtx.tx.From]
+	delete(senderTxs, mtx.tx.Nonce)
+	if len(senderTxs) == 0 {
+		delete(m.bySender, mtx.tx.From)
+	}
+}
+
+// The nonce following the sender's pending transactions without a gap.
+func (m *mempool) nextNonce(sender common.Address, view *database.StateView) uint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nonce := view.NextAccountNonce(sender)
+	for {
+		if _, ok := m.bySender[sender][nonce]; !ok {
+			return nonce
+		}
+		nonce++
+	}
+}
+
+func (m *mempool) has(hash string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.txs[hash]
+	return ok
+}
+
+func (m *mempool) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.txs)
+}
+
+// Remove the transactions included into the block. Returns the removed transactions.
+func (m *mempool) removeMined(block database.Block) []database.SignedTx {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var removed []database.SignedTx
+	for _, tx := range block.Payload {
+		hash, err := tx.Hash()
+		if err != nil {
+			continue
+		}
+		if mtx, ok := m.txs[hash.String()]; ok {
+			removed = append(removed, mtx.tx)
+			m.removeLocked(mtx)
+		}
+	}
+	return removed
+}
+
+// Revalidate the transactions against the new state: drop the mined and the stale ones,
+// and the ones the sender can't pay for anymore. Returns the dropped transactions.
+func (m *mempool) update(view *database.StateView, now time.Time) []database.SignedTx {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var dropped []database.SignedTx
+	for sender, senderTxs := range m.bySender {
+		next := view.NextAccountNonce(sender)
+		balance := view.Balance(sender)
+		nonces := sortedNonces(senderTxs)
+		var cost uint
+		for _, nonce := range nonces {
+			mtx := senderTxs[nonce]
+			reason := dropStale
+			if nonce >= next {
+				if cost += mtx.tx.Cost(); cost <= balance {
+					continue
+				}
+				reason = dropUnaffordable
+			}
+			dropped = append(dropped, mtx.tx)
+			m.dropLocked(mtx, reason, "", now)
+		}
+	}
+	return dropped
+}
+
+// Drop the transactions pending longer than the TTL. Returns the dropped transactions.
+func (m *mempool) expire(now time.Time) []database.SignedTx {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var dropped []database.SignedTx
+	for _, mtx := range m.txs {
+		if now.Sub(mtx.addedAt) > m.ttl {
+			dropped = append(dropped, mtx.tx)
+			m.dropLocked(mtx, dropExpired, "", now)
+		}
+	}
+	return dropped
+}
+
+// The transactions, which can be applied to the state in the order: the transactions of a sender
+// follow the nonces without gaps, the senders' transactions are interleaved by the fee.
+func (m *mempool) pending(view *database.StateView) []database.SignedTx {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	queues := make(txQueues, 0, len(m.bySender))
+	for sender, senderTxs := range m.bySender {
+		var queue []*mempoolTx
+		for nonce := view.NextAccountNonce(sender); ; nonce++ {
+			mtx, ok := senderTxs[nonce]
+			if !ok {
+				break
+			}
+			queue = append(queue, mtx)
+		}
+		if len(queue) > 0 {
+			queues = append(queues, queue)
+		}
+	}
+	heap.Init(&queues)
+	var res []database.SignedTx
+	for queues.Len() > 0 {
+		queue := queues[0]
+		res = append(res, queue[0].tx)
+		if len(queue) == 1 {
+			heap.Pop(&queues)
+			continue
+		}
+		queues[0] = queue[1:]
+		heap.Fix(&queues, 0)
+	}
+	return res
+}
+
+// All pending transactions, ordered by the sender and the nonce.
+func (m *mempool) all() []database.SignedTx {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	senders := make([]common.Address, 0, len(m.bySender))
+	for sender := range m.bySender {
+		senders = append(senders, sender)
+	}
+	sort.Slice(senders, func(i, j int) bool { return senders[i].Cmp(senders[j]) < 0 })
+	res := make([]database.SignedTx, 0, len(m.txs))
+	for _, sender := range senders {
+		for _, nonce := range sortedNonces(m.bySender[sender]) {
+			res = append(res, m.bySender[sender][nonce].tx)
+		}
+	}
+	return res
+}
+
+func sortedNonces(txs map[uint]*mempoolTx) []uint {
+	nonces := make([]uint, 0, len(txs))
+	for nonce := range txs {
+		nonces = append(nonces, nonce)
+	}
+	sort.Slice(nonces, func(i, j int) bool { return nonces[i] < nonces[j] })
+	return nonces
+}
+
+// txQueues is a max heap of the senders' executable transactions by the fee of the first one.
+// The earlier added transaction goes first among the ones with the same fee.
+type txQueues [][]*mempoolTx
+
+func (q txQueues) Len() int { return len(q) }
+
+func (q txQueues) Less(i, j int) bool {
+	if fi, fj := q[i][0].tx.EffectiveFee(), q[j][0].tx.EffectiveFee(); fi != fj {
+		return fi > fj
+	}
+	return q[i][0].addedAt.Before(q[j][0].addedAt)
+}
+
+func (q txQueues) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *txQueues) Push(x any) { *q = append(*q, x.([]*mempoolTx)) }
+
+func (q *txQueues) Pop() any {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
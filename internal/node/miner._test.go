@@ -5,6 +5,8 @@ import (
 	"taraskrasiuk/blockchain_l/internal/database"
 	"testing"
 	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 func createRandomPendingBlock() *PendingBlock {
@@ -31,3 +33,147 @@ func TestMine(t *testing.T) {
 		t.Fatal("the block's hash is not valid")
 	}
 }
+
+func TestSelectBlockTXs(t *testing.T) {
+	var txs []database.SignedTx
+	for i := 0; i < database.MaxBlockTXs+10; i++ {
+		txs = append(txs, *database.NewSignedTx(*database.NewTx(database.NewAccount("andrej"), database.NewAccount("taras"), "", uint(i), uint(i+1)), []byte{}))
+	}
+	selected := selectBlockTXs(txs, time.Now())
+	if len(selected) != database.MaxBlockTXs {
+		t.Fatalf("expected %d transactions in the template, got %d", database.MaxBlockTXs, len(selected))
+	}
+	block := database.NewBlock(database.Hash{}, 1, 0, selected, database.NewAccount("miner"))
+	if err := database.ValidateBlockLimits(block); err != nil {
+		t.Fatalf("expected the template to respect the block limits, got %v", err)
+	}
+}
+
+func TestPowMiner_Threads(t *testing.T) {
+	m := newPowMiner(4)
+	block, err := m.mine(context.Background(), createRandomPendingBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := block.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !database.IsValidBlock(hash) {
+		t.Fatal("the block's hash is not valid")
+	}
+	if m.hashrate() <= 0 {
+		t.Fatal("expected the hashrate of the latest run to be reported")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.mine(ctx, createRandomPendingBlock()); err == nil {
+		t.Fatal("expected the canceled mining to fail")
+	}
+}
+
+func TestPowMiner_RollsExhaustedTemplate(t *testing.T) {
+	m := newPowMiner(2)
+	// a valid nonce is unlikely among 16, so the template is rolled many times
+	m.nonceSpace = 16
+	blockTime := time.Now()
+	m.now = func() time.Time { return blockTime }
+	pending := newPendingBlockAt(database.Hash{}, 1, createRandomPendingBlock().txs, database.NewAccount("test"), blockTime)
+
+	block, err := m.mine(context.Background(), pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := block.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !database.IsValidBlock(hash) {
+		t.Fatal("the block's hash is not valid")
+	}
+	if block.Header.ExtraNonce == 0 || block.Header.Time != uint64(blockTime.Unix()) {
+		t.Fatalf("expected the extra nonce to be rolled with the same time, got %d", block.Header.ExtraNonce)
+	}
+}
+
+func TestNode_BlockTemplateSkipsStaleTXs(t *testing.T) {
+	key := newTestKey(t)
+	s := setupMempoolTestState(t, key)
+	n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+	n.state, n.opened = s, true
+
+	tx1, tx2 := signTestTx(t, key, 1, 10, 0), signTestTx(t, key, 2, 10, 0)
+	for _, tx := range []database.SignedTx{tx1, tx2} {
+		if err := n.AddPendingTX(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// another transaction with the nonce 1 is mined, while the mempool isn't updated yet
+	replaced := signTestTx(t, key, 1, 20, 0)
+	block, err := Mine(context.Background(), newPendingBlockAt(*s.GetLastHash(), s.NextBlockNumber(), []database.SignedTx{replaced}, database.NewAccount("miner"), time.Now().Add(-time.Minute)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	template := n.buildBlockTemplate(time.Now())
+	if txs := template.TXs(); len(txs) != 1 || txs[0].Nonce != 2 {
+		t.Fatalf("expected the stale transaction to be skipped, got %d transactions", len(txs))
+	}
+	if err := n.processPendingTXs(context.Background()); err != nil {
+		t.Fatalf("expected the mined block to apply, got %v", err)
+	}
+	if s.NextAccountNonce(crypto.PubkeyToAddress(key.PublicKey)) != 3 {
+		t.Fatal("expected the second transaction to be mined")
+	}
+}
+
+func TestNode_MinedBlockOnReplacedTipIsDropped(t *testing.T) {
+	key := newTestKey(t)
+	s := setupMempoolTestState(t, key)
+	n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+	n.state, n.opened = s, true
+	if err := n.AddPendingTX(signTestTx(t, key, 1, 10, 0)); err != nil {
+		t.Fatal(err)
+	}
+	stopped := n.Subscribe(EventMiningStopped)
+	defer stopped.Close()
+
+	// a valid first nonce is unlikely, so the template is rolled, while a rival block replaces the tip
+	n.pow.nonceSpace = 1
+	var rival database.Block
+	n.pow.now = func() time.Time {
+		if rival.Header.Number != 0 {
+			return time.Now()
+		}
+		block, err := Mine(context.Background(), newPendingBlockAt(*s.GetLastHash(), s.NextBlockNumber(), []database.SignedTx{signTestTx(t, key, 1, 20, 0)}, database.NewAccount("rival"), time.Now()))
+		if err != nil {
+			t.Error(err)
+			return time.Now()
+		}
+		if _, err := s.AddBlock(block); err != nil {
+			t.Error(err)
+		}
+		rival = block
+		return time.Now()
+	}
+
+	if err := n.processPendingTXs(context.Background()); err != nil {
+		t.Fatalf("expected the stale block to be dropped, got %v", err)
+	}
+	rivalHash, _ := rival.Hash()
+	if rival.Header.Number == 0 || *s.GetLastHash() != rivalHash || s.NextBlockNumber() != 2 {
+		t.Fatal("expected the rival block to stay the tip")
+	}
+	select {
+	case e := <-stopped.Events():
+		if e.Mining.Hash != "" || e.Mining.Error == "" {
+			t.Fatalf("expected the mining to stop with an error, got %+v", e.Mining)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the mining stopped event")
+	}
+}
@@ -4,13 +4,27 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"taraskrasiuk/blockchain_l/internal/database"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 )
 
+var (
+	// The number of the mining workers.
+	MINER_THREADS = runtime.NumCPU()
+
+	ErrNonceSpaceExhausted = errors.New("the nonce space of the header is exhausted")
+)
+
+// How many hashes a mining worker computes between the checks for the cancellation.
+const minerBatch = 1 << 12
+
 type PendingBlock struct {
 	parent database.Hash
 	number uint64
@@ -20,58 +34,259 @@ type PendingBlock struct {
 }
 
 func NewPendingBlock(h database.Hash, n uint64, txs []database.SignedTx, miner common.Address) *PendingBlock {
-	return &PendingBlock{h, n, uint64(time.Now().UnixMilli()), txs, miner}
+	return newPendingBlockAt(h, n, txs, miner, time.Now())
 }
 
-// Main Mine function
-func Mine(ctx context.Context, p *PendingBlock) (database.Block, error) {
-	if len(p.txs) == 0 {
-		return database.Block{}, errors.New("the transactions are missed")
-	}
+// Create a pending block with the block time taken from the given time.
+func newPendingBlockAt(h database.Hash, n uint64, txs []database.SignedTx, miner common.Address, t time.Time) *PendingBlock {
+	return &PendingBlock{h, n, uint64(t.Unix()), txs, miner}
+}
+
+// The space reserved for the block's header and the JSON envelope of the payload,
+// when the block template is filled with transactions.
+const blockHeaderReserve = 512
+
+// Pick the transactions, in the given order, which fit into the block limits and are valid
+// for the block time. Transactions which don't fit are left for the next blocks.
+func selectBlockTXs(txs []database.SignedTx, blockTime time.Time) []database.SignedTx {
 	var (
-		startTime = time.Now()
-		attempt   = 0
-		block     = database.Block{}
-		hash      = database.Hash{}
-		nonce     = *new(uint32)
+		res  []database.SignedTx
+		size = blockHeaderReserve
 	)
-
-	// run the loop
-	for !database.IsValidBlock(hash) {
-		select {
-		case <-ctx.Done():
-			fmt.Println("Mining canceled")
-			return database.Block{}, fmt.Errorf("mining canceled, %s", ctx.Err())
-		default:
+	for _, tx := range txs {
+		if len(res) == database.MaxBlockTXs {
+			break
 		}
-
-		attempt++
-		nonce = generateNonce()
-
-		if attempt%1_000_000 == 0 || attempt == 1 {
-			fmt.Printf("Mining Pending TXs with attempt %d\n", attempt)
+		if err := database.ValidateTxLimits(tx.Tx); err != nil {
+			continue
 		}
-		block = database.NewBlock(p.parent, p.number, nonce, p.txs, p.miner)
-		blockHash, err := block.Hash()
+		if err := database.ValidateTxTime(tx.Tx, blockTime); err != nil {
+			continue
+		}
+		txSize, err := database.TxSize(tx)
 		if err != nil {
-			fmt.Printf("block hash is not valid %v", err)
-			return database.Block{}, err
+			continue
+		}
+		// a transaction and a separating comma
+		if size+txSize+1 > database.MaxBlockSize {
+			continue
 		}
-		hash = blockHash
+		size += txSize + 1
+		res = append(res, tx)
+	}
+	return res
+}
+
+// Build the template of the next block. The executable pending transactions, ordered by the sender
+// nonce and the fee, which fit into the block limits, are applied to a copy of the state, the ones,
+// which don't apply, are skipped. The state may change while the block is mined, so the block
+// is still validated when it's added.
+func (n *Node) buildBlockTemplate(now time.Time) *database.BlockTemplate {
+	n.mempool.expire(now)
+	template := n.state.NewBlockTemplate(now)
+	for _, tx := range selectBlockTXs(n.mempool.pending(n.state.Snapshot()), now) {
+		if err := template.Apply(tx); err != nil {
+			logger.Printf(".buildBlockTemplate() skipping tx from %s with nonce %d: %v\n", tx.From, tx.Nonce, err)
+		}
+	}
+	return template
+}
+
+// Mine the block with MINER_THREADS workers.
+func Mine(ctx context.Context, p *PendingBlock) (database.Block, error) {
+	return newPowMiner(MINER_THREADS).mine(ctx, p)
+}
+
+// Mine the header with the given number of workers, e.g. the header of the work handed out by a node.
+func MineHeader(ctx context.Context, header database.BlockHeader, threads int) (database.BlockHeader, error) {
+	m := newPowMiner(threads)
+	m.start()
+	defer m.stop()
+	return m.mineHeader(ctx, header)
+}
+
+// powMiner searches the nonce of a block with a pool of workers, each one searches its own range
+// of the nonce space. Only the header is hashed, it commits to the payload by the TxRoot.
+type powMiner struct {
+	threads atomic.Int64
+	// the number of the nonces of a header
+	nonceSpace uint64
+	// the time of the rolled templates
+	now func() time.Time
+	// the hashes of the current run
+	hashes atomic.Uint64
+
+	mu        sync.Mutex
+	running   bool
+	startedAt time.Time
+	// the hashrate of the latest run
+	lastRate float64
+}
+
+func newPowMiner(threads int) *powMiner {
+	m := &powMiner{nonceSpace: math.MaxUint32 + 1, now: time.Now}
+	m.setThreads(threads)
+	return m
+}
+
+// Set the number of the workers, it's applied from the next block.
+func (m *powMiner) setThreads(threads int) {
+	m.threads.Store(int64(max(threads, 1)))
+}
+
+func (m *powMiner) getThreads() int {
+	return int(m.threads.Load())
+}
+
+// The hashes per second of the current run, or of the latest one, if the miner is idle.
+func (m *powMiner) hashrate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.running {
+		return m.lastRate
+	}
+	return float64(m.hashes.Load()) / max(time.Since(m.startedAt).Seconds(), 1e-3)
+}
+
+func (m *powMiner) start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hashes.Store(0)
+	m.running, m.startedAt = true, time.Now()
+}
+
+func (m *powMiner) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastRate = float64(m.hashes.Load()) / max(time.Since(m.startedAt).Seconds(), 1e-3)
+	m.running = false
+}
+
+func (m *powMiner) mine(ctx context.Context, p *PendingBlock) (database.Block, error) {
+	if len(p.txs) == 0 {
+		return database.Block{}, errors.New("the transactions are missed")
+	}
+	block := database.NewBlock(p.parent, p.number, 0, p.txs, p.miner)
+	block.Header.Time = p.time
+
+	fmt.Printf("Mining Pending TXs with %d threads\n", m.getThreads())
+	m.start()
+	defer m.stop()
+	startTime := time.Now()
+
+	header, err := m.mineHeader(ctx, block.Header)
+	if err != nil {
+		return database.Block{}, err
 	}
+	block.Header = header
+	hash, err := block.Hash()
+	if err != nil {
+		return database.Block{}, err
+	}
+	elapsed := time.Since(startTime)
+	hashes := m.hashes.Load()
 	fmt.Printf("\nMined new Block '%x'\n using PoW%s:\n", hash, hash)
 	fmt.Printf("\tHeight: '%v'\n", block.Header.Number)
 	fmt.Printf("\tNonce: '%v'\n", block.Header.Nonce)
+	fmt.Printf("\tExtra nonce: '%v'\n", block.Header.ExtraNonce)
 	fmt.Printf("\tCreated: '%v'\n", block.Header.Time)
-	// fmt.Printf("\tMiner: '%v'\n", block.Header.Miner)
-	// fmt.Printf("\tParent: '%v'\n\n", block.Header.Parent.Hex())
-	fmt.Printf("\tAttempt: '%v'\n", attempt)
-	fmt.Printf("\tTime: %s\n\n", time.Since(startTime))
+	fmt.Printf("\tHashes: '%v'\n", hashes)
+	fmt.Printf("\tHashrate: %.0f H/s\n", float64(hashes)/max(elapsed.Seconds(), 1e-3))
+	fmt.Printf("\tTime: %s\n\n", elapsed)
 	return block, nil
 }
 
-func generateNonce() uint32 {
-	s := rand.NewSource(time.Now().UTC().UnixNano())
-	r := rand.New(s)
-	return r.Uint32()
+// Search the valid nonce of the header. When the nonce space of the header is exhausted, the header
+// is rolled to the current time, or to the next extra nonce, if the time hasn't changed.
+func (m *powMiner) mineHeader(ctx context.Context, header database.BlockHeader) (database.BlockHeader, error) {
+	threads := m.getThreads()
+	for {
+		nonce, err := m.searchHeader(ctx, header, threads)
+		if err == nil {
+			header.Nonce = nonce
+			return header, nil
+		}
+		if !errors.Is(err, ErrNonceSpaceExhausted) {
+			return database.BlockHeader{}, err
+		}
+		if now := uint64(m.now().Unix()); now > header.Time {
+			header.Time = now
+		} else {
+			header.ExtraNonce++
+		}
+		logger.Printf(".powMiner.mineHeader() the nonce space is exhausted, mining the block %d with the time %d and the extra nonce %d\n",
+			header.Number, header.Time, header.ExtraNonce)
+	}
+}
+
+// Search the nonce space of the header with the workers. Returns ErrNonceSpaceExhausted,
+// if none of the nonces is valid.
+func (m *powMiner) searchHeader(ctx context.Context, header database.BlockHeader, threads int) (uint32, error) {
+	hasher, err := database.NewNonceHasher(header)
+	if err != nil {
+		return 0, err
+	}
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		found = make(chan uint32, 1)
+		wg    sync.WaitGroup
+		// the workers search the ranges of the nonce space from a random offset,
+		// so the nodes mining the same template don't repeat the work
+		offset = rand.Uint32()
+		span   = (m.nonceSpace + uint64(threads) - 1) / uint64(threads)
+	)
+	for i := 0; i < threads; i++ {
+		from := uint64(i) * span
+		to := min(from+span, m.nonceSpace)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if nonce, ok := m.search(workCtx, hasher, offset, from, to); ok {
+				select {
+				case found <- nonce:
+				default:
+				}
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case nonce := <-found:
+		return nonce, nil
+	default:
+	}
+	if ctx.Err() != nil {
+		fmt.Println("Mining canceled")
+		return 0, fmt.Errorf("mining canceled, %s", ctx.Err())
+	}
+	return 0, ErrNonceSpaceExhausted
+}
+
+// Search the nonces in the range [from, to), shifted by the offset. The context is checked once per batch.
+func (m *powMiner) search(ctx context.Context, hasher *database.NonceHasher, offset uint32, from, to uint64) (uint32, bool) {
+	var (
+		buf    []byte
+		hash   database.Hash
+		hashes uint64
+	)
+	defer func() { m.hashes.Add(hashes) }()
+	for n := from; n < to; n++ {
+		if (n-from)%minerBatch == 0 {
+			m.hashes.Add(hashes)
+			hashes = 0
+			if ctx.Err() != nil {
+				return 0, false
+			}
+		}
+		nonce := offset + uint32(n)
+		hash, buf = hasher.Hash(nonce, buf)
+		hashes++
+		if database.IsValidBlock(hash) {
+			return nonce, true
+		}
+	}
+	return 0, false
 }
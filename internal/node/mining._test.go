@@ -0,0 +1,90 @@
+package node
+
+import (
+	"context"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"testing"
+	"time"
+)
+
+func TestNode_MiningControl(t *testing.T) {
+	key := newTestKey(t)
+	s := setupMempoolTestState(t, key)
+	n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+	n.state, n.opened = s, true
+	if !n.IsMiningEnabled() {
+		t.Fatal("expected mining to be enabled by default")
+	}
+
+	ctx, ok := n.mining.tryBegin(context.Background())
+	if !ok || !n.MiningStatus().Mining {
+		t.Fatal("expected a block to be mined")
+	}
+	if _, ok := n.mining.tryBegin(context.Background()); ok {
+		t.Fatal("expected a single block to be mined at a time")
+	}
+	n.StopMining()
+	if ctx.Err() == nil {
+		t.Fatal("expected the block being mined to be abandoned")
+	}
+	n.mining.end()
+	if status := n.MiningStatus(); status.Enabled || status.Mining {
+		t.Fatalf("expected mining to be stopped, got %+v", status)
+	}
+	if _, ok := n.mining.tryBegin(context.Background()); ok {
+		t.Fatal("expected the disabled miner not to mine")
+	}
+
+	n.SetCoinbase(database.NewAccount("pool"))
+	n.SetMinerThreads(3)
+	n.StartMining()
+	status := n.MiningStatus()
+	if !status.Enabled || status.Coinbase != database.NewAccount("pool").Hex() || status.Threads != 3 {
+		t.Fatalf("unexpected mining status %+v", status)
+	}
+	if err := n.AddPendingTX(signTestTx(t, key, 1, 10, 0)); err != nil {
+		t.Fatal(err)
+	}
+	// the work is handed out for the new coinbase
+	work, err := n.GetWork(database.NewAccount(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if work.Header.Miner != database.NewAccount("pool") {
+		t.Fatalf("expected the work for the new coinbase, got %s", work.Header.Miner)
+	}
+}
+
+// The block being mined on the replaced tip is abandoned on the reorg.
+func TestNode_MiningCanceledOnReorg(t *testing.T) {
+	key := newTestKey(t)
+	n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+	n.state, n.opened = setupMempoolTestState(t, key), true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	miningCtx, ok := n.mining.tryBegin(ctx)
+	if !ok {
+		t.Fatal("expected a block to be mined")
+	}
+	defer n.mining.end()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.mine(ctx)
+	}()
+	// the miner subscribes to the events once it runs, the reorg is published until it's handled
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(5 * time.Second)
+	for miningCtx.Err() == nil {
+		select {
+		case <-ticker.C:
+			n.publish(Event{Type: EventReorg, Reorg: &ReorgEvent{}})
+		case <-timeout:
+			t.Fatal("expected the reorg to cancel the mining")
+		}
+	}
+	cancel()
+	<-done
+}
@@ -0,0 +1,164 @@
+package node
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// miningControl is the runtime state of the local miner, changed by the admin API.
+type miningControl struct {
+	mu       sync.Mutex
+	enabled  bool
+	coinbase common.Address
+	// cancels the block being mined, nil if the miner is idle
+	cancel context.CancelFunc
+}
+
+// Start mining a block, if the mining is enabled and no block is being mined. Returns the context,
+// which is canceled by cancelCurrent. The check and the start are atomic, so a single block is mined at a time.
+func (c *miningControl) tryBegin(ctx context.Context) (context.Context, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.enabled || c.cancel != nil {
+		return nil, false
+	}
+	miningCtx, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
+	return miningCtx, true
+}
+
+// Whether a block is being mined.
+func (c *miningControl) active() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cancel != nil
+}
+
+func (c *miningControl) end() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+}
+
+// Cancel the block being mined, if any.
+func (c *miningControl) cancelCurrent() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+func (c *miningControl) setEnabled(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enabled = enabled
+}
+
+type MiningStatusRes struct {
+	// whether the node mines the pending transactions
+	Enabled bool `json:"enabled"`
+	// whether a block is being mined right now
+	Mining   bool   `json:"mining"`
+	Coinbase string `json:"coinbase"`
+	Threads  int    `json:"threads"`
+	// hashes per second of the current block, or of the latest mined one
+	Hashrate float64 `json:"hashrate"`
+}
+
+func (n *Node) MiningStatus() MiningStatusRes {
+	n.mining.mu.Lock()
+	defer n.mining.mu.Unlock()
+	return MiningStatusRes{
+		Enabled:  n.mining.enabled,
+		Mining:   n.mining.cancel != nil,
+		Coinbase: n.mining.coinbase.Hex(),
+		Threads:  n.pow.getThreads(),
+		Hashrate: n.pow.hashrate(),
+	}
+}
+
+func (n *Node) IsMiningEnabled() bool {
+	n.mining.mu.Lock()
+	defer n.mining.mu.Unlock()
+	return n.mining.enabled
+}
+
+// Resume mining the pending transactions, starting from the next mining interval.
+func (n *Node) StartMining() {
+	n.mining.setEnabled(true)
+	logger.Printf(".StartMining() mining is started\n")
+}
+
+// Stop mining, the block being mined is abandoned. The node keeps relaying the blocks
+// and the transactions, and handing out the work to the external miners.
+func (n *Node) StopMining() {
+	n.mining.setEnabled(false)
+	n.mining.cancelCurrent()
+	logger.Printf(".StopMining() mining is stopped\n")
+}
+
+// The address rewarded for the mined blocks.
+func (n *Node) Coinbase() common.Address {
+	n.mining.mu.Lock()
+	defer n.mining.mu.Unlock()
+	return n.mining.coinbase
+}
+
+// Change the address rewarded for the mined blocks, it's applied from the next block.
+func (n *Node) SetCoinbase(coinbase common.Address) {
+	n.mining.mu.Lock()
+	defer n.mining.mu.Unlock()
+	n.mining.coinbase = coinbase
+}
+
+// Set the number of the mining workers, it's applied from the next block.
+func (n *Node) SetMinerThreads(threads int) {
+	n.pow.setThreads(threads)
+}
+
+// MiningAdminClient controls the mining of a running node by its admin API.
+type MiningAdminClient struct {
+	node PeerNode
+}
+
+func NewMiningAdminClient(ip string, port uint) *MiningAdminClient {
+	return &MiningAdminClient{node: PeerNode{IP: ip, Port: port}}
+}
+
+func (c *MiningAdminClient) Start(ctx context.Context) (MiningStatusRes, error) {
+	return c.post(ctx, "admin/mining/start", struct{}{})
+}
+
+func (c *MiningAdminClient) Stop(ctx context.Context) (MiningStatusRes, error) {
+	return c.post(ctx, "admin/mining/stop", struct{}{})
+}
+
+func (c *MiningAdminClient) SetCoinbase(ctx context.Context, coinbase common.Address) (MiningStatusRes, error) {
+	return c.post(ctx, "admin/mining/coinbase", SetCoinbaseReq{Coinbase: coinbase.Hex()})
+}
+
+func (c *MiningAdminClient) SetThreads(ctx context.Context, threads int) (MiningStatusRes, error) {
+	return c.post(ctx, "admin/mining/threads", SetMinerThreadsReq{Threads: threads})
+}
+
+func (c *MiningAdminClient) post(ctx context.Context, path string, req any) (MiningStatusRes, error) {
+	var res MiningStatusRes
+	if err := postReq(ctx, &c.node, path, req, &res); err != nil {
+		return MiningStatusRes{}, err
+	}
+	return res, nil
+}
+
+type SetCoinbaseReq struct {
+	Coinbase string `json:"coinbase"`
+}
+
+type SetMinerThreadsReq struct {
+	Threads int `json:"threads"`
+}
@@ -2,10 +2,8 @@ package node
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"errors"
 	"os"
-	"sync"
 	"taraskrasiuk/blockchain_l/internal/database"
 	"taraskrasiuk/blockchain_l/internal/wallet"
 	"testing"
@@ -101,6 +99,9 @@ func TestNode_Run(t *testing.T) {
 }
 
 func TestNode_Mining(t *testing.T) {
+	defer func(interval time.Duration) { MINE_PENDING_INTERVAL = interval }(MINE_PENDING_INTERVAL)
+	MINE_PENDING_INTERVAL = 100 * time.Millisecond
+
 	accounts := setup()
 	defer clear()
 
@@ -108,75 +109,60 @@ func TestNode_Mining(t *testing.T) {
 	peerNode := NewPeerNode("localhost", 8080, true, true)
 	n := NewNode(testDir, 8081, "localhost", peerNode, miner, true)
 
-	pctx := context.Background()
-	ctx, cancel := context.WithTimeout(pctx, 20*time.Minute)
-	defer cancel()
-
 	var (
 		acc1 = accounts[0].Address
 		acc2 = accounts[1].Address
-		wg   = sync.WaitGroup{}
 	)
+	// the mining is held, until both transactions are pending
+	n.StopMining()
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	blocks := n.Subscribe(EventNewBlock)
+	defer blocks.Close()
 
-	wg.Add(3)
-	// create 1 transaction
-	go func() {
-		defer wg.Done()
-		time.Sleep(2 * time.Second)
-		tx := database.NewTx(acc1, acc2, "", 100, n.state.NextAccountNonce(acc1))
-
-		signedTx, err := wallet.SignTxWithKeystoreAccount(*tx, acc1, passphrase1, wallet.GetKeystoreDirPath(n.Dirname()))
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if err := n.AddPendingTX(signedTx); err != nil {
-			panic(err)
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		time.Sleep(6 * time.Second)
-		tx := database.NewTx(acc1, acc2, "", 300, n.state.NextAccountNonce(acc1))
+	tx1 := database.NewTx(acc1, acc2, "", 100, n.NextAccountNonce(acc1))
+	signedTx1, err := wallet.SignTxWithKeystoreAccount(*tx1, acc1, passphrase1, wallet.GetKeystoreDirPath(n.Dirname()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.AddPendingTX(signedTx1); err != nil {
+		t.Fatal(err)
+	}
+	// the first transaction is still pending, its nonce is taken
+	tx2 := database.NewTx(acc1, acc2, "", 300, n.NextPendingNonce(acc1))
+	signedTx2, err := wallet.SignTxWithKeystoreAccount(*tx2, acc1, passphrase1, wallet.GetKeystoreDirPath(n.Dirname()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.AddPendingTX(signedTx2); err != nil {
+		t.Fatal(err)
+	}
+	n.StartMining()
 
-		signedTx, err := wallet.SignTxWithKeystoreAccount(*tx, acc1, passphrase1, wallet.GetKeystoreDirPath(n.Dirname()))
-		if err != nil {
-			log.Fatal(err)
+	select {
+	case e := <-blocks.Events():
+		if e.Block.Number != 1 || e.Block.TXs != 2 {
+			t.Fatalf("expected the block 1 of both transactions, got the block %d of %d", e.Block.Number, e.Block.TXs)
 		}
-		if err := n.AddPendingTX(signedTx); err != nil {
-			panic(err)
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		ticker := time.NewTicker(5 * time.Second)
-
-		for {
-			select {
-			case <-ticker.C:
-				if n.state.GetLastBlock().Header.Number == 1 {
-					fmt.Println("height : ", n.state.GetLastBlock().Header.Number)
-					if err := n.Close(); err != nil {
-						panic(err)
-					}
-					return
-				}
-			}
-		}
-	}()
-
-	if err := n.Run(ctx); err != nil {
+	case <-time.After(time.Minute):
+		t.Fatal("expected the pending transactions to be mined")
+	}
+	if err := n.Close(); err != nil {
 		t.Fatal(err)
 	}
-	wg.Wait()
-	if n.state.GetLastBlock().Header.Number > 1 {
-		t.Fatalf("expected a block heaight to be 1 but got %d", n.state.GetLastBlock().Header.Number)
+	if n.state.GetLastBlock().Header.Number != 1 {
+		t.Fatalf("expected a block height to be 1 but got %d", n.state.GetLastBlock().Header.Number)
+	}
+	if balance := n.state.Snapshot().Balance(acc2); balance != 1000+100+300 {
+		t.Fatalf("expected the balance of the recipient to be %d but got %d", 1000+100+300, balance)
 	}
 }
 
 func TestNode_MiningStopsOnNewSyncedBlock(t *testing.T) {
+	defer func(interval time.Duration) { MINE_PENDING_INTERVAL = interval }(MINE_PENDING_INTERVAL)
+	// the block being mined is held by the test, the miner doesn't start one meanwhile
 	MINE_PENDING_INTERVAL = 10 * time.Second
 	accounts := setup()
 	defer clear()
@@ -192,92 +178,76 @@ func TestNode_MiningStopsOnNewSyncedBlock(t *testing.T) {
 	var (
 		acc1 = accounts[0].Address
 		acc2 = accounts[1].Address
-		wg   = sync.WaitGroup{}
 	)
-	tx1 := database.NewTx(acc1, acc2, "", 100, n.state.NextAccountNonce(acc1))
+	// the pending transactions are validated against the state, which is loaded on start
+	if err := n.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	tx1 := database.NewTx(acc1, acc2, "", 100, n.NextAccountNonce(acc1))
 	signedTx1, err := wallet.SignTxWithKeystoreAccount(*tx1, acc1, passphrase1, wallet.GetKeystoreDirPath(n.Dirname()))
 	if err != nil {
 		t.Fatal(err)
 	}
-	tx2 := database.NewTx(acc1, acc2, "", 200, n.state.NextAccountNonce(acc1))
+	// the first transaction is pending, when the second one is added
+	tx2 := database.NewTx(acc1, acc2, "", 200, tx1.Nonce+1)
 	signedTx2, err := wallet.SignTxWithKeystoreAccount(*tx2, acc1, passphrase1, wallet.GetKeystoreDirPath(n.Dirname()))
 	if err != nil {
 		t.Fatal(err)
 	}
-	tx2Hash, _ := tx2.Hash()
+	tx2Hash, _ := signedTx2.Hash()
 
-	firstPendingBlock := NewPendingBlock(database.Hash{}, 0, []database.SignedTx{signedTx1}, acc1)
+	firstPendingBlock := NewPendingBlock(database.Hash{}, n.state.NextBlockNumber(), []database.SignedTx{signedTx1}, acc1)
 	validSyncedBlock, err := Mine(ctx, firstPendingBlock)
 	if err != nil {
 		t.Fatal(err)
 	}
-	wg.Add(3)
-	go func() {
-		defer wg.Done()
-		time.Sleep(MINE_PENDING_INTERVAL - (MINE_PENDING_INTERVAL / 4))
-		err := n.AddPendingTX(signedTx1)
-		if err != nil {
-			panic(err)
+	for _, tx := range []database.SignedTx{signedTx1, signedTx2} {
+		if err := n.AddPendingTX(tx); err != nil {
+			t.Fatal(err)
 		}
-		err = n.AddPendingTX(signedTx2)
-		if err != nil {
-			panic(err)
-		}
-	}()
+	}
 
-	go func() {
-		defer wg.Done()
-		time.Sleep(MINE_PENDING_INTERVAL + (2 * time.Second))
-		if !n.isMining {
-			panic("should be mining")
-		}
-		_, err := n.state.AddBlock(validSyncedBlock)
-		if err != nil {
-			panic(err)
-		}
-		n.newSyncedBlocksCh <- validSyncedBlock
+	// the local PoW takes milliseconds, so the block being mined is held, while the synced block arrives
+	miningCtx, ok := n.mining.tryBegin(ctx)
+	if !ok {
+		t.Fatal("should be mining")
+	}
+	if _, err := n.state.AddBlock(validSyncedBlock); err != nil {
+		t.Fatal(err)
+	}
+	n.notifyNewBlock(validSyncedBlock)
+	select {
+	case <-miningCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("synced block should have canceled mining")
+	}
+	n.mining.end()
 
-		time.Sleep(time.Second * 2)
-		if n.isMining {
-			t.Fatal("synced block should have canceled mining")
-		}
-		// Mined TX1 by Andrej should be removed from the Mempool
-		_, onlyTX2IsPending := n.pendingTXs[tx2Hash.String()]
-		if len(n.pendingTXs) != 1 && !onlyTX2IsPending {
-			t.Fatal("TX1 should be still pending")
-		}
-		time.Sleep(MINE_PENDING_INTERVAL * 2)
-		if !n.isMining {
-			t.Fatal("should attempt to mine TX1 again")
-		}
-	}()
-	go func() {
-		defer wg.Done()
-		// Regularly check whenever both TXs are now mined
-		ticker := time.NewTicker(time.Second * 10)
-		for {
-			select {
-			case <-ticker.C:
-				if n.state.GetLastBlock().Header.Number == 1 {
-					if err := n.Close(); err != nil {
-						panic(err)
-					}
-					return
-				}
-			}
+	// Mined TX1 by Andrej should be removed from the Mempool
+	if n.mempool.len() != 1 || !n.mempool.has(tx2Hash.String()) {
+		t.Fatal("only TX2 should be still pending")
+	}
+	// the miner mines TX2 on the next interval
+	blocks := n.Subscribe(EventNewBlock)
+	defer blocks.Close()
+	select {
+	case e := <-blocks.Events():
+		if e.Block.Number != 2 || e.Block.TXs != 1 {
+			t.Fatalf("expected the block 2 of TX2, got the block %d of %d transactions", e.Block.Number, e.Block.TXs)
 		}
-	}()
-
-	if err := n.Run(ctx); err != nil {
+	case <-time.After(MINE_PENDING_INTERVAL * 3):
+		t.Fatal("should mine TX2 again")
+	}
+	if err := n.Close(); err != nil {
 		t.Fatal(err)
 	}
-	wg.Wait()
 
-	if n.state.GetLastBlock().Header.Number > 1 {
-		t.Fatalf("expected a block heaight to be 1 but got %d", n.state.GetLastBlock().Header.Number)
+	if n.state.GetLastBlock().Header.Number > 2 {
+		t.Fatalf("expected a block heaight to be 2 but got %d", n.state.GetLastBlock().Header.Number)
 	}
 	// check miner balance
-	balance := n.state.Balances[acc1]
+	balance := n.state.Snapshot().Balance(acc1)
 	expectedBalance := 1000 - 100 - 200 + 175 + 175
 	if balance != uint(expectedBalance) /* with 2 rewards */ {
 		t.Fatalf("expected balance for miner account to be %d but got %d", expectedBalance, balance)
@@ -285,7 +255,8 @@ func TestNode_MiningStopsOnNewSyncedBlock(t *testing.T) {
 }
 
 func TestNode_Forged(t *testing.T) {
-	MINE_PENDING_INTERVAL = 10 * time.Second
+	defer func(interval time.Duration) { MINE_PENDING_INTERVAL = interval }(MINE_PENDING_INTERVAL)
+	MINE_PENDING_INTERVAL = 100 * time.Millisecond
 
 	accounts := setup()
 	defer clear()
@@ -294,14 +265,9 @@ func TestNode_Forged(t *testing.T) {
 	peerNode := NewPeerNode("localhost", 8080, true, true)
 	n := NewNode(testDir, 8081, "localhost", peerNode, miner, true)
 
-	pctx := context.Background()
-	ctx, cancel := context.WithTimeout(pctx, 20*time.Minute)
-	defer cancel()
-
 	var (
 		acc1 = accounts[0].Address
 		acc2 = accounts[1].Address
-		wg   = sync.WaitGroup{}
 	)
 	txValue := uint(25)
 
@@ -309,73 +275,52 @@ func TestNode_Forged(t *testing.T) {
 	validSignedTx1, err := wallet.SignTxWithKeystoreAccount(*tx1, acc1, passphrase1, wallet.GetKeystoreDirPath(n.Dirname()))
 	if err != nil {
 		t.Fatal(err)
-		return
 	}
-	if err := n.AddPendingTX(validSignedTx1); err != nil {
+	// the pending transactions are validated against the state, which is loaded on start
+	n.StopMining()
+	if err := n.Start(context.Background()); err != nil {
 		t.Fatal(err)
-		return
-	}
-
-	wg.Add(1)
-
-	go func() {
-		defer wg.Done()
-		ticker := time.NewTicker(MINE_PENDING_INTERVAL + time.Second)
-		wasForgedTxAdded := false
-		for {
-			select {
-			case <-ticker.C:
-				fmt.Println(wasForgedTxAdded, n.isMining)
-				if wasForgedTxAdded && !n.isMining {
-					if err := n.Close(); err != nil {
-						t.Fatal(err)
-					}
-					return
-				}
-				if !wasForgedTxAdded {
-					// create a forged transaction with a signature from first transaction
-					fmt.Println("running forged .... ")
-					forgedTx := database.NewTx(acc1, acc2, "", txValue, 2)
-					signedForgedTx := database.NewSignedTx(*forgedTx, validSignedTx1.Sig)
-					if err := n.AddPendingTX(*signedForgedTx); err != nil {
-						t.Fatal(err)
-						return
-					}
-					wasForgedTxAdded = true
-					time.Sleep(MINE_PENDING_INTERVAL + time.Second)
-				}
-			}
-		}
-	}()
-	if err := n.Run(ctx); err != nil {
+	}
+	defer n.Close()
+	blocks := n.Subscribe(EventNewBlock)
+	defer blocks.Close()
+	if err := n.AddPendingTX(validSignedTx1); err != nil {
 		t.Fatal(err)
 	}
-	wg.Wait()
+	// create a forged transaction with a signature from first transaction,
+	// the mempool rejects it on admission, before it reaches the miner
+	forgedTx := database.NewTx(acc1, acc2, "", txValue, 2)
+	signedForgedTx := database.NewSignedTx(*forgedTx, validSignedTx1.Sig)
+	if err := n.AddPendingTX(*signedForgedTx); !errors.Is(err, ErrTxForged) {
+		t.Fatalf("expected the forged transaction to be rejected, got %v", err)
+	}
+	n.StartMining()
 
-	// if n.state.GetLastBlock().Header.Number != 0 {
-	// 	t.Fatalf("expected only one block to be mined, but latest block header is %d", n.state.GetLastBlock().Header.Number)
-	// }
-	for k, v := range n.state.Balance() {
-		fmt.Printf("%s : %d\n", k.Hex(), v)
+	select {
+	case e := <-blocks.Events():
+		if e.Block.TXs != 1 {
+			t.Fatalf("expected the block of the valid transaction only, got %d transactions", e.Block.TXs)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("expected the valid transaction to be mined")
 	}
-	if n.state.Balances[acc2] != 1000+txValue {
-		t.Fatalf("forged tx succeeded, expected balance should be %d but got %d", 1000+txValue, n.state.Balances[acc2])
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n.state.Snapshot().Balance(acc2) != 1000+txValue {
+		t.Fatalf("forged tx succeeded, expected balance should be %d but got %d", 1000+txValue, n.state.Snapshot().Balance(acc2))
 	}
 }
 
 func TestNode_MiningSpamTransactions(t *testing.T) {
-	MINE_PENDING_INTERVAL = 10 * time.Second
+	defer func(interval time.Duration) { MINE_PENDING_INTERVAL = interval }(MINE_PENDING_INTERVAL)
+	MINE_PENDING_INTERVAL = 100 * time.Millisecond
 
 	accounts := setup()
 	defer clear()
 
 	miner := accounts[0].Address
-	peerNode := NewPeerNode("localhost", 8080, true, true)
-	n := NewNode(testDir, 8081, "localhost", peerNode, miner, true)
-
-	pctx := context.Background()
-	ctx, cancel := context.WithTimeout(pctx, 20*time.Minute)
-	defer cancel()
+	n := NewNode(testDir, 8081, "localhost", nil, miner, true)
 
 	var (
 		acc1                = accounts[0].Address
@@ -383,51 +328,48 @@ func TestNode_MiningSpamTransactions(t *testing.T) {
 		txValue             = uint(100)
 		txCount             = 5
 		initialBalance uint = 1000
-		wg                  = sync.WaitGroup{}
 	)
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for i := 0; i < txCount; i++ {
-			tx1 := database.NewTx(acc1, acc2, "", txValue, uint(i+1))
-			validSignedTx1, err := wallet.SignTxWithKeystoreAccount(*tx1, acc1, passphrase1, wallet.GetKeystoreDirPath(n.Dirname()))
-			if err != nil {
-				t.Fatal(err)
-				return
-			}
-			if err := n.AddPendingTX(validSignedTx1); err != nil {
-				t.Fatal(err)
-				return
-			}
-		}
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	// the mining is held, until all the transactions are pending, so they're mined in one block
+	n.StopMining()
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	blocks := n.Subscribe(EventNewBlock)
+	defer blocks.Close()
 
-		ticker := time.NewTicker(1 * time.Minute)
-		select {
-		case <-ticker.C:
-			n.Close()
-			return
+	for i := 0; i < txCount; i++ {
+		tx := database.NewTx(acc1, acc2, "", txValue, uint(i+1))
+		signedTx, err := wallet.SignTxWithKeystoreAccount(*tx, acc1, passphrase1, wallet.GetKeystoreDirPath(n.Dirname()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.AddPendingTX(signedTx); err != nil {
+			t.Fatal(err)
 		}
-	}()
+	}
+	n.StartMining()
 
-	if err := n.Run(ctx); err != nil {
+	select {
+	case e := <-blocks.Events():
+		if e.Block.Number != 1 || e.Block.TXs != txCount {
+			t.Fatalf("expected the block 1 of %d transactions, got the block %d of %d", txCount, e.Block.Number, e.Block.TXs)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("expected the pending transactions to be mined")
+	}
+	if err := n.Close(); err != nil {
 		t.Fatal(err)
 	}
 
-	wg.Wait()
-
 	var expectedAcc1Balance uint = initialBalance + database.MinerReward - txValue*uint(txCount)
 	var expectedAcc2Balance uint = initialBalance + txValue*uint(txCount)
 
-	if n.state.Balances[acc1] != expectedAcc1Balance {
-		t.Fatalf("expected balance for account 1 should be %d but got %d", expectedAcc1Balance, n.state.Balances[acc1])
+	if n.state.Snapshot().Balance(acc1) != expectedAcc1Balance {
+		t.Fatalf("expected balance for account 1 should be %d but got %d", expectedAcc1Balance, n.state.Snapshot().Balance(acc1))
 	}
-	if n.state.Balances[acc2] != expectedAcc2Balance {
-		t.Fatalf("expected balance for account 1 should be %d but got %d", expectedAcc2Balance, n.state.Balances[acc2])
+	if n.state.Snapshot().Balance(acc2) != expectedAcc2Balance {
+		t.Fatalf("expected balance for account 2 should be %d but got %d", expectedAcc2Balance, n.state.Snapshot().Balance(acc2))
 	}
 }
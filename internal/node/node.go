@@ -2,11 +2,13 @@ package node
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/ecdsa"
+	"errors"
 	"fmt"
-	"net/http"
+	"sort"
 	"sync"
 	"taraskrasiuk/blockchain_l/internal/database"
+	"taraskrasiuk/blockchain_l/internal/p2p"
 	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/keystore"
@@ -22,77 +24,114 @@ var (
 // Node Config
 
 type Node struct {
-	dirname        string
-	ip             string
-	port           uint
-	state          *database.State
-	mu             sync.Mutex
-	knownPeers     map[string]PeerNode
+	dirname string
+	ip      string
+	port    uint
+	state   *database.State
+	// the node key, which authenticates the node to its peers
+	key    *ecdsa.PrivateKey
+	nodeID string
+	mu     sync.Mutex
+	// node id -> peer
+	knownPeers map[string]PeerNode
+	// the bootstrap nodes are known by the address only, until their node id is learned
+	bootstrapPeers []PeerNode
+	// node id -> the end of the ban
+	bannedPeers    map[string]time.Time
 	hasGenesisFile bool // TODO: probably no need
 	// mining
-	pendingTXs        map[string]database.SignedTx
-	archivedTXs       map[string]database.SignedTx
-	newSyncedBlocksCh chan database.Block
-	isMining          bool
-	miner             common.Address
+	mempool         *mempool
+	journal         *txJournal
+	journalRotation time.Duration
+	recentTXs       *recentTxs
+	pow             *powMiner
+	mining          miningControl
+	clock           database.Clock
+	// the chain, mempool, peer and mining events, see events.go
+	events  *eventBus
+	metrics eventMetrics
+	// the templates handed out to the external miners
+	work workSet
+	// gossip
+	seen *seenCache
+	// the validated headers of the blocks being synced
+	headers  headerChain
+	progress syncProgress
+	// p2p, disabled when the port is zero
+	p2pPort uint
+	p2p     *p2p.Server
+	// replaces the HTTP API and the p2p protocol, if it's set
+	transport Transport
+	// lifecycle, see lifecycle.go
+	cancel    context.CancelFunc
+	services  sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+	stopped   chan struct{}
+	// the state is loaded, guarded by mu
+	opened bool
 	// public
 	IsBootstrap bool
-	done        chan struct{}
 }
 
 // TODO: remove hasGenesisFile
 func NewNode(datadir string, port uint, ip string, bootstrap *PeerNode, miner common.Address, hasGenesisFile bool) *Node {
 	node := &Node{
-		dirname:           datadir,
-		ip:                ip,
-		port:              port,
-		knownPeers:        make(map[string]PeerNode),
-		hasGenesisFile:    hasGenesisFile,
-		pendingTXs:        make(map[string]database.SignedTx),
-		archivedTXs:       make(map[string]database.SignedTx),
-		newSyncedBlocksCh: make(chan database.Block),
-		isMining:          false,
-		miner:             miner,
-		done:              make(chan struct{}, 1),
+		dirname:         datadir,
+		ip:              ip,
+		port:            port,
+		knownPeers:      make(map[string]PeerNode),
+		bannedPeers:     make(map[string]time.Time),
+		hasGenesisFile:  hasGenesisFile,
+		mempool:         newMempool(),
+		journal:         newTxJournal(GetTxJournalFile(datadir)),
+		journalRotation: TX_JOURNAL_ROTATION,
+		recentTXs:       newRecentTxs(),
+		pow:             newPowMiner(MINER_THREADS),
+		mining:          miningControl{enabled: true, coinbase: miner},
+		clock:           database.SystemClock,
+		events:          newEventBus(),
+		metrics:         eventMetrics{counts: make(map[EventType]uint64)},
+		seen:            newSeenCache(GOSSIP_SEEN_TTL),
+		stopped:         make(chan struct{}),
 	}
 
+	node.pow.now = func() time.Time { return node.clock.Now() }
+	node.mempool.onDrop = node.publishTxDropped
+
 	if bootstrap != nil {
-		node.knownPeers[bootstrap.TcpAddress()] = *bootstrap
+		node.bootstrapPeers = append(node.bootstrapPeers, *bootstrap)
 	} else {
 		node.IsBootstrap = true
 	}
+	if err := node.loadPeers(); err != nil {
+		logger.Printf(".NewNode() could not restore the peers: %v\n", err)
+	}
 	return node
 }
 
-func (n *Node) Run(ctx context.Context) error {
-	logger.Printf(".run() running node on port %d\n", n.port)
-	// create a new state
-	state, err := database.NewState(n.dirname, n.hasGenesisFile)
-	if err != nil {
-		return err
-	}
+// The node ID, derived from the node key. Empty until the node is running.
+func (n *Node) ID() string {
+	return n.nodeID
+}
 
-	// assign a state to node
-	n.state = state
-	// run sync
-	go func() {
-		n.sync(ctx)
-	}()
-	go func() {
-		n.mine(ctx)
-	}()
-	<-n.done
+// Set the port of the p2p protocol. The zero port disables the p2p server,
+// then the node talks to the peers over their HTTP API only.
+// Should be called before the node is running.
+func (n *Node) SetP2PPort(port uint) {
+	n.p2pPort = port
+}
 
-	return nil
+// Set how often the transactions journal is rewritten with the pending transactions only.
+// Should be called before the node is running.
+func (n *Node) SetTxJournalRotation(d time.Duration) {
+	n.journalRotation = d
 }
 
-func (n *Node) Close() error {
-	fmt.Println("Closing node...")
-	if err := n.state.Close(); err != nil {
-		return err
-	}
-	n.done <- struct{}{}
-	return nil
+// Replace the clock used for the block times and the time based validation.
+// Should be called before the node is running.
+func (n *Node) SetClock(c database.Clock) {
+	n.clock = c
 }
 
 func (n *Node) sync(ctx context.Context) {
@@ -104,57 +143,194 @@ func (n *Node) sync(ctx context.Context) {
 		case <-ctx.Done():
 			t.Stop()
 			return
-		case <-n.done:
-			return
 		}
 	}
 }
 
+// Sync with the known peers once.
+func (n *Node) SyncOnce(ctx context.Context) {
+	n.doSync(ctx)
+}
+
 func (n *Node) doSync(ctx context.Context) {
 	ctxWithTimout, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
-	for _, peer := range n.knownPeers {
-		if peer.IP == n.ip && peer.Port == n.port {
+	var targets []syncPeer
+	for _, peer := range n.syncTargets() {
+		if n.isSelf(peer) {
 			logger.Println(".doSync() skip sync self")
 			continue
 		}
 		logger.Printf(".doSync() running for peer: %s\n", peer.TcpAddress())
-		status, err := peer.getPeerNodeStatus(ctxWithTimout)
+		client, err := n.clientFor(ctx, peer)
 		if err != nil {
-			logger.Printf(".doSync() queryNodeStatus error occured %v\n", err)
+			logger.Printf(".doSync() could not connect to peer %s: %v\n", peer.TcpAddress(), err)
+			continue
 		}
-		err = n.joinPeer(ctx, &peer)
+		status, err := client.getStatus(ctxWithTimout)
 		if err != nil {
-			logger.Printf(".doSync() joining peer %s", peer.TcpAddress())
+			logger.Printf(".doSync() queryNodeStatus error occured %v\n", err)
+			n.adjustPeerScore(peer.ID, PEER_SCORE_TIMEOUT, err.Error())
+			continue
 		}
-		err = n.syncBlocks(ctx, peer, status)
-		if err != nil {
-			logger.Printf(".doSync() syncBlocks error occured %v\n", err)
+		// a bootstrap node is identified by its status
+		if peer.ID == "" {
+			peer.ID = status.NodeID
 		}
-		err = n.syncPeers(status)
-		if err != nil {
+		if n.isBanned(peer.ID) {
+			continue
+		}
+		n.adjustPeerScore(peer.ID, PEER_SCORE_GOOD_RESPONSE, "")
+		// a p2p connection joins the peer on handshake
+		if _, isP2P := client.(p2pPeerClient); !isP2P {
+			err = n.joinPeer(ctx, &peer)
+			if err != nil {
+				logger.Printf(".doSync() joining peer %s", peer.TcpAddress())
+			}
+		}
+		targets = append(targets, syncPeer{peer: peer, client: client, status: status})
+	}
+	// the blocks are downloaded from all the peers ahead at once
+	if err := n.syncChain(ctx, targets); err != nil {
+		logger.Printf(".doSync() syncChain error occured %v\n", err)
+	}
+	for _, t := range targets {
+		if err := n.syncPeers(t.status); err != nil {
 			logger.Printf(".doSync() syncPeers error occured %v\n", err)
 		}
-		if err := n.syncPendingTXs(&peer, status); err != nil {
+		if err := n.syncPendingTXs(&t.peer, t.status); err != nil {
 			logger.Printf(".syncPendingTXs error occured %v\n", err)
 		}
 	}
+	if err := n.savePeers(); err != nil {
+		logger.Printf(".doSync() saving peers %v\n", err)
+	}
 }
 
 func (n *Node) IsKnownPeer(p *PeerNode) bool {
-	_, isKnownPeer := n.knownPeers[p.TcpAddress()]
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, isKnownPeer := n.knownPeers[p.ID]
 	return isKnownPeer
 }
 
-func (n *Node) AddPeer(p *PeerNode) {
-	n.knownPeers[p.TcpAddress()] = *p
+// Add the peer to the known peers. The peer must have a node id, which is the key of the record.
+// A known peer keeps its score, a new one starts with the initial score and may evict another peer,
+// if the peer limit is reached.
+func (n *Node) AddPeer(p *PeerNode) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.addPeer(*p)
+}
+
+// Should be called with n.mu held.
+func (n *Node) addPeer(p PeerNode) error {
+	if p.ID == "" {
+		return fmt.Errorf("peer %s has no node id", p.TcpAddress())
+	}
+	if n.isBannedLocked(p.ID) {
+		return fmt.Errorf("%w: %s", ErrPeerBanned, p.ID)
+	}
+	for _, bootstrap := range n.bootstrapPeers {
+		if bootstrap.TcpAddress() == p.TcpAddress() {
+			p.IsBootstrap = true
+		}
+	}
+	if p.IsActive {
+		p.LastSeen = n.clock.Now().Unix()
+	}
+	if known, ok := n.knownPeers[p.ID]; ok {
+		p.Score = known.Score
+		p.IsBootstrap = p.IsBootstrap || known.IsBootstrap
+		p.LastSeen = max(p.LastSeen, known.LastSeen)
+	} else {
+		p.Score = PEER_INITIAL_SCORE
+		if len(n.knownPeers) >= MAX_PEERS && !n.evictPeer() {
+			return fmt.Errorf("%w: %d peers", ErrPeerLimit, MAX_PEERS)
+		}
+	}
+	n.knownPeers[p.ID] = p
+	return nil
+}
+
+// Add the peer, which has proven the ownership of its node id by the signed join request.
+func (n *Node) AcceptJoin(req p2p.JoinRequest, sig string) (*PeerNode, error) {
+	if err := req.Verify(sig, n.clock.Now()); err != nil {
+		return nil, err
+	}
+	if req.NodeID == n.nodeID {
+		return nil, fmt.Errorf("could not join the node to itself")
+	}
+	peer := NewPeerNode(req.IP, req.Port, false, true)
+	peer.ID = req.NodeID
+	peer.P2PPort = req.P2PPort
+	if err := n.AddPeer(peer); err != nil {
+		return nil, err
+	}
+	return peer, nil
+}
+
+func (n *Node) knownPeersList() []PeerNode {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	res := make([]PeerNode, 0, len(n.knownPeers))
+	for _, peer := range n.knownPeers {
+		res = append(res, peer)
+	}
+	// the peers are synced and announced to in the same order
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+func (n *Node) knownPeersMap() map[string]PeerNode {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	res := make(map[string]PeerNode, len(n.knownPeers))
+	for id, peer := range n.knownPeers {
+		res[id] = peer
+	}
+	return res
+}
+
+// The known peers and the bootstrap nodes, which aren't identified yet.
+func (n *Node) syncTargets() []PeerNode {
+	res := n.knownPeersList()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, bootstrap := range n.bootstrapPeers {
+		identified := false
+		for _, peer := range res {
+			if peer.TcpAddress() == bootstrap.TcpAddress() {
+				identified = true
+				break
+			}
+		}
+		if !identified {
+			res = append(res, bootstrap)
+		}
+	}
+	return res
+}
+
+func (n *Node) isSelf(p PeerNode) bool {
+	return (p.ID != "" && p.ID == n.nodeID) || (p.IP == n.ip && p.Port == n.port)
+}
+
+// The tcp address of the node, as it's known by the peers.
+func (n *Node) tcpAddress() string {
+	return fmt.Sprintf("%s:%d", n.ip, n.port)
 }
 
 func (n *Node) syncPeers(status GetPeerNodeStatusResponse) error {
 	for _, statusPeer := range status.KnownPeers {
-		if !n.IsKnownPeer(&statusPeer) {
-			logger.Printf(" found new peer node %s\n", statusPeer.TcpAddress())
-			n.AddPeer(&statusPeer)
+		if n.isSelf(statusPeer) || n.IsKnownPeer(&statusPeer) {
+			continue
+		}
+		logger.Printf(" found new peer node %s %s\n", statusPeer.ID, statusPeer.TcpAddress())
+		// the peer is not connected yet
+		statusPeer.IsActive = false
+		if err := n.AddPeer(&statusPeer); err != nil {
+			logger.Printf(" skipping peer: %v\n", err)
 		}
 	}
 	return nil
@@ -162,8 +338,8 @@ func (n *Node) syncPeers(status GetPeerNodeStatusResponse) error {
 
 func (n *Node) syncPendingTXs(p *PeerNode, status GetPeerNodeStatusResponse) error {
 	for _, tx := range status.PendingTXs {
-		if err := n.AddPendingTX(tx); err != nil {
-			return err
+		if err := n.addPendingTX(tx, p.ID); err != nil {
+			logger.Printf(".syncPendingTXs() skipping tx from %s with nonce %d: %v\n", tx.From, tx.Nonce, err)
 		}
 	}
 	return nil
@@ -176,12 +352,18 @@ func (n *Node) joinPeer(ctx context.Context, p *PeerNode) error {
 		logger.Printf(" joinPeer() peer is active")
 		return nil
 	}
-	url := fmt.Sprintf("%s/node/addpeer?ip=%s&port=%d", p.TcpAddressWithProtocol(), n.ip, n.port)
-	logger.Printf(" joinPeer() with url %s", url)
-	if _, err := http.Get(url); err != nil {
+	req := p2p.JoinRequest{NodeID: n.nodeID, IP: n.ip, Port: n.port, P2PPort: n.p2pPort, Time: n.clock.Now().Unix()}
+	sig, err := req.Sign(n.key)
+	if err != nil {
 		return err
 	}
-	response, err := p.joinPeer(ctx, n.ip, n.port)
+	var response GetAddingPeerResponse
+	if n.transport != nil {
+		err = n.transport.Join(ctx, *p, req, sig)
+		response.Success = err == nil
+	} else {
+		response, err = p.joinPeer(ctx, req, sig)
+	}
 	if err != nil {
 		logger.Printf(" joinPerr() got an error %v", err)
 		return err
@@ -192,39 +374,15 @@ func (n *Node) joinPeer(ctx context.Context, p *PeerNode) error {
 	}
 
 	// update the isActive field
-	n.mu.Lock()
 	p.IsActive = response.Success
-	n.AddPeer(p)
-	n.mu.Unlock()
+	if err := n.AddPeer(p); err != nil {
+		return err
+	}
 	logger.Printf("Successfully sending a request to add a node with ip %s to peer node %s", n.ip, p.TcpAddress())
 
 	return nil
 }
 
-func (n *Node) syncBlocks(ctx context.Context, p PeerNode, status GetPeerNodeStatusResponse) error {
-	localBlockNumber := n.state.GetLastBlock().Header.Number
-	if localBlockNumber < status.BlockNumber {
-		logger.Printf(" getNodeBlocks() with a last hash: %s", *n.state.GetLastHash())
-		newBlocks, err := p.getNodeBlocks(ctx, *n.state.GetLastHash())
-		if err != nil {
-			return fmt.Errorf("%s could not retrieve the peer node's blocks. \n %v", logger.Prefix(), err)
-		}
-		logger.Printf("Found new blocks %d", len(newBlocks.Blocks))
-		for _, newBlock := range newBlocks.Blocks {
-			_, err := n.state.AddBlock(newBlock)
-			if err != nil {
-				return err
-			}
-
-			// Need to notify the Miner logic, in order to stop processing pending transactions,
-			// due to incommed new block
-			n.newSyncedBlocksCh <- newBlock
-		}
-		logger.Printf(" done syncing blocks for peer node %s\n", p.TcpAddress())
-	}
-	return nil
-}
-
 // ==== node views
 type NodeBalancesListRes struct {
 	Hash    *database.Hash          `json:"hash"`
@@ -232,25 +390,40 @@ type NodeBalancesListRes struct {
 }
 
 func (n *Node) ViewBalancesList() NodeBalancesListRes {
+	// read the hash and the balances from the same snapshot
+	snapshot := n.state.Snapshot()
+	hash := snapshot.LastHash()
 	return NodeBalancesListRes{
-		Hash:    n.state.GetLastHash(),
-		Balance: *&n.state.Balances,
+		Hash:    &hash,
+		Balance: snapshot.Balances(),
 	}
 }
 
 type NodeStatusRes struct {
+	NodeID      string              `json:"node_id"`
 	BlockHash   string              `json:"block_hash"`
 	BlockNumber uint64              `json:"block_number"`
 	KnownPeers  map[string]PeerNode `json:"known_peers"`
+	// node id -> unix time of the end of the ban
+	BannedPeers map[string]int64    `json:"banned_peers"`
 	PendingTXs  []database.SignedTx `json:"pendingTXs"`
+	Sync        SyncProgressRes     `json:"sync"`
+	Mining      MiningStatusRes     `json:"mining"`
+	Events      EventMetricsRes     `json:"events"`
 }
 
 func (n *Node) ViewNodeStatus() NodeStatusRes {
+	snapshot := n.state.Snapshot()
 	return NodeStatusRes{
-		BlockHash:   n.state.GetLastHash().String(),
-		BlockNumber: n.state.GetLastBlock().Header.Number,
-		KnownPeers:  n.knownPeers,
-		PendingTXs:  n.pendingTXsToArray(),
+		NodeID:      n.nodeID,
+		BlockHash:   snapshot.LastHash().String(),
+		BlockNumber: snapshot.LastBlock().Header.Number,
+		KnownPeers:  n.knownPeersMap(),
+		BannedPeers: n.bannedPeersMap(),
+		PendingTXs:  n.mempool.all(),
+		Sync:        n.progress.view(),
+		Mining:      n.MiningStatus(),
+		Events:      n.EventMetrics(),
 	}
 }
 
@@ -258,48 +431,57 @@ type SyncBlocksRes struct {
 	Blocks []database.Block `json:"blocks"`
 }
 
-func (n *Node) ViewSyncBlocks(afterHash database.Hash) (SyncBlocksRes, error) {
-	blocks, err := n.state.GetBlocksAfter(afterHash, n.dirname)
+// A page of the blocks after the hash. The limit is capped by MAX_SYNC_BLOCKS.
+func (n *Node) ViewSyncBlocks(afterHash database.Hash, limit int) (SyncBlocksRes, error) {
+	blocks, err := n.blocksPage(afterHash, limit)
 	if err != nil {
 		return SyncBlocksRes{}, err
 	}
 	return SyncBlocksRes{blocks}, nil
 }
 
+type SyncHeadersRes struct {
+	Headers []database.BlockHeader `json:"headers"`
+}
+
+// A page of the headers after the hash, or after the latest common block of the locator, if it's set.
+// The limit is capped by MAX_SYNC_HEADERS.
+func (n *Node) ViewSyncHeaders(afterHash database.Hash, locator []database.Hash, limit int) (SyncHeadersRes, error) {
+	headers, err := n.headersPage(afterHash, locator, limit)
+	if err != nil {
+		return SyncHeadersRes{}, err
+	}
+	return SyncHeadersRes{headers}, nil
+}
+
 // Node mining process.
 func (n *Node) mine(ctx context.Context) error {
+	// a new block or a reorg replaces the tip the current block is mined on
+	blocks := n.Subscribe(EventNewBlock, EventReorg)
+	defer blocks.Close()
 	// The time interval
 	ticker := time.NewTicker(MINE_PENDING_INTERVAL)
-	var (
-		innerContext      context.Context
-		cancelContextFunc context.CancelFunc
-	)
 	for {
 		select {
-		case <-n.done:
-			ticker.Stop()
-			return nil
 		// handle ticker case
 		case <-ticker.C:
-			go func() {
-				if !n.isMining && len(n.pendingTXs) > 0 {
-					n.isMining = true
-
-					innerContext, cancelContextFunc = context.WithCancel(ctx)
-					if err := n.processPendingTXs(innerContext); err != nil {
-						// TODO what to do with an error
-						fmt.Println("ERROR ", err)
-					}
-					n.isMining = false
+			n.goService(func() {
+				if err := n.MineOnce(ctx); err != nil {
+					// TODO what to do with an error
+					fmt.Println("ERROR ", err)
 				}
-			}()
-		case block, _ := <-n.newSyncedBlocksCh:
-			// check if current node is in mining process
-			if n.isMining {
-				fmt.Println("Another peer node mined the new block faster, need to cancel current mining.")
-				n.removeMindedPendingTXs(block)
+			})
+		case _, ok := <-blocks.Events():
+			if !ok {
+				ticker.Stop()
+				return nil
+			}
+			// check if current node is in mining process, the block mined by the node itself
+			// is published after its mining is done
+			if n.mining.active() {
+				fmt.Println("The chain tip is replaced, need to cancel current mining.")
 				// cancel current mining process
-				cancelContextFunc()
+				n.mining.cancelCurrent()
 			}
 		case <-ctx.Done():
 			ticker.Stop()
@@ -308,38 +490,83 @@ func (n *Node) mine(ctx context.Context) error {
 	}
 }
 
-func (n *Node) removeMindedPendingTXs(block database.Block) error {
-	if len(block.Payload) > 0 && len(n.pendingTXs) > 0 {
-		fmt.Println("removeMindedPendingTXs, update in memory pending transactions")
+// Mine a block of the pending transactions, unless the mining is stopped, a block is already being mined,
+// or there is nothing to mine. Returns, when the block is added or the mining is canceled.
+func (n *Node) MineOnce(ctx context.Context) error {
+	if n.mempool.len() == 0 {
+		return nil
 	}
-	for _, tx := range block.Payload {
+	miningCtx, ok := n.mining.tryBegin(ctx)
+	if !ok {
+		return nil
+	}
+	defer n.mining.end()
+	return n.processPendingTXs(miningCtx)
+}
+
+// Remove the block's transactions from the mempool and remember them as mined, then revalidate the rest
+// of the pending transactions against the new state. The outstanding work of the external miners is stale.
+func (n *Node) updateMempool(block database.Block) {
+	n.work.clear()
+	for _, tx := range n.mempool.removeMined(block) {
 		txHash, err := tx.Hash()
 		if err != nil {
-			return err
+			continue
 		}
-		// check the pending TXs map contains a transcation by hash
-		if _, exists := n.pendingTXs[txHash.String()]; exists {
-			n.archivedTXs[txHash.String()] = tx
-			delete(n.pendingTXs, txHash.String())
+		n.recentTXs.add(txHash.String(), block.Header.Number, n.clock.Now())
+	}
+	for _, tx := range n.mempool.update(n.state.Snapshot(), n.clock.Now()) {
+		logger.Printf(".updateMempool() dropped tx from %s with nonce %d\n", tx.From, tx.Nonce)
+	}
+}
+
+// Return the transactions of the blocks removed from the local chain to the pending ones.
+func (n *Node) restorePendingTXs(blocks []database.Block) {
+	for _, block := range blocks {
+		for _, tx := range block.Payload {
+			txHash, err := tx.Hash()
+			if err != nil {
+				continue
+			}
+			n.recentTXs.remove(txHash.String())
+			if _, err := n.mempool.add(tx, n.state.Snapshot(), n.clock.Now()); err != nil {
+				logger.Printf(".restorePendingTXs() dropped tx %s: %v\n", txHash, err)
+			}
 		}
 	}
-	return nil
 }
 
 func (n *Node) processPendingTXs(ctx context.Context) error {
-	pendingBlock := NewPendingBlock(*n.state.GetLastHash(), n.state.NextBlockNumber(), n.pendingTXsToArray(), n.miner)
-	minedBlock, err := Mine(ctx, pendingBlock)
-	if err != nil {
-		return err
+	template := n.buildBlockTemplate(n.clock.Now())
+	if len(template.TXs()) == 0 {
+		// the pending transactions wait for the missing nonces
+		return nil
 	}
+	pendingBlock := newPendingBlockAt(template.ParentHash(), template.Number(), template.TXs(), n.Coinbase(), template.Time())
+	started := MiningEvent{Number: pendingBlock.number, TXs: len(pendingBlock.txs)}
+	n.publish(Event{Type: EventMiningStarted, Mining: &started})
+	stopped := started
+	defer func() { n.publish(Event{Type: EventMiningStopped, Mining: &stopped}) }()
 
-	if err := n.removeMindedPendingTXs(minedBlock); err != nil {
+	minedBlock, err := n.pow.mine(ctx, pendingBlock)
+	if err != nil {
+		stopped.Error = err.Error()
 		return err
 	}
-	_, err = n.state.AddBlock(minedBlock)
-	if err != nil {
+	// the template is built on a snapshot, the tip can be replaced by a synced or a submitted block
+	// while the block is mined, the state rejects such a block and its transactions stay pending
+	hash, err := n.state.AddBlock(minedBlock)
+	if errors.Is(err, database.ErrBlockParent) {
+		logger.Printf(".processPendingTXs() the mined block %d is stale: %v\n", minedBlock.Header.Number, err)
+		stopped.Error = err.Error()
+		return nil
+	} else if err != nil {
+		stopped.Error = err.Error()
 		return err
 	}
+	stopped.Hash = hash.String()
+	n.notifyNewBlock(minedBlock)
+	n.announceBlock(minedBlock, "")
 
 	return nil
 }
@@ -349,37 +576,83 @@ func (n *Node) NextAccountNonce(acc common.Address) uint {
 	return n.state.NextAccountNonce(acc)
 }
 
-func (n *Node) AddPendingTX(tx database.SignedTx) error {
-	// if err := n.state.IsValidTX(tx); err != nil {
-	// 	return err
-	// }
-	txHash, err := tx.Hash()
-	if err != nil {
-		return err
+// The nonce of the account's next transaction, which follows the pending ones.
+func (n *Node) NextPendingNonce(acc common.Address) uint {
+	return n.mempool.nextNonce(acc, n.state.Snapshot())
+}
+
+type TxStatusRes struct {
+	Hash database.Hash `json:"hash"`
+	// pending, mined, replaced, dropped or unknown
+	Status string `json:"status"`
+	// the number of the block, which includes the mined transaction, the first block is numbered 0
+	BlockNumber *uint64 `json:"block_number,omitempty"`
+	// the hash of the transaction, which replaced the pending one
+	ReplacedBy string `json:"replaced_by,omitempty"`
+	// why the transaction was dropped
+	Reason string `json:"reason,omitempty"`
+}
+
+// The status of the transaction known to the node. The replaced and dropped transactions are
+// reported, while they're remembered by the mempool.
+func (n *Node) TxStatus(hash database.Hash) TxStatusRes {
+	res := TxStatusRes{Hash: hash, Status: "unknown"}
+	if n.mempool.has(hash.String()) {
+		res.Status = "pending"
+		return res
 	}
-	_, isAlreadyPending := n.pendingTXs[txHash.String()]
-	_, isArchived := n.archivedTXs[txHash.String()]
-	if !isAlreadyPending && !isArchived {
-		txJson, err := json.Marshal(tx)
-		if err != nil {
-			return err
+	if number, ok, err := n.state.TxBlockNumber(hash); err == nil && ok {
+		res.Status, res.BlockNumber = "mined", &number
+		return res
+	}
+	if dropped, ok := n.mempool.droppedTx(hash.String()); ok {
+		res.Status, res.Reason = "dropped", dropped.reason
+		if dropped.replacedBy != "" {
+			res.Status, res.ReplacedBy = "replaced", dropped.replacedBy
 		}
-		fmt.Printf("Added Pending TX %s from Peer %s\n", txJson, n.ip)
-		n.pendingTXs[txHash.String()] = tx
 	}
+	return res
+}
 
-	return nil
+func (n *Node) AddPendingTX(tx database.SignedTx) error {
+	return n.addPendingTX(tx, "")
 }
 
-func (n *Node) pendingTXsToArray() []database.SignedTx {
-	result := make([]database.SignedTx, len(n.pendingTXs))
-	i := 0
-	for _, tx := range n.pendingTXs {
-		result[i] = tx
-		i++
+// Validate and add a pending transaction, and announce it to the peers, except the one it was received from.
+// A replacement of a pending transaction is announced the same way. An already pending, mined or replaced
+// transaction is ignored.
+func (n *Node) addPendingTX(tx database.SignedTx, from string) error {
+	if !n.isOpen() {
+		return ErrNodeNotOpen
 	}
-
-	return result
+	if err := database.ValidateTxLimits(tx.Tx); err != nil {
+		return err
+	}
+	if err := database.ValidateTxTime(tx.Tx, n.clock.Now()); err != nil {
+		return err
+	}
+	txHash, err := tx.Hash()
+	if err != nil {
+		return err
+	}
+	if n.isMinedTX(txHash) {
+		return nil
+	}
+	_, err = n.mempool.add(tx, n.state.Snapshot(), n.clock.Now())
+	if errors.Is(err, ErrTxKnown) || errors.Is(err, ErrTxReplaced) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logger.Printf(".addPendingTX() added tx %s from %s with nonce %d\n", txHash, tx.From, tx.Nonce)
+	n.publish(Event{Type: EventTxAdmitted, Tx: &TxEvent{Hash: txHash.String(), From: tx.From.Hex(), Nonce: tx.Nonce}})
+	if err := n.journal.insert(tx); err != nil {
+		logger.Printf(".addPendingTX() journaling tx %s: %v\n", txHash, err)
+	}
+	n.seen.markSeen(txHash.String(), n.clock.Now())
+	n.announceTX(tx, from)
+	return nil
 }
 
 func (n *Node) Dirname() string {
@@ -0,0 +1,94 @@
+package node
+
+import (
+	"errors"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"taraskrasiuk/blockchain_l/internal/p2p"
+	"testing"
+	"time"
+)
+
+func TestNode_AcceptJoin(t *testing.T) {
+	n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+	key, err := p2p.LoadOrCreateNodeKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	join := p2p.JoinRequest{NodeID: p2p.NodeID(&key.PublicKey), IP: "localhost", Port: 8086, P2PPort: 9086, Time: time.Now().Unix()}
+	sig, err := join.Sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stray host replays the signature with its own address
+	stray := join
+	stray.IP = "10.0.0.66"
+	if _, err := n.AcceptJoin(stray, sig); err == nil {
+		t.Fatal("expected the forged join request to be rejected")
+	}
+	if len(n.knownPeersList()) != 0 {
+		t.Fatal("expected no known peers after the rejected join")
+	}
+
+	peer, err := n.AcceptJoin(join, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !n.IsKnownPeer(peer) {
+		t.Fatal("expected the joined peer to be known")
+	}
+	known := n.knownPeersMap()
+	if got, ok := known[join.NodeID]; !ok || got.TcpAddress() != "localhost:8086" {
+		t.Fatalf("expected the peer to be keyed by its node id, got %v", known)
+	}
+}
+
+func TestNode_AddPeerRequiresNodeID(t *testing.T) {
+	n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+	if err := n.AddPeer(NewPeerNode("localhost", 8086, false, true)); err == nil {
+		t.Fatal("expected a peer without node id to be rejected")
+	}
+}
+
+func TestNode_PeerPenalizedForInvalidDataOnly(t *testing.T) {
+	n, _ := newScoreTestNode(t)
+	key := newTestKey(t)
+	n.state, n.opened = setupMempoolTestState(t, key), true
+	addTestPeer(t, n, "peer", 8086)
+	score := func() int { return n.knownPeersMap()["peer"].Score }
+
+	if err := n.handlePeerTX("peer", signTestTx(t, key, 1, 3, 0)); err != nil {
+		t.Fatal(err)
+	}
+	// the races of the gossip don't lower the score
+	if err := n.handlePeerTX("peer", signTestTx(t, key, 1, 4, 0)); !errors.Is(err, ErrTxNonceTaken) {
+		t.Fatalf("expected the nonce to be taken, got %v", err)
+	}
+	if err := n.handlePeerTX("peer", signTestTx(t, key, 0, 4, 0)); !errors.Is(err, ErrTxNonceTooLow) {
+		t.Fatalf("expected the nonce to be too low, got %v", err)
+	}
+	if got := score(); got != PEER_INITIAL_SCORE {
+		t.Fatalf("expected the score to stay %d, got %d", PEER_INITIAL_SCORE, got)
+	}
+
+	forged := signTestTx(t, key, 2, 3, 0)
+	forged.Value = 300
+	if err := n.handlePeerTX("peer", forged); !errors.Is(err, ErrTxForged) {
+		t.Fatalf("expected the forged transaction to be rejected, got %v", err)
+	}
+	if got := score(); got != PEER_INITIAL_SCORE+PEER_SCORE_INVALID_DATA {
+		t.Fatalf("expected the forged transaction to lower the score, got %d", got)
+	}
+
+	// a block without the proof of work
+	block := database.NewBlock(*n.state.GetLastHash(), n.state.NextBlockNumber(), 0, nil, database.NewAccount("miner"))
+	for hash, _ := block.Hash(); database.IsValidBlock(hash); hash, _ = block.Hash() {
+		block.Header.Nonce++
+	}
+	if err := n.handlePeerBlock("peer", block); err == nil {
+		t.Fatal("expected the block without the proof of work to be rejected")
+	}
+	if got := score(); got != PEER_INITIAL_SCORE+2*PEER_SCORE_INVALID_DATA {
+		t.Fatalf("expected the invalid block to lower the score, got %d", got)
+	}
+}
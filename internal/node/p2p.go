@@ -0,0 +1,312 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"taraskrasiuk/blockchain_l/internal/p2p"
+	"time"
+)
+
+// Timeout of dialing a peer's p2p port.
+var P2P_DIAL_TIMEOUT = 2 * time.Second
+
+// Start the p2p server, if the node has the p2p port. Should be called once the state is loaded.
+func (n *Node) startP2P() error {
+	if n.p2pPort == 0 {
+		return nil
+	}
+	local := p2p.Handshake{
+		Version:     p2p.ProtocolVersion,
+		ChainID:     n.state.ChainID(),
+		GenesisHash: n.state.GenesisHash(),
+		IP:          n.ip,
+		Port:        n.port,
+		P2PPort:     n.p2pPort,
+	}
+	server := p2p.NewServer(fmt.Sprintf(":%d", n.p2pPort), local, n.key, &p2pHandler{n}, nil)
+	n.mu.Lock()
+	n.p2p = server
+	n.mu.Unlock()
+	return server.Start()
+}
+
+// peerClient is the way the node talks to a peer: over the transport, if it's set, over the p2p
+// connection, when the peer has a p2p port, or over the peer's HTTP API otherwise.
+type peerClient interface {
+	getStatus(ctx context.Context) (GetPeerNodeStatusResponse, error)
+	// the headers after the block, or after the latest common block of the locator, if it's set
+	getHeaders(ctx context.Context, lastBlockHash database.Hash, locator []database.Hash, limit int) (GetNodeHeadersResponse, error)
+	getBlocks(ctx context.Context, lastBlockHash database.Hash, limit int) (GetNodeBlocksResponse, error)
+	announceBlock(ctx context.Context, req AnnounceBlockReq) error
+	announceTX(ctx context.Context, req AnnounceTxReq) error
+}
+
+// Get a client for the peer. Dials the peer's p2p port, if it's not connected yet.
+// Fails, if the node at the peer's address authenticates with another node id.
+func (n *Node) clientFor(ctx context.Context, peer PeerNode) (peerClient, error) {
+	if n.transport != nil {
+		return transportPeerClient{n.transport, peer}, nil
+	}
+	if n.p2p == nil || peer.P2PPort == 0 {
+		return httpPeerClient{peer}, nil
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, P2P_DIAL_TIMEOUT)
+	defer cancel()
+	p, err := n.p2p.Connect(dialCtx, peer.P2PAddress())
+	if err != nil {
+		logger.Printf(".clientFor() could not connect to peer %s over p2p, fallback to http: %v\n", peer.P2PAddress(), err)
+		return httpPeerClient{peer}, nil
+	}
+	if peer.ID != "" && p.ID() != peer.ID {
+		return nil, fmt.Errorf("the node at %s has id %s, expected %s", peer.P2PAddress(), p.ID(), peer.ID)
+	}
+	return p2pPeerClient{p}, nil
+}
+
+// Get a client for the announcements. Doesn't dial the peer, an already established
+// p2p connection is used if there is one.
+func (n *Node) announceClientFor(peer PeerNode) peerClient {
+	if n.transport != nil {
+		return transportPeerClient{n.transport, peer}
+	}
+	if n.p2p != nil && peer.P2PPort != 0 {
+		if p, ok := n.p2p.Peer(peer.ID); ok {
+			return p2pPeerClient{p}
+		}
+	}
+	return httpPeerClient{peer}
+}
+
+type httpPeerClient struct {
+	peer PeerNode
+}
+
+func (c httpPeerClient) getStatus(ctx context.Context) (GetPeerNodeStatusResponse, error) {
+	return c.peer.getPeerNodeStatus(ctx)
+}
+
+func (c httpPeerClient) getHeaders(ctx context.Context, lastBlockHash database.Hash, locator []database.Hash, limit int) (GetNodeHeadersResponse, error) {
+	return c.peer.getNodeHeaders(ctx, lastBlockHash, locator, limit)
+}
+
+func (c httpPeerClient) getBlocks(ctx context.Context, lastBlockHash database.Hash, limit int) (GetNodeBlocksResponse, error) {
+	return c.peer.getNodeBlocks(ctx, lastBlockHash, limit)
+}
+
+func (c httpPeerClient) announceBlock(ctx context.Context, req AnnounceBlockReq) error {
+	return c.peer.announceBlock(ctx, req)
+}
+
+func (c httpPeerClient) announceTX(ctx context.Context, req AnnounceTxReq) error {
+	return c.peer.announceTX(ctx, req)
+}
+
+type p2pPeerClient struct {
+	peer *p2p.Peer
+}
+
+func (c p2pPeerClient) getStatus(ctx context.Context) (GetPeerNodeStatusResponse, error) {
+	var status p2p.StatusMsg
+	if err := c.peer.Request(ctx, p2p.MsgGetStatus, struct{}{}, p2p.MsgStatus, &status); err != nil {
+		return GetPeerNodeStatusResponse{}, err
+	}
+	knownPeers := make(map[string]PeerNode, len(status.KnownPeers))
+	for _, info := range status.KnownPeers {
+		peer := peerNodeFromInfo(info)
+		knownPeers[peer.ID] = peer
+	}
+	return GetPeerNodeStatusResponse{
+		NodeID:      c.peer.ID(),
+		BlockHash:   status.BlockHash.String(),
+		BlockNumber: status.BlockNumber,
+		KnownPeers:  knownPeers,
+		PendingTXs:  status.PendingTXs,
+	}, nil
+}
+
+func (c p2pPeerClient) getHeaders(ctx context.Context, lastBlockHash database.Hash, locator []database.Hash, limit int) (GetNodeHeadersResponse, error) {
+	var headers p2p.HeadersMsg
+	if err := c.peer.Request(ctx, p2p.MsgGetHeaders, &p2p.GetHeadersMsg{FromBlock: lastBlockHash, Locator: locator, Limit: limit}, p2p.MsgHeaders, &headers); err != nil {
+		return GetNodeHeadersResponse{}, err
+	}
+	return GetNodeHeadersResponse{headers.Headers}, nil
+}
+
+func (c p2pPeerClient) getBlocks(ctx context.Context, lastBlockHash database.Hash, limit int) (GetNodeBlocksResponse, error) {
+	var blocks p2p.BlocksMsg
+	if err := c.peer.Request(ctx, p2p.MsgGetBlocks, &p2p.GetBlocksMsg{FromBlock: lastBlockHash, Limit: limit}, p2p.MsgBlocks, &blocks); err != nil {
+		return GetNodeBlocksResponse{}, err
+	}
+	return GetNodeBlocksResponse{blocks.Blocks}, nil
+}
+
+func (c p2pPeerClient) announceBlock(ctx context.Context, req AnnounceBlockReq) error {
+	return c.peer.Send(p2p.MsgNewBlock, &p2p.NewBlockMsg{Block: req.Block})
+}
+
+func (c p2pPeerClient) announceTX(ctx context.Context, req AnnounceTxReq) error {
+	return c.peer.Send(p2p.MsgTx, &p2p.TxMsg{Tx: req.Tx})
+}
+
+func peerNodeFromInfo(info p2p.PeerInfo) PeerNode {
+	peer := NewPeerNode(info.IP, info.Port, info.IsBootstrap, false)
+	peer.ID = info.NodeID
+	peer.P2PPort = info.P2PPort
+	return *peer
+}
+
+func peerInfo(p PeerNode) p2p.PeerInfo {
+	return p2p.PeerInfo{NodeID: p.ID, IP: p.IP, Port: p.Port, P2PPort: p.P2PPort, IsBootstrap: p.IsBootstrap}
+}
+
+// p2pHandler serves the requests and the announcements of the p2p peers.
+type p2pHandler struct {
+	n *Node
+}
+
+func (h *p2pHandler) HandleGetStatus(p *p2p.Peer) (p2p.StatusMsg, error) {
+	snapshot := h.n.state.Snapshot()
+	var knownPeers []p2p.PeerInfo
+	for _, peer := range h.n.knownPeersList() {
+		knownPeers = append(knownPeers, peerInfo(peer))
+	}
+	return p2p.StatusMsg{
+		BlockHash:   snapshot.LastHash(),
+		BlockNumber: snapshot.LastBlock().Header.Number,
+		KnownPeers:  knownPeers,
+		PendingTXs:  h.n.mempool.all(),
+	}, nil
+}
+
+func (h *p2pHandler) HandleGetBlocks(p *p2p.Peer, req p2p.GetBlocksMsg) (p2p.BlocksMsg, error) {
+	blocks, err := h.n.blocksPage(req.FromBlock, req.Limit)
+	if err != nil {
+		return p2p.BlocksMsg{}, err
+	}
+	return p2p.BlocksMsg{Blocks: blocks}, nil
+}
+
+func (h *p2pHandler) HandleGetHeaders(p *p2p.Peer, req p2p.GetHeadersMsg) (p2p.HeadersMsg, error) {
+	headers, err := h.n.headersPage(req.FromBlock, req.Locator, req.Limit)
+	if err != nil {
+		return p2p.HeadersMsg{}, err
+	}
+	return p2p.HeadersMsg{Headers: headers}, nil
+}
+
+func (h *p2pHandler) HandleGetPeers(p *p2p.Peer) (p2p.PeersMsg, error) {
+	var peers []p2p.PeerInfo
+	for _, peer := range h.n.knownPeersList() {
+		peers = append(peers, peerInfo(peer))
+	}
+	return p2p.PeersMsg{Peers: peers}, nil
+}
+
+func (h *p2pHandler) HandleTx(p *p2p.Peer, msg p2p.TxMsg) error {
+	return h.n.handlePeerTX(p.ID(), msg.Tx)
+}
+
+func (h *p2pHandler) HandleNewBlock(p *p2p.Peer, msg p2p.NewBlockMsg) error {
+	return h.n.handlePeerBlock(p.ID(), msg.Block)
+}
+
+// The announcements of the p2p peers are authenticated, so the invalid ones lower the sender's score.
+// Only the data, which is invalid regardless of the local chain, is penalized. A stale block, a known
+// transaction or a full mempool are the races of the gossip, an honest peer runs into them as well.
+func (n *Node) handlePeerTX(id string, tx database.SignedTx) error {
+	if err := validateAnnouncedTX(tx); err != nil {
+		n.adjustPeerScore(id, PEER_SCORE_INVALID_DATA, err.Error())
+		return err
+	}
+	return n.HandleAnnouncedTX(tx, id)
+}
+
+func (n *Node) handlePeerBlock(id string, block database.Block) error {
+	err := n.HandleAnnouncedBlock(block, id)
+	if errors.Is(err, ErrInvalidBlock) {
+		n.adjustPeerScore(id, PEER_SCORE_INVALID_DATA, err.Error())
+	}
+	return err
+}
+
+// Validate the transaction without the state: the limits and the signature.
+func validateAnnouncedTX(tx database.SignedTx) error {
+	if err := database.ValidateTxLimits(tx.Tx); err != nil {
+		return err
+	}
+	if tx.IsReward() {
+		return ErrTxReward
+	}
+	return validateTxSignature(tx)
+}
+
+// Validate the block without the state: the proof of work, the limits, the payload root and the signatures.
+func validateAnnouncedBlock(block database.Block) error {
+	hash, err := block.Hash()
+	if err != nil {
+		return err
+	}
+	if !database.IsValidBlock(hash) {
+		return fmt.Errorf("the block %d hash %s doesn't satisfy the proof of work", block.Header.Number, hash)
+	}
+	if err := database.ValidateBlockLimits(block); err != nil {
+		return err
+	}
+	if err := database.ValidateTxRoot(block); err != nil {
+		return err
+	}
+	for _, tx := range block.Payload {
+		if err := validateTxSignature(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateTxSignature(tx database.SignedTx) error {
+	ok, err := tx.IsAuthentic()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrTxForged, err)
+	}
+	if !ok {
+		return ErrTxForged
+	}
+	return nil
+}
+
+// A connected node becomes a known peer, as it was joined over /node/addpeer.
+// The handshake has authenticated its node id.
+func (h *p2pHandler) PeerConnected(p *p2p.Peer) {
+	info := p.Info()
+	peer := NewPeerNode(info.IP, info.Port, false, true)
+	peer.ID = p.ID()
+	peer.P2PPort = info.P2PPort
+
+	if err := h.n.AddPeer(peer); err != nil {
+		logger.Printf(".PeerConnected() rejecting peer %s: %v\n", p.Addr(), err)
+		p.Close()
+		return
+	}
+	logger.Printf(".PeerConnected() peer %s %s connected over p2p\n", p.ID(), p.Addr())
+	h.n.publish(Event{Type: EventPeerConnected, Peer: &PeerEvent{ID: p.ID(), Address: p.Addr()}})
+}
+
+func (h *p2pHandler) PeerDisconnected(p *p2p.Peer, err error) {
+	if errors.Is(err, p2p.ErrProtocolViolation) {
+		h.n.adjustPeerScore(p.ID(), PEER_SCORE_PROTOCOL_VIOLATION, err.Error())
+	}
+	h.n.mu.Lock()
+	if known, ok := h.n.knownPeers[p.ID()]; ok {
+		known.IsActive = false
+		h.n.knownPeers[p.ID()] = known
+	}
+	h.n.mu.Unlock()
+	logger.Printf(".PeerDisconnected() peer %s disconnected: %v\n", p.Addr(), err)
+	peerEvent := &PeerEvent{ID: p.ID(), Address: p.Addr()}
+	if err != nil {
+		peerEvent.Reason = err.Error()
+	}
+	h.n.publish(Event{Type: EventPeerDisconnected, Peer: peerEvent})
+}
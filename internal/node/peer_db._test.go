@@ -0,0 +1,70 @@
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"testing"
+	"time"
+)
+
+func TestNode_PeersPersistAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	n := NewNode(dir, 8085, "localhost", nil, database.NewAccount("miner"), true)
+	addTestPeer(t, n, "peer", 8086)
+	n.adjustPeerScore("peer", PEER_SCORE_TIMEOUT, "timeout")
+	if err := n.BanPeer("banned", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.savePeers(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewNode(dir, 8085, "localhost", nil, database.NewAccount("miner"), true)
+	peer, ok := restarted.knownPeersMap()["peer"]
+	if !ok {
+		t.Fatal("expected the peer to be restored")
+	}
+	if peer.Score != PEER_SCORE_TIMEOUT || peer.LastSeen == 0 || peer.IsActive {
+		t.Fatalf("unexpected restored peer %+v", peer)
+	}
+	if !restarted.isBanned("banned") {
+		t.Fatal("expected the ban to be restored")
+	}
+}
+
+func TestParseBootstrapPeer(t *testing.T) {
+	peer, err := ParseBootstrapPeer("10.0.0.1:8080:9090", 9080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.IP != "10.0.0.1" || peer.Port != 8080 || peer.P2PPort != 9090 || !peer.IsBootstrap {
+		t.Fatalf("unexpected bootstrap peer %+v", peer)
+	}
+	peer, err = ParseBootstrapPeer("localhost:8081", 9080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.P2PPort != 9080 {
+		t.Fatalf("expected the default p2p port, got %d", peer.P2PPort)
+	}
+	for _, invalid := range []string{"", "localhost", "localhost:port", "local/host:8080", "a:1:2:3"} {
+		if _, err := ParseBootstrapPeer(invalid, 9080); err == nil {
+			t.Fatalf("expected '%s' to be rejected", invalid)
+		}
+	}
+}
+
+func TestLoadBootstrapConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bootstrap.json")
+	if err := os.WriteFile(path, []byte(`{"bootstrap_nodes": ["10.0.0.1:8080", "10.0.0.2:8080:0"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := LoadBootstrapConfig(path, 9080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0].P2PPort != 9080 || peers[1].P2PPort != 0 {
+		t.Fatalf("unexpected bootstrap peers %+v", peers)
+	}
+}
@@ -0,0 +1,163 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const peersDBFile = "peers.json"
+
+func GetPeersDBFile(dataDir string) string {
+	return filepath.Join(dataDir, peersDBFile)
+}
+
+// peerDB is the content of the peers file, which keeps the known peers and the bans across restarts.
+type peerDB struct {
+	Peers []PeerNode `json:"peers"`
+	// node id -> unix time of the end of the ban
+	Banned map[string]int64 `json:"banned"`
+}
+
+func loadPeerDB(path string) (peerDB, error) {
+	var db peerDB
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return db, nil
+	}
+	if err != nil {
+		return db, err
+	}
+	if err := json.Unmarshal(content, &db); err != nil {
+		return db, fmt.Errorf("could not decode the peers file %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// Write the peers file. The content is written to a temporary file first, so a crash
+// doesn't leave a truncated file.
+func savePeerDB(path string, db peerDB) error {
+	content, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Restore the peers and the bans saved by the previous run. The restored peers are inactive,
+// until they respond again.
+func (n *Node) loadPeers() error {
+	db, err := loadPeerDB(GetPeersDBFile(n.dirname))
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, peer := range db.Peers {
+		if peer.ID == "" {
+			continue
+		}
+		peer.IsActive = false
+		n.knownPeers[peer.ID] = peer
+	}
+	for id, until := range db.Banned {
+		n.bannedPeers[id] = time.Unix(until, 0)
+	}
+	logger.Printf(".loadPeers() restored %d peers and %d bans\n", len(db.Peers), len(db.Banned))
+	return nil
+}
+
+// Persist the known peers and the active bans.
+func (n *Node) savePeers() error {
+	return savePeerDB(GetPeersDBFile(n.dirname), peerDB{
+		Peers:  n.knownPeersList(),
+		Banned: n.bannedPeersMap(),
+	})
+}
+
+// Add a bootstrap node, besides the one the node is created with.
+// Should be called before the node is running.
+func (n *Node) AddBootstrapPeer(p PeerNode) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	p.IsBootstrap = true
+	n.bootstrapPeers = append(n.bootstrapPeers, p)
+	n.IsBootstrap = false
+}
+
+// Parse the bootstrap node address in the form of ip:port or ip:port:p2pPort.
+// The zero p2p port means the node doesn't run the p2p protocol.
+func ParseBootstrapPeer(addr string, defaultP2PPort uint) (PeerNode, error) {
+	parts := strings.Split(addr, ":")
+	if len(parts) != 2 && len(parts) != 3 {
+		return PeerNode{}, fmt.Errorf("invalid bootstrap node '%s', expected ip:port or ip:port:p2pPort", addr)
+	}
+	if !isHostname(parts[0]) {
+		return PeerNode{}, fmt.Errorf("invalid bootstrap node host '%s'", parts[0])
+	}
+	port, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return PeerNode{}, fmt.Errorf("invalid bootstrap node port '%s': %w", parts[1], err)
+	}
+	peer := NewPeerNode(parts[0], uint(port), true, false)
+	peer.P2PPort = defaultP2PPort
+	if len(parts) == 3 {
+		p2pPort, err := strconv.ParseUint(parts[2], 10, 16)
+		if err != nil {
+			return PeerNode{}, fmt.Errorf("invalid bootstrap node p2p port '%s': %w", parts[2], err)
+		}
+		peer.P2PPort = uint(p2pPort)
+	}
+	return *peer, nil
+}
+
+// An ipv4 address or a host name.
+func isHostname(host string) bool {
+	if host == "" {
+		return false
+	}
+	for _, r := range host {
+		if !(r == '.' || r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// BootstrapConfig is the file listing the bootstrap nodes, e.g.
+//
+//	{"bootstrap_nodes": ["10.0.0.1:8080:9080", "10.0.0.2:8080"]}
+type BootstrapConfig struct {
+	BootstrapNodes []string `json:"bootstrap_nodes"`
+}
+
+func LoadBootstrapConfig(path string, defaultP2PPort uint) ([]PeerNode, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg BootstrapConfig
+	if err := json.Unmarshal(content, &cfg); err != nil {
+		return nil, fmt.Errorf("could not decode the bootstrap config %s: %w", path, err)
+	}
+	var res []PeerNode
+	for _, addr := range cfg.BootstrapNodes {
+		peer, err := ParseBootstrapPeer(addr, defaultP2PPort)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, peer)
+	}
+	return res, nil
+}
@@ -1,37 +1,59 @@
 package node
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"taraskrasiuk/blockchain_l/internal/database"
+	"taraskrasiuk/blockchain_l/internal/p2p"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 // ===========
 type PeerNode struct {
+	// the node id, derived from the peer's node key
+	ID          string `json:"id"`
 	IP          string `json:"ip"`
 	Port        uint   `json:"port"`
 	IsBootstrap bool   `json:"is_bootstrap"`
 	IsActive    bool   `json:"is_active"`
+	// zero, if the peer doesn't run the p2p protocol
+	P2PPort uint `json:"p2p_port"`
+	// the local score of the peer, see peer_score.go
+	Score int `json:"score"`
+	// unix time the peer was active last time
+	LastSeen int64 `json:"last_seen"`
 }
 
 func (p *PeerNode) TcpAddress() string {
 	return fmt.Sprintf("%s:%d", p.IP, p.Port)
 }
 
+// The address of the peer's p2p server.
+func (p *PeerNode) P2PAddress() string {
+	return fmt.Sprintf("%s:%d", p.IP, p.P2PPort)
+}
+
 func (p *PeerNode) TcpAddressWithProtocol() string {
 	return fmt.Sprintf("http://%s", p.TcpAddress())
 }
 
 func NewPeerNode(ip string, port uint, isBootstrap, isActive bool) *PeerNode {
-	return &PeerNode{ip, port, isBootstrap, isActive}
+	return &PeerNode{IP: ip, Port: port, IsBootstrap: isBootstrap, IsActive: isActive}
 }
 
 // ==========
 type GetPeerNodeStatusResponse struct {
+	NodeID      string              `json:"node_id"`
 	BlockHash   string              `json:"block_hash"`
 	BlockNumber uint64              `json:"block_number"`
 	KnownPeers  map[string]PeerNode `json:"known_peers"`
@@ -63,13 +85,13 @@ type GetNodeBlocksResponse struct {
 	Blocks []database.Block `json:"blocks"`
 }
 
-func (p *PeerNode) getNodeBlocks(ctx context.Context, lastBlockHash database.Hash) (GetNodeBlocksResponse, error) {
-	ctxWithTimeout, cancel := context.WithTimeout(ctx, 1*time.Second)
-	defer cancel()
+// Get a page of the blocks after the hash. The timeout is defined by the context,
+// as a page of the blocks may take a while to download.
+func (p *PeerNode) getNodeBlocks(ctx context.Context, lastBlockHash database.Hash, limit int) (GetNodeBlocksResponse, error) {
 	logger.Printf(".GetNodeBlocks() running with a last hash: %s", lastBlockHash)
 
 	var statusResp GetNodeBlocksResponse
-	result, err := getReq(ctxWithTimeout, p, fmt.Sprintf("node/sync?fromBlock=%s", lastBlockHash), &statusResp)
+	result, err := getReq(ctx, p, fmt.Sprintf("node/sync?fromBlock=%s&limit=%d", lastBlockHash, limit), &statusResp)
 	if err != nil {
 		return GetNodeBlocksResponse{}, err
 	}
@@ -80,17 +102,52 @@ func (p *PeerNode) getNodeBlocks(ctx context.Context, lastBlockHash database.Has
 	return *blocks, nil
 }
 
+type GetNodeHeadersResponse struct {
+	Headers []database.BlockHeader `json:"headers"`
+}
+
+func (p *PeerNode) getNodeHeaders(ctx context.Context, lastBlockHash database.Hash, locator []database.Hash, limit int) (GetNodeHeadersResponse, error) {
+	query := url.Values{}
+	query.Set("fromBlock", lastBlockHash.String())
+	query.Set("limit", fmt.Sprint(limit))
+	if len(locator) > 0 {
+		hashes := make([]string, len(locator))
+		for i, hash := range locator {
+			hashes[i] = hash.String()
+		}
+		query.Set("locator", strings.Join(hashes, ","))
+	}
+	var res GetNodeHeadersResponse
+	result, err := getReq(ctx, p, "node/headers?"+query.Encode(), &res)
+	if err != nil {
+		return GetNodeHeadersResponse{}, err
+	}
+	headers, ok := result.(*GetNodeHeadersResponse)
+	if !ok {
+		return GetNodeHeadersResponse{}, fmt.Errorf("%s. could not convert a response to type GetNodeHeadersResponse", logger.Prefix())
+	}
+	return *headers, nil
+}
+
 type GetAddingPeerResponse struct {
 	Success bool   `json:"success"`
 	Error   string `json:"error"`
 }
 
-func (p *PeerNode) joinPeer(ctx context.Context, ip string, port uint) (GetAddingPeerResponse, error) {
+// Send the join request signed by the node key.
+func (p *PeerNode) joinPeer(ctx context.Context, join p2p.JoinRequest, sig string) (GetAddingPeerResponse, error) {
 	ctxWithTimeout, cancel := context.WithTimeout(ctx, 1*time.Second)
 	defer cancel()
 
+	query := url.Values{}
+	query.Set("nodeId", join.NodeID)
+	query.Set("ip", join.IP)
+	query.Set("port", fmt.Sprint(join.Port))
+	query.Set("p2pPort", fmt.Sprint(join.P2PPort))
+	query.Set("time", fmt.Sprint(join.Time))
+	query.Set("sig", sig)
 	var res GetAddingPeerResponse
-	result, err := getReq(ctxWithTimeout, p, fmt.Sprintf("/node/addpeer?ip=%s&port=%d`", ip, port), &res)
+	result, err := getReq(ctxWithTimeout, p, "node/addpeer?"+query.Encode(), &res)
 	fmt.Printf("result :: %v", result)
 	if err != nil {
 		logger.Printf("e %v\n", err)
@@ -104,6 +161,16 @@ func (p *PeerNode) joinPeer(ctx context.Context, ip string, port uint) (GetAddin
 	return *response, nil
 }
 
+func (p *PeerNode) announceBlock(ctx context.Context, req AnnounceBlockReq) error {
+	var res GetAddingPeerResponse
+	return postReq(ctx, p, "node/announce/block", req, &res)
+}
+
+func (p *PeerNode) announceTX(ctx context.Context, req AnnounceTxReq) error {
+	var res GetAddingPeerResponse
+	return postReq(ctx, p, "node/announce/tx", req, &res)
+}
+
 // create a inner variable in order to mock it in test
 var httpClient *http.Client = http.DefaultClient
 
@@ -113,16 +180,64 @@ func getReq(ctx context.Context, p *PeerNode, path string, resp any) (any, error
 	if err != nil {
 		return nil, err
 	}
+	// setting the header manually disables the transparent gzip decoding of the http.Transport,
+	// so the body is decoded in decodedBody.
+	req.Header.Set("Accept-Encoding", "zstd, gzip")
 	response, err := httpClient.Do(req)
 	if err != nil {
 		return &resp, err
 	}
+	defer response.Body.Close()
 	if response.StatusCode != http.StatusOK {
 		return nil, errors.New("Not found")
 	}
-	defer response.Body.Close()
-	if err := json.NewDecoder(response.Body).Decode(&resp); err != nil {
+	body, err := decodedBody(response)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
 		return resp, err
 	}
 	return resp, nil
 }
+
+// Wrap the response body with a decoder matching the Content-Encoding header.
+func decodedBody(response *http.Response) (io.ReadCloser, error) {
+	switch encoding := response.Header.Get("Content-Encoding"); encoding {
+	case "":
+		return io.NopCloser(response.Body), nil
+	case "gzip":
+		return gzip.NewReader(response.Body)
+	case "zstd":
+		dec, err := zstd.NewReader(response.Body)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding '%s'", encoding)
+	}
+}
+
+func postReq(ctx context.Context, p *PeerNode, path string, body any, resp any) error {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/%s", p.TcpAddressWithProtocol(), path), bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	response, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("peer %s responded with %d: %s", p.TcpAddress(), response.StatusCode, msg)
+	}
+	return json.NewDecoder(response.Body).Decode(resp)
+}
@@ -0,0 +1,118 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func newScoreTestNode(t *testing.T) (*Node, *testClock) {
+	n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+	clock := &testClock{time.Now()}
+	n.SetClock(clock)
+	return n, clock
+}
+
+func addTestPeer(t *testing.T, n *Node, id string, port uint) {
+	peer := NewPeerNode("localhost", port, false, true)
+	peer.ID = id
+	if err := n.AddPeer(peer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNode_PeerBannedByScore(t *testing.T) {
+	n, clock := newScoreTestNode(t)
+	addTestPeer(t, n, "bad", 8086)
+
+	for i := 0; i < -PEER_BAN_SCORE/-PEER_SCORE_INVALID_DATA; i++ {
+		n.adjustPeerScore("bad", PEER_SCORE_INVALID_DATA, "invalid block")
+	}
+	if len(n.knownPeersList()) != 0 {
+		t.Fatal("expected the banned peer to be removed from the known peers")
+	}
+	if _, ok := n.bannedPeersMap()["bad"]; !ok {
+		t.Fatal("expected the peer to be banned")
+	}
+
+	peer := NewPeerNode("localhost", 8086, false, true)
+	peer.ID = "bad"
+	if err := n.AddPeer(peer); !errors.Is(err, ErrPeerBanned) {
+		t.Fatalf("expected the banned peer to be rejected, got %v", err)
+	}
+
+	// the ban expires
+	clock.now = clock.now.Add(PEER_BAN_DURATION + time.Second)
+	if err := n.AddPeer(peer); err != nil {
+		t.Fatalf("expected the peer to be added after the ban, got %v", err)
+	}
+	if got := n.knownPeersMap()["bad"].Score; got != PEER_INITIAL_SCORE {
+		t.Fatalf("expected the initial score after the ban, got %d", got)
+	}
+}
+
+func TestNode_BanAndUnbanPeer(t *testing.T) {
+	n, _ := newScoreTestNode(t)
+	addTestPeer(t, n, "peer", 8086)
+
+	if err := n.BanPeer("peer", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if n.IsKnownPeer(&PeerNode{ID: "peer"}) {
+		t.Fatal("expected the banned peer to be removed")
+	}
+	if err := n.UnbanPeer("peer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.UnbanPeer("peer"); !errors.Is(err, ErrPeerNotFound) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+	addTestPeer(t, n, "peer", 8086)
+}
+
+func TestNode_PeerEviction(t *testing.T) {
+	defer func(limit int) { MAX_PEERS = limit }(MAX_PEERS)
+	MAX_PEERS = 3
+
+	n, _ := newScoreTestNode(t)
+	n.bootstrapPeers = []PeerNode{*NewPeerNode("localhost", 9000, true, false)}
+	bootstrap := NewPeerNode("localhost", 9000, false, true)
+	bootstrap.ID = "bootstrap"
+	if err := n.AddPeer(bootstrap); err != nil {
+		t.Fatal(err)
+	}
+	addTestPeer(t, n, "good", 8086)
+	addTestPeer(t, n, "slow", 8087)
+	n.adjustPeerScore("good", PEER_SCORE_GOOD_RESPONSE, "")
+	n.adjustPeerScore("bootstrap", PEER_SCORE_TIMEOUT, "timeout")
+	n.adjustPeerScore("slow", PEER_SCORE_TIMEOUT, "timeout")
+
+	addTestPeer(t, n, "new", 8088)
+	known := n.knownPeersMap()
+	if _, ok := known["slow"]; ok {
+		t.Fatal("expected the peer with the lowest score to be evicted")
+	}
+	for _, id := range []string{"bootstrap", "good", "new"} {
+		if _, ok := known[id]; !ok {
+			t.Fatalf("expected peer %s to be kept, got %v", id, known)
+		}
+	}
+
+	// all the peers score better than a new one
+	n.adjustPeerScore("new", PEER_SCORE_GOOD_RESPONSE, "")
+	peer := NewPeerNode("localhost", 8089, false, true)
+	peer.ID = fmt.Sprintf("peer-%d", 8089)
+	if err := n.AddPeer(peer); !errors.Is(err, ErrPeerLimit) {
+		t.Fatalf("expected the peer limit error, got %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The score changes of a peer. A peer reaching PEER_BAN_SCORE is banned for PEER_BAN_DURATION.
+const (
+	PEER_INITIAL_SCORE            = 0
+	PEER_MAX_SCORE                = 100
+	PEER_BAN_SCORE                = -100
+	PEER_SCORE_GOOD_RESPONSE      = 1
+	PEER_SCORE_TIMEOUT            = -10
+	PEER_SCORE_INVALID_DATA       = -25
+	PEER_SCORE_PROTOCOL_VIOLATION = -50
+)
+
+var (
+	PEER_BAN_DURATION = time.Hour
+	// The limit of the known peers. A new peer evicts the known peer with the lowest score.
+	MAX_PEERS = 50
+
+	ErrPeerBanned   = errors.New("peer is banned")
+	ErrPeerLimit    = errors.New("peer limit reached")
+	ErrPeerNotFound = errors.New("peer not found")
+)
+
+// Change the score of the known peer. Unknown peers, e.g. the not identified bootstrap nodes, are ignored.
+func (n *Node) adjustPeerScore(id string, delta int, reason string) {
+	if id == "" {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	peer, ok := n.knownPeers[id]
+	if !ok {
+		return
+	}
+	peer.Score = min(peer.Score+delta, PEER_MAX_SCORE)
+	if delta > 0 {
+		peer.LastSeen = n.clock.Now().Unix()
+	}
+	if delta < 0 {
+		logger.Printf(".adjustPeerScore() peer %s score %d (%d): %s\n", id, peer.Score, delta, reason)
+	}
+	if peer.Score <= PEER_BAN_SCORE {
+		n.banPeer(id, n.clock.Now().Add(PEER_BAN_DURATION))
+		return
+	}
+	n.knownPeers[id] = peer
+}
+
+// Ban the peer for the duration. The peer is removed from the known peers and disconnected.
+func (n *Node) BanPeer(id string, duration time.Duration) error {
+	if id == "" {
+		return fmt.Errorf("%w: empty node id", ErrPeerNotFound)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.banPeer(id, n.clock.Now().Add(duration))
+	return nil
+}
+
+// Lift the ban of the peer. The peer can be added again, once it's discovered or joins.
+func (n *Node) UnbanPeer(id string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.bannedPeers[id]; !ok {
+		return fmt.Errorf("%w: %s is not banned", ErrPeerNotFound, id)
+	}
+	delete(n.bannedPeers, id)
+	logger.Printf(".UnbanPeer() peer %s unbanned\n", id)
+	return nil
+}
+
+func (n *Node) isBanned(id string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.isBannedLocked(id)
+}
+
+// Should be called with n.mu held. Drops the expired ban.
+func (n *Node) isBannedLocked(id string) bool {
+	until, ok := n.bannedPeers[id]
+	if !ok {
+		return false
+	}
+	if n.clock.Now().Before(until) {
+		return true
+	}
+	delete(n.bannedPeers, id)
+	return false
+}
+
+// Should be called with n.mu held.
+func (n *Node) banPeer(id string, until time.Time) {
+	n.bannedPeers[id] = until
+	delete(n.knownPeers, id)
+	n.disconnectPeer(id)
+	logger.Printf(".banPeer() peer %s banned until %s\n", id, until.Format(time.RFC3339))
+}
+
+// Make room for a new peer by evicting the known peer with the lowest score, which isn't
+// a bootstrap node and doesn't score better than a new peer. Should be called with n.mu held.
+func (n *Node) evictPeer() bool {
+	var (
+		worst PeerNode
+		found bool
+	)
+	for _, peer := range n.knownPeers {
+		if peer.IsBootstrap || peer.Score > PEER_INITIAL_SCORE {
+			continue
+		}
+		// prefer the inactive peers among the ones with the same score
+		if !found || peer.Score < worst.Score || (peer.Score == worst.Score && worst.IsActive && !peer.IsActive) {
+			worst, found = peer, true
+		}
+	}
+	if !found {
+		return false
+	}
+	delete(n.knownPeers, worst.ID)
+	n.disconnectPeer(worst.ID)
+	logger.Printf(".evictPeer() peer %s evicted with score %d\n", worst.ID, worst.Score)
+	return true
+}
+
+// Close the p2p connection of the peer, if there is one.
+func (n *Node) disconnectPeer(id string) {
+	if n.p2p == nil {
+		return
+	}
+	if p, ok := n.p2p.Peer(id); ok {
+		p.Close()
+	}
+}
+
+func (n *Node) bannedPeersMap() map[string]int64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	res := make(map[string]int64, len(n.bannedPeers))
+	for id := range n.bannedPeers {
+		if n.isBannedLocked(id) {
+			res[id] = n.bannedPeers[id].Unix()
+		}
+	}
+	return res
+}
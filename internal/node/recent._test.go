@@ -0,0 +1,82 @@
+package node
+
+import (
+	"context"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"testing"
+	"time"
+)
+
+func TestRecentTxs_Bounded(t *testing.T) {
+	r := newRecentTxs()
+	r.max, r.blocks = 2, 10
+	now := time.Now()
+
+	r.add("a", 1, now)
+	r.add("b", 2, now)
+	r.add("c", 3, now)
+	if r.len() != 2 || r.has("a", 3, now) {
+		t.Fatal("expected the oldest transaction to be evicted")
+	}
+	if r.has("b", 12, now) || !r.has("c", 12, now) {
+		t.Fatal("expected the transaction of an old block to expire")
+	}
+	if r.has("c", 3, now.Add(r.ttl)) || r.len() != 0 {
+		t.Fatal("expected the transaction to expire by time")
+	}
+}
+
+func TestNode_MinedTXsAreIgnored(t *testing.T) {
+	key := newTestKey(t)
+	s := setupMempoolTestState(t, key)
+	n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+	n.state, n.opened = s, true
+
+	tx := signTestTx(t, key, 1, 10, 0)
+	pending := newPendingBlockAt(*s.GetLastHash(), s.NextBlockNumber(), []database.SignedTx{tx}, database.NewAccount("miner"), time.Now())
+	block, err := Mine(context.Background(), pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	// the transaction isn't in the recent set, so it's found in the index
+	if err := n.AddPendingTX(tx); err != nil {
+		t.Fatalf("expected the mined transaction to be ignored, got %v", err)
+	}
+	if n.mempool.len() != 0 || n.recentTXs.len() != 1 {
+		t.Fatalf("expected the mined transaction to be remembered, got %d recent", n.recentTXs.len())
+	}
+}
+
+func TestNode_TxStatusMined(t *testing.T) {
+	key := newTestKey(t)
+	s := setupMempoolTestState(t, key)
+	n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+	n.state, n.opened = s, true
+
+	var blocks []database.Block
+	startTime := time.Now().Add(-time.Minute)
+	for nonce := uint(1); nonce <= 2; nonce++ {
+		blockTime := startTime.Add(time.Duration(nonce) * time.Second)
+		pending := newPendingBlockAt(*s.GetLastHash(), s.NextBlockNumber(), []database.SignedTx{signTestTx(t, key, nonce, 10, 0)}, database.NewAccount("miner"), blockTime)
+		block, err := Mine(context.Background(), pending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+
+	for _, block := range blocks {
+		hash, _ := block.Payload[0].Hash()
+		status := n.TxStatus(hash)
+		if status.Status != "mined" || status.BlockNumber == nil || *status.BlockNumber != block.Header.Number {
+			t.Fatalf("expected the transaction to be mined in the block %d, got %+v", block.Header.Number, status)
+		}
+	}
+}
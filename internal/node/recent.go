@@ -0,0 +1,117 @@
+package node
+
+import (
+	"container/list"
+	"sync"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"time"
+)
+
+var (
+	// The limit of the remembered mined transactions. The oldest one is forgotten first.
+	RECENT_TXS_MAX = 10000
+	// How long a mined transaction is remembered.
+	RECENT_TXS_TTL = time.Hour
+	// How many blocks a mined transaction is remembered for.
+	RECENT_TXS_BLOCKS uint64 = 100
+)
+
+type recentTx struct {
+	hash   string
+	seenAt time.Time
+	// the number of the block, which includes the transaction
+	height uint64
+}
+
+// recentTxs is the bounded set of the recently mined transactions, which rejects the mined transactions
+// re-announced by the peers without a lookup in the transaction index. The older ones are found in the index.
+type recentTxs struct {
+	mu     sync.Mutex
+	max    int
+	ttl    time.Duration
+	blocks uint64
+	// hash -> element of order
+	items map[string]*list.Element
+	// the oldest first
+	order *list.List
+}
+
+func newRecentTxs() *recentTxs {
+	return &recentTxs{
+		max:    RECENT_TXS_MAX,
+		ttl:    RECENT_TXS_TTL,
+		blocks: RECENT_TXS_BLOCKS,
+		items:  make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+func (r *recentTxs) add(hash string, height uint64, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if el, ok := r.items[hash]; ok {
+		r.order.Remove(el)
+	}
+	r.items[hash] = r.order.PushBack(recentTx{hash: hash, seenAt: now, height: height})
+	for r.order.Len() > r.max {
+		r.removeLocked(r.order.Front())
+	}
+}
+
+// Whether the transaction was mined recently, as of the block height. The expired entries are dropped.
+func (r *recentTxs) has(hash string, height uint64, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the entries are added in time order, so the expired ones are at the front
+	for el := r.order.Front(); el != nil && now.Sub(el.Value.(recentTx).seenAt) >= r.ttl; el = r.order.Front() {
+		r.removeLocked(el)
+	}
+	el, ok := r.items[hash]
+	if !ok {
+		return false
+	}
+	if el.Value.(recentTx).height+r.blocks <= height {
+		r.removeLocked(el)
+		return false
+	}
+	return true
+}
+
+func (r *recentTxs) remove(hash string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if el, ok := r.items[hash]; ok {
+		r.removeLocked(el)
+	}
+}
+
+func (r *recentTxs) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.order.Len()
+}
+
+// Should be called with r.mu held.
+func (r *recentTxs) removeLocked(el *list.Element) {
+	delete(r.items, el.Value.(recentTx).hash)
+	r.order.Remove(el)
+}
+
+// Whether the transaction is already mined: it's found in the recent set or in the transaction index.
+func (n *Node) isMinedTX(hash database.Hash) bool {
+	snapshot := n.state.Snapshot()
+	height := snapshot.NextBlockNumber() - 1
+	now := n.clock.Now()
+	if n.recentTXs.has(hash.String(), height, now) {
+		return true
+	}
+	number, ok, err := n.state.TxBlockNumber(hash)
+	if err != nil {
+		logger.Printf(".isMinedTX() looking up tx %s: %v\n", hash, err)
+		return false
+	}
+	if ok {
+		n.recentTXs.add(hash.String(), number, now)
+	}
+	return ok
+}
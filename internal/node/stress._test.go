@@ -0,0 +1,170 @@
+package node
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Run the sync, the miner, the external miners and the API against a running node at the same time.
+// It's meant to be run with -race.
+func TestNode_ConcurrentStress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the stress test is skipped in the short mode")
+	}
+	defer func(mine, sync time.Duration) { MINE_PENDING_INTERVAL, SYNC_TIME_TIMEOUT = mine, sync }(MINE_PENDING_INTERVAL, SYNC_TIME_TIMEOUT)
+	MINE_PENDING_INTERVAL, SYNC_TIME_TIMEOUT = 20*time.Millisecond, 50*time.Millisecond
+
+	forkKey, keys := newTestKey(t), []*ecdsa.PrivateKey{newTestKey(t), newTestKey(t), newTestKey(t)}
+	dir := setupGenesisDir(t, append([]*ecdsa.PrivateKey{forkKey}, keys...)...)
+
+	// a competing chain of the same genesis, served to the sync
+	srcDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(srcDir, "database"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := os.ReadFile(filepath.Join(dir, "database", "genesis.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "database", "genesis.json"), genesis, 0600); err != nil {
+		t.Fatal(err)
+	}
+	src, err := database.NewState(srcDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { src.Close() })
+	mineTestChain(t, src, forkKey, 5)
+
+	n := NewNode(dir, 8085, "localhost", nil, database.NewAccount("miner"), true)
+	n.SetMinerThreads(2)
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ctx.Err() == nil; i++ {
+				f(i)
+			}
+		}()
+	}
+
+	// the transactions of the users
+	for _, key := range keys {
+		from := crypto.PubkeyToAddress(key.PublicKey)
+		run(func(i int) {
+			n.AddPendingTX(signTestTx(t, key, n.NextPendingNonce(from), 1, uint(i%3)))
+			time.Sleep(5 * time.Millisecond)
+		})
+	}
+	// the API readers
+	run(func(i int) {
+		n.ViewNodeStatus()
+		n.ViewBalancesList()
+		n.TxStatus(database.Hash{byte(i)})
+		n.ViewSyncHeaders(database.Hash{}, nil, 10)
+		n.ViewSyncBlocks(database.Hash{}, 5)
+		n.MiningStatus()
+		n.EventMetrics()
+	})
+	// the admin API
+	run(func(i int) {
+		id := fmt.Sprintf("peer-%d", i%4)
+		n.AddPeer(&PeerNode{ID: id, IP: "127.0.0.1", Port: uint(1 + i%4)})
+		n.SetMinerThreads(1 + i%2)
+		n.SetCoinbase(database.NewAccount(fmt.Sprintf("0x%02x", i%2+1)))
+		if i%10 == 0 {
+			n.StopMining()
+			n.BanPeer(id, time.Minute)
+			n.StartMining()
+			n.UnbanPeer(id)
+		}
+		time.Sleep(5 * time.Millisecond)
+	})
+	// an external miner
+	run(func(i int) {
+		work, err := n.GetWork(common.Address{})
+		if err != nil {
+			time.Sleep(10 * time.Millisecond)
+			return
+		}
+		header, err := MineHeader(ctx, work.Header, 1)
+		if err != nil {
+			return
+		}
+		n.SubmitWork(SubmitWorkReq{WorkID: work.WorkID, Nonce: header.Nonce, ExtraNonce: header.ExtraNonce, Time: header.Time})
+	})
+	// the sync with the competing chain
+	client := &testPeerClient{src: src, dir: srcDir, blocksBudget: -1}
+	run(func(i int) {
+		status, _ := client.getStatus(ctx)
+		n.syncBlocks(ctx, PeerNode{ID: "fork"}, client, status)
+		time.Sleep(50 * time.Millisecond)
+	})
+	// a subscriber of the events
+	events := n.Subscribe()
+	run(func(i int) {
+		select {
+		case <-events.Events():
+		case <-ctx.Done():
+		}
+	})
+
+	wg.Wait()
+	events.Close()
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pending transactions follow the nonces of the chain
+	snapshot := n.state.Snapshot()
+	for _, tx := range n.mempool.all() {
+		if tx.Nonce < snapshot.NextAccountNonce(tx.From) {
+			t.Fatalf("the pending transaction of %s with nonce %d is already mined", tx.From, tx.Nonce)
+		}
+	}
+	// the persisted chain is the one the node ended with
+	reopened, err := database.NewState(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if *reopened.GetLastHash() != snapshot.LastHash() || snapshot.LastBlock().Header.Number == 0 {
+		t.Fatalf("expected the persisted chain to end with block %d %s, got %d %s",
+			snapshot.LastBlock().Header.Number, snapshot.LastHash(), reopened.GetLastBlock().Header.Number, reopened.GetLastHash())
+	}
+	// every persisted block is the child of the previous one, the first one is the child of the genesis
+	blocks, err := reopened.GetBlocksAfter(database.Hash{}, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parent database.Hash
+	for i, block := range blocks {
+		if block.Header.Number != uint64(i+1) || block.Header.ParentHash != parent {
+			t.Fatalf("expected the block %d to follow the block %s, got the block %d of the parent %s",
+				i+1, parent, block.Header.Number, block.Header.ParentHash)
+		}
+		if parent, err = block.Hash(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if parent != snapshot.LastHash() {
+		t.Fatalf("expected the persisted chain to link up to %s, got %s", snapshot.LastHash(), parent)
+	}
+}
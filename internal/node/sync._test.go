@@ -0,0 +1,287 @@
+package node
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"taraskrasiuk/blockchain_l/internal/wallet"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Create the data dir with the genesis, which funds the key's account.
+func setupSyncTestDir(t *testing.T, key *ecdsa.PrivateKey) string {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "database"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	gen := database.NewGenesisResource()
+	gen.AddAccount(crypto.PubkeyToAddress(key.PublicKey).Hex(), 1000000)
+	if err := gen.SaveToFile(filepath.Join(dir, "database", "genesis.json")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Mine the chain of the blocks with a single transaction each.
+func mineTestChain(t *testing.T, s *database.State, key *ecdsa.PrivateKey, blocks int) {
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	start := time.Now().Add(-5 * time.Minute)
+	for i := 0; i < blocks; i++ {
+		tx, err := wallet.SignTx(*database.NewTx(from, database.NewAccount("0x01"), "", 1, s.NextAccountNonce(from)), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending := newPendingBlockAt(*s.GetLastHash(), s.NextBlockNumber(), []database.SignedTx{tx}, database.NewAccount("miner"), start.Add(time.Duration(i)*time.Second))
+		block, err := Mine(context.Background(), pending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testPeerClient serves the headers and the blocks of the source state.
+type testPeerClient struct {
+	src *database.State
+	dir string
+	// fail the blocks requests after the number of successful ones, if not negative
+	blocksBudget int
+	tamper       func(headers []database.BlockHeader)
+}
+
+func (c *testPeerClient) getStatus(ctx context.Context) (GetPeerNodeStatusResponse, error) {
+	return GetPeerNodeStatusResponse{BlockNumber: c.src.GetLastBlock().Header.Number}, nil
+}
+
+func (c *testPeerClient) getHeaders(ctx context.Context, from database.Hash, locator []database.Hash, limit int) (GetNodeHeadersResponse, error) {
+	if len(locator) > 0 {
+		from, _ = c.src.FindAncestor(locator)
+	}
+	headers, err := c.src.GetHeadersAfter(from, c.dir, limit)
+	if c.tamper != nil {
+		c.tamper(headers)
+	}
+	return GetNodeHeadersResponse{headers}, err
+}
+
+func (c *testPeerClient) getBlocks(ctx context.Context, from database.Hash, limit int) (GetNodeBlocksResponse, error) {
+	if c.blocksBudget == 0 {
+		return GetNodeBlocksResponse{}, errors.New("timeout")
+	}
+	c.blocksBudget--
+	blocks, err := c.src.GetBlocksAfter(from, c.dir, limit)
+	return GetNodeBlocksResponse{blocks}, err
+}
+
+func (c *testPeerClient) announceBlock(ctx context.Context, req AnnounceBlockReq) error {
+	return nil
+}
+
+func (c *testPeerClient) announceTX(ctx context.Context, req AnnounceTxReq) error {
+	return nil
+}
+
+func setupSyncTest(t *testing.T, blocks int) (*Node, *testPeerClient) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcDir := setupSyncTestDir(t, key)
+	src, err := database.NewState(srcDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { src.Close() })
+	mineTestChain(t, src, key, blocks)
+
+	dstDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dstDir, "database"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := os.ReadFile(filepath.Join(srcDir, "database", "genesis.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dstDir, "database", "genesis.json"), genesis, 0600); err != nil {
+		t.Fatal(err)
+	}
+	n := NewNode(dstDir, 8085, "localhost", nil, database.NewAccount("miner"), true)
+	n.state, err = database.NewState(dstDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.state.Close() })
+	return n, &testPeerClient{src: src, dir: srcDir, blocksBudget: -1}
+}
+
+func TestNode_SyncHeadersFirst(t *testing.T) {
+	defer func(h, b int) { SYNC_HEADERS_BATCH, SYNC_BLOCKS_BATCH = h, b }(SYNC_HEADERS_BATCH, SYNC_BLOCKS_BATCH)
+	SYNC_HEADERS_BATCH, SYNC_BLOCKS_BATCH = 2, 2
+
+	n, client := setupSyncTest(t, 5)
+	peer := PeerNode{ID: "peer"}
+	status, _ := client.getStatus(context.Background())
+
+	// the download is interrupted after the first page of the blocks
+	client.blocksBudget = 1
+	if err := n.syncBlocks(context.Background(), peer, client, status); err == nil {
+		t.Fatal("expected the interrupted sync to fail")
+	}
+	if got := n.state.GetLastBlock().Header.Number; got != 2 {
+		t.Fatalf("expected 2 blocks synced before the interruption, got %d", got)
+	}
+	if got := n.headers.len(); got != 3 {
+		t.Fatalf("expected the validated headers of the rest of the blocks to be kept, got %d", got)
+	}
+
+	// the sync resumes from the kept headers
+	client.blocksBudget = -1
+	if err := n.syncBlocks(context.Background(), peer, client, status); err != nil {
+		t.Fatal(err)
+	}
+	if *n.state.GetLastHash() != *client.src.GetLastHash() {
+		t.Fatal("expected the local chain to match the peer's chain")
+	}
+	if n.headers.len() != 0 {
+		t.Fatal("expected no pending headers after the sync")
+	}
+}
+
+func TestNode_SyncRejectsInvalidHeaders(t *testing.T) {
+	n, client := setupSyncTest(t, 3)
+	client.tamper = func(headers []database.BlockHeader) {
+		if len(headers) > 1 {
+			headers[1].Time++
+		}
+	}
+	status, _ := client.getStatus(context.Background())
+	if err := n.syncBlocks(context.Background(), PeerNode{ID: "peer"}, client, status); err == nil {
+		t.Fatal("expected the tampered headers to be rejected")
+	}
+	// no block is downloaded before the headers are valid
+	if got := n.state.GetLastBlock().Header.Number; got != 0 {
+		t.Fatalf("expected no synced blocks, got %d", got)
+	}
+}
+
+func TestNode_SyncDownloadsFromMultiplePeers(t *testing.T) {
+	defer func(b int) { SYNC_BLOCKS_BATCH = b }(SYNC_BLOCKS_BATCH)
+	SYNC_BLOCKS_BATCH = 2
+
+	n, good := setupSyncTest(t, 7)
+	// the peer fails the blocks requests, its ranges are re-requested from the other peer
+	bad := &testPeerClient{src: good.src, dir: good.dir, blocksBudget: 1}
+	status, _ := good.getStatus(context.Background())
+	peers := []syncPeer{
+		{peer: PeerNode{ID: "bad"}, client: bad, status: status},
+		{peer: PeerNode{ID: "good"}, client: good, status: status},
+	}
+	if err := n.syncChain(context.Background(), peers); err != nil {
+		t.Fatal(err)
+	}
+	if *n.state.GetLastHash() != *good.src.GetLastHash() {
+		t.Fatal("expected the local chain to match the peers' chain")
+	}
+	progress := n.ViewNodeStatus().Sync
+	if progress.Syncing || progress.CurrentBlock != 7 || progress.TargetBlock != 7 {
+		t.Fatalf("unexpected sync progress %+v", progress)
+	}
+}
+
+// Build the local chain, which shares the first 2 blocks with the peer's chain of 6 blocks, and mines the
+// next 2 transactions on its own.
+func setupForkSyncTest(t *testing.T) (*Node, *testPeerClient) {
+	n, client := setupSyncTest(t, 6)
+	blocks, err := client.src.GetBlocksAfter(database.Hash{}, client.dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range blocks[:2] {
+		if _, err := n.state.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, txs := range [][]database.SignedTx{blocks[2].Payload, blocks[3].Payload} {
+		pending := newPendingBlockAt(*n.state.GetLastHash(), n.state.NextBlockNumber(), txs, database.NewAccount("fork"), time.Now().Add(-time.Minute))
+		block, err := Mine(context.Background(), pending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := n.state.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return n, client
+}
+
+func TestNode_SyncSwitchesToLongerFork(t *testing.T) {
+	n, client := setupForkSyncTest(t)
+
+	status, _ := client.getStatus(context.Background())
+	if err := n.syncBlocks(context.Background(), PeerNode{ID: "peer"}, client, status); err != nil {
+		t.Fatal(err)
+	}
+	if *n.state.GetLastHash() != *client.src.GetLastHash() {
+		t.Fatal("expected the local chain to switch to the peer's longer chain")
+	}
+	if depth := n.ViewNodeStatus().Sync.DivergenceDepth; depth != 2 {
+		t.Fatalf("expected the divergence depth of 2 blocks, got %d", depth)
+	}
+}
+
+// The peer serves the fork's headers, but not enough of its blocks to replace the local chain.
+func TestNode_SyncRevertsFailedFork(t *testing.T) {
+	defer func(b int) { SYNC_BLOCKS_BATCH = b }(SYNC_BLOCKS_BATCH)
+	SYNC_BLOCKS_BATCH = 1
+
+	for _, budget := range []int{0, 1} {
+		n, client := setupForkSyncTest(t)
+		lastHash, balances := *n.state.GetLastHash(), n.state.Balance()
+		client.blocksBudget = budget
+
+		status, _ := client.getStatus(context.Background())
+		if err := n.syncBlocks(context.Background(), PeerNode{ID: "peer"}, client, status); err == nil {
+			t.Fatal("expected the sync to fail")
+		}
+		if *n.state.GetLastHash() != lastHash {
+			t.Fatalf("expected the local chain to be restored after %d downloaded blocks, got the block %d", budget, n.state.GetLastBlock().Header.Number)
+		}
+		if !reflect.DeepEqual(n.state.Balance(), balances) {
+			t.Fatalf("expected the balances to be restored, got %v", n.state.Balance())
+		}
+		if pending := n.mempool.len(); pending != 0 {
+			t.Fatalf("expected the restored blocks' transactions not to be pending, got %d", pending)
+		}
+	}
+}
+
+// A replaced block, which can't be added back, stops the restore: the chain is restored up to the block before it.
+func TestNode_RevertForkReportsPartialRestore(t *testing.T) {
+	n, _ := setupForkSyncTest(t)
+	blocks, err := n.state.GetBlocksAfter(database.Hash{}, n.dirname, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _ := blocks[1].Hash()
+	restored, _ := blocks[2].Hash()
+	broken := blocks[3]
+	broken.Header.ParentHash = database.Hash{0x01}
+	fork := &forkSwitch{base: base, baseNumber: 2, lastNumber: 4, removed: []database.Block{blocks[2], broken}}
+
+	reverted, err := n.revertFork(fork)
+	if !reverted || err == nil {
+		t.Fatalf("expected the fork to be removed and the restore to fail, got %v %v", reverted, err)
+	}
+	if *n.state.GetLastHash() != restored {
+		t.Fatalf("expected the chain to be restored up to the block 3, got the block %d", n.state.GetLastBlock().Header.Number)
+	}
+}
@@ -0,0 +1,297 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"time"
+)
+
+var (
+	// The number of headers and blocks requested from a peer at once.
+	SYNC_HEADERS_BATCH = 500
+	SYNC_BLOCKS_BATCH  = 20
+	// Timeout of a single headers or blocks request.
+	SYNC_REQUEST_TIMEOUT = 10 * time.Second
+
+	// The limits of a single page served to the peers.
+	MAX_SYNC_HEADERS       = 2000
+	MAX_SYNC_BLOCKS        = 100
+	MAX_SYNC_RESPONSE_SIZE = 16 << 20
+	MAX_LOCATOR_HASHES     = 128
+
+	errSyncMismatch = errors.New("the peer's blocks don't match the synced headers")
+)
+
+// headerChain keeps the validated headers, whose blocks aren't downloaded yet.
+// An interrupted sync resumes from them, instead of downloading the headers again.
+type headerChain struct {
+	mu sync.Mutex
+	// the local block the headers extend, which is behind the local tip, if the headers fork from the local chain
+	base       database.Hash
+	baseNumber uint64
+	headers    []database.BlockHeader
+	hashes     []database.Hash
+}
+
+// Drop the headers up to the local chain's last block. The headers forking from the local chain
+// are kept, while they are longer than the local chain. Otherwise all headers are dropped.
+func (c *headerChain) rebase(lastHash database.Hash, lastNumber uint64, isLocal func(database.Hash) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, hash := range c.hashes {
+		if hash == lastHash {
+			c.headers, c.hashes = c.headers[i+1:], c.hashes[i+1:]
+			c.base, c.baseNumber = lastHash, lastNumber
+			return
+		}
+	}
+	if c.base == lastHash {
+		return
+	}
+	if len(c.headers) > 0 && c.headers[len(c.headers)-1].Number > lastNumber && isLocal(c.base) {
+		return
+	}
+	c.headers, c.hashes = nil, nil
+	c.base, c.baseNumber = lastHash, lastNumber
+}
+
+// Drop the headers and start the new ones from the local block.
+func (c *headerChain) locate(base database.Hash, baseNumber uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.headers, c.hashes = nil, nil
+	c.base, c.baseNumber = base, baseNumber
+}
+
+// The local block the headers extend.
+func (c *headerChain) root() (database.Hash, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.base, c.baseNumber
+}
+
+// The hash and the number of the last validated header, or the root, if there are no headers.
+func (c *headerChain) tip() (database.Hash, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.headers) == 0 {
+		return c.base, c.baseNumber
+	}
+	return c.hashes[len(c.hashes)-1], c.headers[len(c.headers)-1].Number
+}
+
+// Validate the headers against the tip and append them.
+func (c *headerChain) append(headers []database.BlockHeader, tipHash database.Hash, tipNumber uint64, now time.Time) error {
+	hashes := make([]database.Hash, 0, len(headers))
+	for _, h := range headers {
+		hash, err := database.ValidateHeader(h, tipHash, tipNumber, now)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, hash)
+		tipHash, tipNumber = hash, h.Number
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.headers = append(c.headers, headers...)
+	c.hashes = append(c.hashes, hashes...)
+	return nil
+}
+
+// The hashes of the first n headers.
+func (c *headerChain) next(n int) []database.Hash {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]database.Hash(nil), c.hashes[:min(n, len(c.hashes))]...)
+}
+
+// Drop the first header, once its block is added to the local chain.
+func (c *headerChain) pop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.headers) > 0 {
+		c.base, c.baseNumber = c.hashes[0], c.headers[0].Number
+		c.headers, c.hashes = c.headers[1:], c.hashes[1:]
+	}
+}
+
+func (c *headerChain) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.headers, c.hashes = nil, nil
+}
+
+func (c *headerChain) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.headers)
+}
+
+// Sync the blocks from the single peer, which is ahead of the local chain.
+func (n *Node) syncBlocks(ctx context.Context, p PeerNode, client peerClient, status GetPeerNodeStatusResponse) error {
+	return n.syncChain(ctx, []syncPeer{{peer: p, client: client, status: status}})
+}
+
+// Download and validate the headers up to the target. Unless the pending headers are resumed, the first
+// request sends the block locator of the local chain, and the headers follow the latest common block.
+func (n *Node) syncHeaders(ctx context.Context, p PeerNode, client peerClient, target uint64) error {
+	snapshot := n.state.Snapshot()
+	lastNumber := snapshot.LastBlock().Header.Number
+	n.headers.rebase(snapshot.LastHash(), lastNumber, n.isLocalBlock)
+	locate := n.headers.len() == 0
+	for {
+		tipHash, tipNumber := n.headers.tip()
+		if tipNumber >= target {
+			return nil
+		}
+		var locator []database.Hash
+		if locate {
+			locator = n.state.BlockLocator()
+		}
+		reqCtx, cancel := context.WithTimeout(ctx, SYNC_REQUEST_TIMEOUT)
+		res, err := client.getHeaders(reqCtx, tipHash, locator, SYNC_HEADERS_BATCH)
+		cancel()
+		if err != nil {
+			n.adjustPeerScore(p.ID, PEER_SCORE_TIMEOUT, err.Error())
+			return fmt.Errorf("could not retrieve the headers after %s: %w", tipHash, err)
+		}
+		if len(res.Headers) == 0 {
+			return nil
+		}
+		if locate {
+			ancestor := res.Headers[0].ParentHash
+			number, ok := n.state.BlockNumber(ancestor)
+			if !ok {
+				n.adjustPeerScore(p.ID, PEER_SCORE_INVALID_DATA, "headers don't follow the locator")
+				return fmt.Errorf("the headers from peer %s don't follow any block of the locator", p.TcpAddress())
+			}
+			if number < lastNumber {
+				logger.Printf(".syncHeaders() peer %s diverged from the local chain at block %d, %d blocks deep\n", p.TcpAddress(), number, lastNumber-number)
+				n.progress.setDivergence(lastNumber - number)
+			}
+			n.headers.locate(ancestor, number)
+			tipHash, tipNumber = ancestor, number
+			locate = false
+		}
+		if err := n.headers.append(res.Headers, tipHash, tipNumber, n.clock.Now()); err != nil {
+			n.adjustPeerScore(p.ID, PEER_SCORE_INVALID_DATA, err.Error())
+			return fmt.Errorf("invalid headers from peer %s: %w", p.TcpAddress(), err)
+		}
+		logger.Printf(".syncHeaders() validated headers up to %d of %d\n", res.Headers[len(res.Headers)-1].Number, target)
+		if len(res.Headers) < SYNC_HEADERS_BATCH {
+			return nil
+		}
+	}
+}
+
+func (n *Node) isLocalBlock(hash database.Hash) bool {
+	_, ok := n.state.BlockNumber(hash)
+	return ok
+}
+
+// forkSwitch is the local chain replaced by a longer fork. The removed blocks are kept, until the
+// fork's blocks are downloaded past the replaced tip.
+type forkSwitch struct {
+	base       database.Hash
+	baseNumber uint64
+	lastNumber uint64
+	removed    []database.Block
+}
+
+// Switch to the validated headers, which fork from the local chain and are longer than it: rewind the
+// local chain to the common block, and return the transactions of the removed blocks to the pending ones.
+// The headers, which aren't longer, are dropped. Returns the switch, if the chain is rewound.
+func (n *Node) switchFork() (*forkSwitch, error) {
+	snapshot := n.state.Snapshot()
+	lastHash, lastNumber := snapshot.LastHash(), snapshot.LastBlock().Header.Number
+	n.headers.rebase(lastHash, lastNumber, n.isLocalBlock)
+	base, baseNumber := n.headers.root()
+	if base == lastHash || n.headers.len() == 0 {
+		return nil, nil
+	}
+	if _, tipNumber := n.headers.tip(); tipNumber <= lastNumber {
+		n.headers.reset()
+		logger.Printf(".switchFork() the fork at block %d isn't longer than the local chain\n", baseNumber)
+		return nil, nil
+	}
+	removed, err := n.state.RewindTo(base, n.dirname)
+	if err != nil {
+		return nil, fmt.Errorf("could not rewind the chain to block %d: %w", baseNumber, err)
+	}
+	logger.Printf(".switchFork() rewound %d blocks to the common block %d\n", len(removed), baseNumber)
+	n.publish(Event{Type: EventReorg, Reorg: &ReorgEvent{CommonHash: base, CommonNumber: baseNumber, Removed: len(removed)}})
+	n.restorePendingTXs(removed)
+	return &forkSwitch{base: base, baseNumber: baseNumber, lastNumber: lastNumber, removed: removed}, nil
+}
+
+// Go back to the replaced chain, if the fork's blocks couldn't be downloaded past its tip, e.g. the peers
+// withheld the blocks of a valid headers chain. The fork's blocks are removed and the replaced ones are
+// added again. Returns true, if the fork's blocks are removed, and an error, if the replaced chain
+// couldn't be restored completely.
+func (n *Node) revertFork(fork *forkSwitch) (bool, error) {
+	if n.state.GetLastBlock().Header.Number > fork.lastNumber {
+		return false, nil
+	}
+	n.headers.reset()
+	dropped, err := n.state.RewindTo(fork.base, n.dirname)
+	if err != nil {
+		return false, fmt.Errorf("could not rewind the chain to block %d: %w", fork.baseNumber, err)
+	}
+	n.restorePendingTXs(dropped)
+	n.publish(Event{Type: EventReorg, Reorg: &ReorgEvent{CommonHash: fork.base, CommonNumber: fork.baseNumber, Removed: len(dropped)}})
+	for _, block := range fork.removed {
+		if _, err = n.state.AddBlock(block); err != nil {
+			err = fmt.Errorf("could not add back block %d: %w", block.Header.Number, err)
+			break
+		}
+		n.notifyNewBlock(block)
+	}
+	restored := n.state.GetLastBlock().Header.Number
+	if err != nil {
+		logger.Printf(".revertFork() restored the chain up to block %d of %d: %v\n", restored, fork.lastNumber, err)
+		return true, err
+	}
+	logger.Printf(".revertFork() restored the chain up to block %d\n", restored)
+	return true, nil
+}
+
+// A page of the blocks after the hash, limited by the number of blocks and the response size.
+func (n *Node) blocksPage(afterHash database.Hash, limit int) ([]database.Block, error) {
+	if limit <= 0 || limit > MAX_SYNC_BLOCKS {
+		limit = MAX_SYNC_BLOCKS
+	}
+	blocks, err := n.state.GetBlocksAfter(afterHash, n.dirname, limit)
+	if err != nil {
+		return nil, err
+	}
+	size := 0
+	for i, b := range blocks {
+		blockSize, err := database.BlockSize(b)
+		if err != nil {
+			return nil, err
+		}
+		// at least one block is returned
+		if size += blockSize; size > MAX_SYNC_RESPONSE_SIZE && i > 0 {
+			return blocks[:i], nil
+		}
+	}
+	return blocks, nil
+}
+
+// A page of the headers after the hash.
+// If the locator is set, the headers follow the latest local block listed in it.
+func (n *Node) headersPage(afterHash database.Hash, locator []database.Hash, limit int) ([]database.BlockHeader, error) {
+	if limit <= 0 || limit > MAX_SYNC_HEADERS {
+		limit = MAX_SYNC_HEADERS
+	}
+	if len(locator) > MAX_LOCATOR_HASHES {
+		return nil, fmt.Errorf("the locator of %d hashes exceeds the limit of %d", len(locator), MAX_LOCATOR_HASHES)
+	}
+	if len(locator) > 0 {
+		afterHash, _ = n.state.FindAncestor(locator)
+	}
+	return n.state.GetHeadersAfter(afterHash, n.dirname, limit)
+}
@@ -0,0 +1,50 @@
+package node
+
+import (
+	"context"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"taraskrasiuk/blockchain_l/internal/p2p"
+)
+
+// Transport carries the requests of the node to its peers in place of the HTTP API and the p2p protocol,
+// e.g. the in-memory network of the simulator. The peers are addressed by their tcp address, the bootstrap
+// nodes have no node id until they're synced with. The announcements should be delivered asynchronously,
+// they're sent by the node inline.
+type Transport interface {
+	Status(ctx context.Context, peer PeerNode) (GetPeerNodeStatusResponse, error)
+	Headers(ctx context.Context, peer PeerNode, lastBlockHash database.Hash, locator []database.Hash, limit int) (GetNodeHeadersResponse, error)
+	Blocks(ctx context.Context, peer PeerNode, lastBlockHash database.Hash, limit int) (GetNodeBlocksResponse, error)
+	Join(ctx context.Context, peer PeerNode, req p2p.JoinRequest, sig string) error
+	AnnounceBlock(peer PeerNode, req AnnounceBlockReq) error
+	AnnounceTX(peer PeerNode, req AnnounceTxReq) error
+}
+
+// Talk to the peers over the transport. Should be called before the node is running.
+func (n *Node) SetTransport(t Transport) {
+	n.transport = t
+}
+
+type transportPeerClient struct {
+	t    Transport
+	peer PeerNode
+}
+
+func (c transportPeerClient) getStatus(ctx context.Context) (GetPeerNodeStatusResponse, error) {
+	return c.t.Status(ctx, c.peer)
+}
+
+func (c transportPeerClient) getHeaders(ctx context.Context, lastBlockHash database.Hash, locator []database.Hash, limit int) (GetNodeHeadersResponse, error) {
+	return c.t.Headers(ctx, c.peer, lastBlockHash, locator, limit)
+}
+
+func (c transportPeerClient) getBlocks(ctx context.Context, lastBlockHash database.Hash, limit int) (GetNodeBlocksResponse, error) {
+	return c.t.Blocks(ctx, c.peer, lastBlockHash, limit)
+}
+
+func (c transportPeerClient) announceBlock(ctx context.Context, req AnnounceBlockReq) error {
+	return c.t.AnnounceBlock(c.peer, req)
+}
+
+func (c transportPeerClient) announceTX(ctx context.Context, req AnnounceTxReq) error {
+	return c.t.AnnounceTX(c.peer, req)
+}
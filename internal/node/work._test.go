@@ -0,0 +1,108 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"testing"
+	"time"
+)
+
+func TestNode_GetAndSubmitWork(t *testing.T) {
+	key := newTestKey(t)
+	s := setupMempoolTestState(t, key)
+	n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+	n.state, n.opened = s, true
+
+	if _, err := n.GetWork(database.NewAccount("pool")); !errors.Is(err, ErrNoWork) {
+		t.Fatalf("expected no work without pending transactions, got %v", err)
+	}
+	if err := n.AddPendingTX(signTestTx(t, key, 1, 10, 0)); err != nil {
+		t.Fatal(err)
+	}
+	work, err := n.GetWork(database.NewAccount("pool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := n.GetWork(database.NewAccount("pool")); again.WorkID != work.WorkID {
+		t.Fatal("expected the same work to be handed out until it's refreshed")
+	}
+
+	header, err := MineHeader(context.Background(), work.Header, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.SubmitWork(SubmitWorkReq{WorkID: work.WorkID, Nonce: header.Nonce + 1, ExtraNonce: header.ExtraNonce, Time: header.Time}); !errors.Is(err, ErrWorkInvalid) {
+		t.Fatalf("expected the wrong nonce to be rejected, got %v", err)
+	}
+	hash, err := n.SubmitWork(SubmitWorkReq{WorkID: work.WorkID, Nonce: header.Nonce, ExtraNonce: header.ExtraNonce, Time: header.Time})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *s.GetLastHash() != hash || s.GetLastBlock().Header.Miner != database.NewAccount("pool") {
+		t.Fatal("expected the mined block of the pool to be added")
+	}
+	if n.mempool.len() != 0 {
+		t.Fatal("expected the mined transaction to be removed from the mempool")
+	}
+	// the outstanding work is invalidated by the new block
+	if _, err := n.SubmitWork(SubmitWorkReq{WorkID: work.WorkID, Nonce: header.Nonce}); !errors.Is(err, ErrWorkUnknown) {
+		t.Fatalf("expected the work to be stale, got %v", err)
+	}
+}
+
+// A solution submitted, while another block is added on the same parent, is either the new tip or stale.
+func TestNode_SubmitWorkRacesNewTip(t *testing.T) {
+	key := newTestKey(t)
+	for i := 0; i < 5; i++ {
+		s := setupMempoolTestState(t, key)
+		n := NewNode(t.TempDir(), 8085, "localhost", nil, database.NewAccount("miner"), true)
+		n.state, n.opened = s, true
+		tx := signTestTx(t, key, 1, 10, 0)
+		if err := n.AddPendingTX(tx); err != nil {
+			t.Fatal(err)
+		}
+		work, err := n.GetWork(database.NewAccount("pool"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := MineHeader(context.Background(), work.Header, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending := newPendingBlockAt(work.Header.ParentHash, work.Header.Number, []database.SignedTx{tx}, database.NewAccount("rival"), time.Now())
+		rival, err := Mine(context.Background(), pending)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			wg                  sync.WaitGroup
+			submitErr, rivalErr error
+		)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, submitErr = n.SubmitWork(SubmitWorkReq{WorkID: work.WorkID, Nonce: header.Nonce, ExtraNonce: header.ExtraNonce, Time: header.Time})
+		}()
+		go func() {
+			defer wg.Done()
+			_, rivalErr = s.AddBlock(rival)
+		}()
+		wg.Wait()
+
+		if (submitErr == nil) == (rivalErr == nil) {
+			t.Fatalf("expected exactly one block to be added, got %v and %v", submitErr, rivalErr)
+		}
+		if submitErr != nil && !errors.Is(submitErr, ErrWorkUnknown) {
+			t.Fatalf("expected the solution to be stale, got %v", submitErr)
+		}
+		if rivalErr != nil && !errors.Is(rivalErr, database.ErrBlockParent) {
+			t.Fatalf("expected the rival block to be rejected by its parent, got %v", rivalErr)
+		}
+		if s.GetLastBlock().Header.Number != 1 {
+			t.Fatalf("expected a single block, got %d", s.GetLastBlock().Header.Number)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package node
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	// How long the same work is handed out to the miners of a coinbase, before it's rebuilt
+	// with the new pending transactions.
+	WORK_REFRESH = 10 * time.Second
+	// The limit of the outstanding work. The oldest one is dropped first.
+	MAX_OUTSTANDING_WORK = 32
+
+	ErrNoWork      = errors.New("there are no pending transactions to mine")
+	ErrWorkUnknown = errors.New("the work is unknown or stale")
+	ErrWorkInvalid = errors.New("the solution doesn't meet the target")
+)
+
+// The upper bound of the valid block hashes, see database.IsValidBlock.
+var workTarget = func() database.Hash {
+	var target database.Hash
+	for i := 2; i < len(target); i++ {
+		target[i] = 0xff
+	}
+	return target
+}()
+
+type WorkRes struct {
+	WorkID string               `json:"work_id"`
+	Header database.BlockHeader `json:"header"`
+	// the hash of the solved header should be below the target, and the third byte isn't zero,
+	// see database.IsValidBlock
+	Target database.Hash `json:"target"`
+}
+
+// The solution of the work. The miner may roll the extra nonce and the time of the header,
+// when the nonce space is exhausted.
+type SubmitWorkReq struct {
+	WorkID     string `json:"work_id"`
+	Nonce      uint32 `json:"nonce"`
+	ExtraNonce uint32 `json:"extra_nonce"`
+	// the time of the template is kept, if it's not set
+	Time uint64 `json:"time"`
+}
+
+type SubmitWorkRes struct {
+	Hash database.Hash `json:"hash"`
+}
+
+// work is the block template handed out to the external miners.
+type work struct {
+	id        string
+	block     database.Block
+	createdAt time.Time
+}
+
+func (w *work) res() WorkRes {
+	return WorkRes{WorkID: w.id, Header: w.block.Header, Target: workTarget}
+}
+
+// workSet keeps the outstanding work, until a new block arrives.
+type workSet struct {
+	mu sync.Mutex
+	// the oldest first
+	items []*work
+}
+
+func (s *workSet) put(w *work) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items = append(s.items, w)
+	if len(s.items) > MAX_OUTSTANDING_WORK {
+		s.items = s.items[len(s.items)-MAX_OUTSTANDING_WORK:]
+	}
+}
+
+func (s *workSet) get(id string) *work {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range s.items {
+		if w.id == id {
+			return w
+		}
+	}
+	return nil
+}
+
+// The latest work for the coinbase, if it's not older than WORK_REFRESH.
+func (s *workSet) latestFor(miner common.Address, now time.Time) *work {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.items) - 1; i >= 0; i-- {
+		if w := s.items[i]; w.block.Header.Miner == miner && now.Sub(w.createdAt) < WORK_REFRESH {
+			return w
+		}
+	}
+	return nil
+}
+
+// Drop the outstanding work, e.g. when a new block arrives.
+func (s *workSet) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items = nil
+}
+
+func newWorkID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Hand out the template of the next block with the pending transactions to an external miner.
+// The node's miner is the coinbase, if it's not set.
+func (n *Node) GetWork(miner common.Address) (WorkRes, error) {
+	if miner == (common.Address{}) {
+		miner = n.Coinbase()
+	}
+	now := n.clock.Now()
+	if w := n.work.latestFor(miner, now); w != nil {
+		return w.res(), nil
+	}
+	template := n.buildBlockTemplate(now)
+	txs := template.TXs()
+	if len(txs) == 0 {
+		return WorkRes{}, ErrNoWork
+	}
+	block := database.NewBlock(template.ParentHash(), template.Number(), 0, txs, miner)
+	block.Header.Time = uint64(now.Unix())
+	w := &work{id: newWorkID(), block: block, createdAt: now}
+	n.work.put(w)
+	logger.Printf(".GetWork() handed out work %s for the block %d with %d txs\n", w.id, block.Header.Number, len(txs))
+	return w.res(), nil
+}
+
+// Validate the solution of the work and add the block, then announce it to the peers.
+func (n *Node) SubmitWork(req SubmitWorkReq) (database.Hash, error) {
+	w := n.work.get(req.WorkID)
+	if w == nil {
+		return database.Hash{}, ErrWorkUnknown
+	}
+	block := w.block
+	block.Header.Nonce, block.Header.ExtraNonce = req.Nonce, req.ExtraNonce
+	if req.Time != 0 {
+		block.Header.Time = req.Time
+	}
+	hash, err := block.Hash()
+	if err != nil {
+		return database.Hash{}, err
+	}
+	if !database.IsValidBlock(hash) {
+		return database.Hash{}, ErrWorkInvalid
+	}
+	// the state checks the parent under the same lock the block is added with, so a block added
+	// by the sync or the local miner meanwhile makes the solution stale
+	if _, err := n.state.AddBlock(block); errors.Is(err, database.ErrBlockParent) {
+		return database.Hash{}, fmt.Errorf("%w: %v", ErrWorkUnknown, err)
+	} else if err != nil {
+		return database.Hash{}, err
+	}
+	logger.Printf(".SubmitWork() added the block %d %s of work %s\n", block.Header.Number, hash, w.id)
+	n.notifyNewBlock(block)
+	n.announceBlock(block, "")
+	return hash, nil
+}
+
+// WorkClient requests the work from a node and submits the solutions, for an external miner.
+type WorkClient struct {
+	node PeerNode
+}
+
+func NewWorkClient(ip string, port uint) *WorkClient {
+	return &WorkClient{node: PeerNode{IP: ip, Port: port}}
+}
+
+func (c *WorkClient) GetWork(ctx context.Context, miner common.Address) (WorkRes, error) {
+	query := url.Values{}
+	if miner != (common.Address{}) {
+		query.Set("miner", miner.Hex())
+	}
+	var res WorkRes
+	result, err := getReq(ctx, &c.node, "mining/work?"+query.Encode(), &res)
+	if err != nil {
+		return WorkRes{}, err
+	}
+	w, ok := result.(*WorkRes)
+	if !ok {
+		return WorkRes{}, fmt.Errorf("%s. could not convert a response to type WorkRes", logger.Prefix())
+	}
+	return *w, nil
+}
+
+func (c *WorkClient) SubmitWork(ctx context.Context, req SubmitWorkReq) (SubmitWorkRes, error) {
+	var res SubmitWorkRes
+	if err := postReq(ctx, &c.node, "mining/submit", req, &res); err != nil {
+		return SubmitWorkRes{}, err
+	}
+	return res, nil
+}
@@ -0,0 +1,56 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"testing"
+)
+
+func TestConn_ReadWriteMsg(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	a, b := NewConn(c1), NewConn(c2)
+
+	sent, err := NewMsg(MsgGetBlocks, 42, &GetBlocksMsg{FromBlock: database.Hash{1, 2, 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.WriteMsg(sent)
+
+	received, err := b.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Type != MsgGetBlocks || received.ID != 42 {
+		t.Fatalf("expected get-blocks message with id 42, got %s with id %d", received.Type, received.ID)
+	}
+	var req GetBlocksMsg
+	if err := received.Decode(&req); err != nil {
+		t.Fatal(err)
+	}
+	if req.FromBlock != (database.Hash{1, 2, 3}) {
+		t.Fatalf("unexpected hash %s", req.FromBlock)
+	}
+}
+
+func TestConn_ReadMsgOverLimit(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	b := NewConn(c2)
+
+	// a ping frame, which claims a payload over the ping limit
+	go func() {
+		header := make([]byte, frameHeaderSize)
+		binary.BigEndian.PutUint32(header[0:4], frameMetaSize+MsgPing.maxSize()+1)
+		header[4] = byte(MsgPing)
+		c1.Write(header)
+	}()
+
+	if _, err := b.ReadMsg(); !errors.Is(err, ErrProtocolViolation) {
+		t.Fatalf("expected a protocol violation, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package p2p
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The frame header: 4 bytes of the frame length, 1 byte of the message type and 8 bytes of the message id.
+// The frame length includes the type, the id and the payload.
+const (
+	frameHeaderSize = 4 + 1 + 8
+	frameMetaSize   = 1 + 8
+)
+
+var WRITE_TIMEOUT = 10 * time.Second
+
+// Conn is a connection, which reads and writes length framed messages.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// serializes the writes of the frames
+	wmu sync.Mutex
+}
+
+func NewConn(c net.Conn) *Conn {
+	return &Conn{conn: c, r: bufio.NewReader(c)}
+}
+
+func (c *Conn) WriteMsg(m Msg) error {
+	if uint32(len(m.Payload)) > m.Type.maxSize() {
+		return fmt.Errorf("the %s message of %d bytes exceeds the limit of %d bytes", m.Type, len(m.Payload), m.Type.maxSize())
+	}
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(m.Payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(frameMetaSize+len(m.Payload)))
+	frame[4] = byte(m.Type)
+	binary.BigEndian.PutUint64(frame[5:13], m.ID)
+	frame = append(frame, m.Payload...)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT)); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Read the next message. The payload size is checked against the message type limit
+// before the payload is read.
+func (c *Conn) ReadMsg() (Msg, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return Msg{}, err
+	}
+	var (
+		length = binary.BigEndian.Uint32(header[0:4])
+		t      = MsgType(header[4])
+		id     = binary.BigEndian.Uint64(header[5:13])
+	)
+	if length < frameMetaSize {
+		return Msg{}, fmt.Errorf("%w: the frame length %d is too small", ErrProtocolViolation, length)
+	}
+	size := length - frameMetaSize
+	if t.maxSize() == 0 {
+		return Msg{}, fmt.Errorf("%w: unknown message type %d", ErrProtocolViolation, uint8(t))
+	}
+	if size > t.maxSize() {
+		return Msg{}, fmt.Errorf("%w: the %s message of %d bytes exceeds the limit of %d bytes", ErrProtocolViolation, t, size, t.maxSize())
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return Msg{}, err
+	}
+	return Msg{t, id, payload}, nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
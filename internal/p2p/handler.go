@@ -0,0 +1,62 @@
+package p2p
+
+import "fmt"
+
+// Handler serves the requests and the announcements of the connected peers.
+type Handler interface {
+	HandleGetStatus(p *Peer) (StatusMsg, error)
+	HandleGetBlocks(p *Peer, req GetBlocksMsg) (BlocksMsg, error)
+	HandleGetHeaders(p *Peer, req GetHeadersMsg) (HeadersMsg, error)
+	HandleGetPeers(p *Peer) (PeersMsg, error)
+	HandleTx(p *Peer, msg TxMsg) error
+	HandleNewBlock(p *Peer, msg NewBlockMsg) error
+	PeerConnected(p *Peer)
+	PeerDisconnected(p *Peer, err error)
+}
+
+// Decode the message and call the handler. Returns the response type and body for
+// the requests, or a zero type for the announcements.
+func dispatch(h Handler, p *Peer, msg Msg) (MsgType, any, error) {
+	switch msg.Type {
+	case MsgGetStatus:
+		status, err := h.HandleGetStatus(p)
+		return MsgStatus, &status, err
+	case MsgGetBlocks:
+		var req GetBlocksMsg
+		if err := msg.Decode(&req); err != nil {
+			return 0, nil, fmt.Errorf("%w: %v", ErrProtocolViolation, err)
+		}
+		blocks, err := h.HandleGetBlocks(p, req)
+		return MsgBlocks, &blocks, err
+	case MsgGetHeaders:
+		var req GetHeadersMsg
+		if err := msg.Decode(&req); err != nil {
+			return 0, nil, fmt.Errorf("%w: %v", ErrProtocolViolation, err)
+		}
+		headers, err := h.HandleGetHeaders(p, req)
+		return MsgHeaders, &headers, err
+	case MsgGetPeers:
+		peers, err := h.HandleGetPeers(p)
+		return MsgPeers, &peers, err
+	case MsgTx:
+		var tx TxMsg
+		if err := msg.Decode(&tx); err != nil {
+			return 0, nil, fmt.Errorf("%w: %v", ErrProtocolViolation, err)
+		}
+		if err := h.HandleTx(p, tx); err != nil {
+			logger.Printf(".dispatch() tx from %s rejected: %v\n", p.Addr(), err)
+		}
+		return 0, nil, nil
+	case MsgNewBlock:
+		var block NewBlockMsg
+		if err := msg.Decode(&block); err != nil {
+			return 0, nil, fmt.Errorf("%w: %v", ErrProtocolViolation, err)
+		}
+		if err := h.HandleNewBlock(p, block); err != nil {
+			logger.Printf(".dispatch() block from %s rejected: %v\n", p.Addr(), err)
+		}
+		return 0, nil, nil
+	default:
+		return 0, nil, fmt.Errorf("%w: unexpected %s message", ErrProtocolViolation, msg.Type)
+	}
+}
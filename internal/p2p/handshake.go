@@ -0,0 +1,126 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const handshakeNonceSize = 32
+
+var (
+	HANDSHAKE_TIMEOUT = 5 * time.Second
+
+	ErrProtocolViolation = errors.New("protocol violation")
+	ErrIncompatiblePeer  = errors.New("incompatible peer")
+)
+
+// Exchange the handshakes, validate that the remote node runs the same protocol and chain,
+// and authenticate it: each side signs the challenge of the other side together with its own
+// handshake, so the remote node ID can't be claimed without the node key.
+func doHandshake(c *Conn, local Handshake, key *ecdsa.PrivateKey) (Handshake, error) {
+	if err := c.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT)); err != nil {
+		return Handshake{}, err
+	}
+	defer c.SetReadDeadline(time.Time{})
+
+	local.NodeID = NodeID(&key.PublicKey)
+	local.Nonce = make([]byte, handshakeNonceSize)
+	if _, err := rand.Read(local.Nonce); err != nil {
+		return Handshake{}, err
+	}
+	msg, err := NewMsg(MsgHandshake, 0, &local)
+	if err != nil {
+		return Handshake{}, err
+	}
+	reply, err := exchange(c, msg)
+	if err != nil {
+		return Handshake{}, err
+	}
+	var remote Handshake
+	if err := reply.Decode(&remote); err != nil {
+		return Handshake{}, fmt.Errorf("%w: %v", ErrProtocolViolation, err)
+	}
+	if err := validateHandshake(local, remote); err != nil {
+		return Handshake{}, err
+	}
+
+	sig, err := signDigest(key, handshakeDigest(remote.Nonce, msg.Payload))
+	if err != nil {
+		return Handshake{}, err
+	}
+	authMsg, err := NewMsg(MsgHandshakeAuth, 0, &HandshakeAuth{sig})
+	if err != nil {
+		return Handshake{}, err
+	}
+	authReply, err := exchange(c, authMsg)
+	if err != nil {
+		return Handshake{}, err
+	}
+	var auth HandshakeAuth
+	if err := authReply.Decode(&auth); err != nil {
+		return Handshake{}, fmt.Errorf("%w: %v", ErrProtocolViolation, err)
+	}
+	if err := verifyDigest(remote.NodeID, handshakeDigest(local.Nonce, reply.Payload), auth.Signature); err != nil {
+		return Handshake{}, fmt.Errorf("%w: %v", ErrIncompatiblePeer, err)
+	}
+	return remote, nil
+}
+
+// Write the message and read the message of the same type from the remote node.
+// Both sides write first, so it works over unbuffered connections as well.
+func exchange(c *Conn, msg Msg) (Msg, error) {
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- c.WriteMsg(msg)
+	}()
+
+	reply, err := c.ReadMsg()
+	if err != nil {
+		return Msg{}, fmt.Errorf("could not read the %s: %w", msg.Type, err)
+	}
+	if err := <-writeErr; err != nil {
+		return Msg{}, fmt.Errorf("could not write the %s: %w", msg.Type, err)
+	}
+	if reply.Type != msg.Type {
+		return Msg{}, fmt.Errorf("%w: expected a %s, got %s", ErrProtocolViolation, msg.Type, reply.Type)
+	}
+	return reply, nil
+}
+
+// The digest signed by the node: the challenge of the remote node and the node's own handshake.
+func handshakeDigest(challenge, handshake []byte) [32]byte {
+	h := sha256.New()
+	h.Write([]byte("handshake|"))
+	h.Write(challenge)
+	hs := sha256.Sum256(handshake)
+	h.Write(hs[:])
+	var digest [32]byte
+	copy(digest[:], h.Sum(nil))
+	return digest
+}
+
+func validateHandshake(local, remote Handshake) error {
+	if remote.Version != local.Version {
+		return fmt.Errorf("%w: protocol version %d, expected %d", ErrIncompatiblePeer, remote.Version, local.Version)
+	}
+	if remote.ChainID != local.ChainID {
+		return fmt.Errorf("%w: chain id '%s', expected '%s'", ErrIncompatiblePeer, remote.ChainID, local.ChainID)
+	}
+	if remote.GenesisHash != local.GenesisHash {
+		return fmt.Errorf("%w: genesis hash %s, expected %s", ErrIncompatiblePeer, remote.GenesisHash, local.GenesisHash)
+	}
+	if remote.P2PPort == 0 {
+		return fmt.Errorf("%w: the p2p port is not defined", ErrProtocolViolation)
+	}
+	if remote.NodeID == "" {
+		return fmt.Errorf("%w: the node id is not defined", ErrProtocolViolation)
+	}
+	if len(remote.Nonce) != handshakeNonceSize {
+		return fmt.Errorf("%w: the handshake nonce must be %d bytes", ErrProtocolViolation, handshakeNonceSize)
+	}
+	return nil
+}
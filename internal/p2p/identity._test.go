@@ -0,0 +1,78 @@
+package p2p
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLoadOrCreateNodeKey(t *testing.T) {
+	dir := t.TempDir()
+	key, err := LoadOrCreateNodeKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadOrCreateNodeKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NodeID(&key.PublicKey) != NodeID(&loaded.PublicKey) {
+		t.Fatal("expected the persisted node key to be loaded")
+	}
+}
+
+func TestJoinRequest_Verify(t *testing.T) {
+	key, err := LoadOrCreateNodeKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	req := JoinRequest{NodeID: NodeID(&key.PublicKey), IP: "127.0.0.1", Port: 8081, P2PPort: 9081, Time: now.Unix()}
+	sig, err := req.Sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Verify(sig, now); err != nil {
+		t.Fatalf("expected a valid join request, got %v", err)
+	}
+
+	tampered := req
+	tampered.Port = 9999
+	if err := tampered.Verify(sig, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected an invalid signature for the tampered request, got %v", err)
+	}
+
+	other, _ := LoadOrCreateNodeKey(t.TempDir())
+	impersonated := req
+	impersonated.NodeID = NodeID(&other.PublicKey)
+	if err := impersonated.Verify(sig, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected an invalid signature for another node id, got %v", err)
+	}
+
+	if err := req.Verify(sig, now.Add(MAX_JOIN_CLOCK_DRIFT+time.Minute)); err == nil {
+		t.Fatal("expected a stale join request to be rejected")
+	}
+}
+
+func TestJoinRequest_VerifyAddress(t *testing.T) {
+	cases := []struct {
+		ip, remoteAddr string
+		ok             bool
+	}{
+		{"10.0.0.5", "10.0.0.5:52000", true},
+		{"localhost", "127.0.0.1:52000", true},
+		{"127.0.0.1", "[::1]:52000", true},
+		{"10.0.0.66", "10.0.0.5:52000", false},
+		{"localhost", "10.0.0.5:52000", false},
+		{"10.0.0.5", "not an address", false},
+	}
+	for _, c := range cases {
+		err := JoinRequest{IP: c.ip}.VerifyAddress(c.remoteAddr)
+		if c.ok && err != nil {
+			t.Fatalf("expected %s to be accepted from %s, got %v", c.ip, c.remoteAddr, err)
+		}
+		if !c.ok && !errors.Is(err, ErrJoinAddress) {
+			t.Fatalf("expected %s to be rejected from %s, got %v", c.ip, c.remoteAddr, err)
+		}
+	}
+}
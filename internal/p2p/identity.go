@@ -0,0 +1,132 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const nodeKeyFile = "nodekey"
+
+// How far the time of a signed join request may differ from the local clock.
+var MAX_JOIN_CLOCK_DRIFT = 5 * time.Minute
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	// the declared address of the join request isn't the one it's sent from
+	ErrJoinAddress = errors.New("the join request address doesn't match the sender")
+)
+
+func GetNodeKeyFile(dataDir string) string {
+	return filepath.Join(dataDir, nodeKeyFile)
+}
+
+// Load the node's secp256k1 key from the data directory, or create and persist a new one.
+func LoadOrCreateNodeKey(dataDir string) (*ecdsa.PrivateKey, error) {
+	path := GetNodeKeyFile(dataDir)
+	key, err := crypto.LoadECDSA(path)
+	if err == nil {
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not load the node key %s: %w", path, err)
+	}
+	key, err = crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+	if err := crypto.SaveECDSA(path, key); err != nil {
+		return nil, err
+	}
+	logger.Printf(".LoadOrCreateNodeKey() created a new node key %s\n", path)
+	return key, nil
+}
+
+// The node ID is the hex encoded compressed public key of the node key.
+func NodeID(pub *ecdsa.PublicKey) string {
+	return hex.EncodeToString(crypto.CompressPubkey(pub))
+}
+
+// Sign the digest and return the signature, which can be verified by the node ID.
+func signDigest(key *ecdsa.PrivateKey, digest [32]byte) ([]byte, error) {
+	return crypto.Sign(digest[:], key)
+}
+
+// Verify that the signature of the digest is made by the node with the given ID.
+func verifyDigest(nodeID string, digest [32]byte, sig []byte) error {
+	pub, err := crypto.SigToPub(digest[:], sig)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	if NodeID(pub) != nodeID {
+		return fmt.Errorf("%w: signed by %s, expected %s", ErrInvalidSignature, NodeID(pub), nodeID)
+	}
+	return nil
+}
+
+// JoinRequest is sent by a node over the HTTP API, in order to be added to the peer's known peers.
+type JoinRequest struct {
+	NodeID  string
+	IP      string
+	Port    uint
+	P2PPort uint
+	// unix time of the request, limits the replay of the request
+	Time int64
+}
+
+func (j JoinRequest) digest() [32]byte {
+	return sha256.Sum256([]byte(fmt.Sprintf("join|%s|%s|%d|%d|%d", j.NodeID, j.IP, j.Port, j.P2PPort, j.Time)))
+}
+
+// Sign the join request with the node key. The signature is hex encoded.
+func (j JoinRequest) Sign(key *ecdsa.PrivateKey) (string, error) {
+	sig, err := signDigest(key, j.digest())
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sig), nil
+}
+
+// Verify the hex encoded signature of the join request and its time against the local time.
+func (j JoinRequest) Verify(sig string, now time.Time) error {
+	rawSig, err := hex.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	drift := now.Sub(time.Unix(j.Time, 0))
+	if drift > MAX_JOIN_CLOCK_DRIFT || drift < -MAX_JOIN_CLOCK_DRIFT {
+		return fmt.Errorf("the join request time %d is too far from the local time", j.Time)
+	}
+	return verifyDigest(j.NodeID, j.digest(), rawSig)
+}
+
+// Verify that the declared IP of the join request is the host the request is sent from, the signature
+// proves the ownership of the node key only. A node on the loopback may declare itself as localhost.
+func (j JoinRequest) VerifyAddress(remoteAddr string) error {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	remote := net.ParseIP(host)
+	if remote == nil {
+		return fmt.Errorf("%w: unknown sender address %s", ErrJoinAddress, remoteAddr)
+	}
+	if declared := net.ParseIP(j.IP); declared != nil && declared.Equal(remote) {
+		return nil
+	}
+	if remote.IsLoopback() && (j.IP == "localhost" || net.ParseIP(j.IP).IsLoopback()) {
+		return nil
+	}
+	return fmt.Errorf("%w: declared %s, sent from %s", ErrJoinAddress, j.IP, host)
+}
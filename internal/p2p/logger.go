@@ -0,0 +1,8 @@
+package p2p
+
+import (
+	"log"
+	"os"
+)
+
+var logger = log.New(os.Stdout, "p2p", log.LstdFlags)
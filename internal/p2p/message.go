@@ -0,0 +1,205 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"taraskrasiuk/blockchain_l/internal/database"
+)
+
+// The version of the node-to-node protocol. Peers with another version are rejected on handshake.
+const ProtocolVersion uint32 = 2
+
+type MsgType uint8
+
+const (
+	MsgHandshake MsgType = iota + 1
+	MsgPing
+	MsgPong
+	MsgGetStatus
+	MsgStatus
+	MsgGetBlocks
+	MsgBlocks
+	MsgGetPeers
+	MsgPeers
+	MsgTx
+	MsgNewBlock
+	MsgError
+	MsgHandshakeAuth
+	MsgGetHeaders
+	MsgHeaders
+)
+
+func (t MsgType) String() string {
+	switch t {
+	case MsgHandshake:
+		return "handshake"
+	case MsgPing:
+		return "ping"
+	case MsgPong:
+		return "pong"
+	case MsgGetStatus:
+		return "get-status"
+	case MsgStatus:
+		return "status"
+	case MsgGetBlocks:
+		return "get-blocks"
+	case MsgBlocks:
+		return "blocks"
+	case MsgGetPeers:
+		return "get-peers"
+	case MsgPeers:
+		return "peers"
+	case MsgTx:
+		return "tx"
+	case MsgNewBlock:
+		return "new-block"
+	case MsgError:
+		return "error"
+	case MsgHandshakeAuth:
+		return "handshake-auth"
+	case MsgGetHeaders:
+		return "get-headers"
+	case MsgHeaders:
+		return "headers"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+// Responses are routed to the pending request with the same id.
+func (t MsgType) isResponse() bool {
+	switch t {
+	case MsgPong, MsgStatus, MsgBlocks, MsgHeaders, MsgPeers, MsgError:
+		return true
+	}
+	return false
+}
+
+// The maximum payload size of the message type. A peer sending a larger message is disconnected.
+func (t MsgType) maxSize() uint32 {
+	switch t {
+	case MsgHandshake, MsgHandshakeAuth, MsgPing, MsgPong, MsgGetStatus, MsgGetBlocks, MsgGetPeers, MsgError:
+		return 4 << 10
+	case MsgGetHeaders:
+		// the block locator grows with the log of the chain length
+		return 16 << 10
+	case MsgTx:
+		return 64 << 10
+	case MsgNewBlock:
+		return 2 * database.MaxBlockSize
+	case MsgPeers:
+		return 1 << 20
+	case MsgHeaders:
+		return 4 << 20
+	case MsgStatus:
+		return 8 << 20
+	case MsgBlocks:
+		return 32 << 20
+	default:
+		return 0
+	}
+}
+
+// Msg is a single frame of the protocol. The payload is a JSON encoded message body.
+type Msg struct {
+	Type    MsgType
+	ID      uint64
+	Payload []byte
+}
+
+func NewMsg(t MsgType, id uint64, body any) (Msg, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return Msg{}, err
+	}
+	if uint32(len(payload)) > t.maxSize() {
+		return Msg{}, fmt.Errorf("the %s message of %d bytes exceeds the limit of %d bytes", t, len(payload), t.maxSize())
+	}
+	return Msg{t, id, payload}, nil
+}
+
+func (m Msg) Decode(body any) error {
+	if err := json.Unmarshal(m.Payload, body); err != nil {
+		return fmt.Errorf("could not decode the %s message: %w", m.Type, err)
+	}
+	return nil
+}
+
+// ==== message bodies
+
+type Handshake struct {
+	Version     uint32        `json:"version"`
+	ChainID     string        `json:"chain_id"`
+	GenesisHash database.Hash `json:"genesis_hash"`
+	NodeID      string        `json:"node_id"`
+	// a random challenge, which the remote node signs with its node key
+	Nonce []byte `json:"nonce"`
+	// the addresses the node is reachable at
+	IP      string `json:"ip"`
+	Port    uint   `json:"port"`
+	P2PPort uint   `json:"p2p_port"`
+}
+
+// The p2p address of the node.
+func (h Handshake) Addr() string {
+	return fmt.Sprintf("%s:%d", h.IP, h.P2PPort)
+}
+
+// HandshakeAuth proves the ownership of the node key, it's the signature of the remote
+// node's challenge and the local handshake.
+type HandshakeAuth struct {
+	Signature []byte `json:"signature"`
+}
+
+type PeerInfo struct {
+	NodeID      string `json:"node_id"`
+	IP          string `json:"ip"`
+	Port        uint   `json:"port"`
+	P2PPort     uint   `json:"p2p_port"`
+	IsBootstrap bool   `json:"is_bootstrap"`
+}
+
+type StatusMsg struct {
+	BlockHash   database.Hash       `json:"block_hash"`
+	BlockNumber uint64              `json:"block_number"`
+	KnownPeers  []PeerInfo          `json:"known_peers"`
+	PendingTXs  []database.SignedTx `json:"pending_txs"`
+}
+
+type GetBlocksMsg struct {
+	FromBlock database.Hash `json:"from_block"`
+	// the maximum number of blocks, the responder may return less
+	Limit int `json:"limit"`
+}
+
+// GetHeadersMsg requests the headers after FromBlock. If the locator is set, the headers follow
+// the latest block of the locator the responder knows, which may be the zero hash.
+type GetHeadersMsg struct {
+	FromBlock database.Hash   `json:"from_block"`
+	Locator   []database.Hash `json:"locator,omitempty"`
+	Limit     int             `json:"limit"`
+}
+
+type HeadersMsg struct {
+	Headers []database.BlockHeader `json:"headers"`
+}
+
+type BlocksMsg struct {
+	Blocks []database.Block `json:"blocks"`
+}
+
+type PeersMsg struct {
+	Peers []PeerInfo `json:"peers"`
+}
+
+type TxMsg struct {
+	Tx database.SignedTx `json:"tx"`
+}
+
+type NewBlockMsg struct {
+	Block database.Block `json:"block"`
+}
+
+type ErrorMsg struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,112 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// blockingHandler holds the status requests until it's released.
+type blockingHandler struct {
+	*testHandler
+	release chan struct{}
+}
+
+func (h *blockingHandler) HandleGetStatus(p *Peer) (StatusMsg, error) {
+	<-h.release
+	return h.status, nil
+}
+
+// Run a peer over a pipe, the returned connection is the remote side.
+func startPipePeer(t *testing.T, h Handler) (*Peer, *Conn) {
+	c1, c2 := net.Pipe()
+	p := newPeer(NewConn(c1), Handshake{}, true)
+	go p.run(h)
+	t.Cleanup(func() {
+		p.Close()
+		c2.Close()
+	})
+	return p, NewConn(c2)
+}
+
+// Ping the peer through the remote connection, the pong proves the read loop isn't stalled.
+func requirePong(t *testing.T, remote *Conn, id uint64) {
+	t.Helper()
+	ping, _ := NewMsg(MsgPing, id, struct{}{})
+	if err := remote.WriteMsg(ping); err != nil {
+		t.Fatal(err)
+	}
+	remote.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		msg, err := remote.ReadMsg()
+		if err != nil {
+			t.Fatalf("expected a pong, got %v", err)
+		}
+		if msg.Type == MsgPong && msg.ID == id {
+			return
+		}
+	}
+}
+
+func TestPeer_DuplicateResponsesDontStall(t *testing.T) {
+	p, remote := startPipePeer(t, newTestHandler(0))
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		var status StatusMsg
+		done <- p.Request(ctx, MsgGetStatus, struct{}{}, MsgStatus, &status)
+	}()
+	remote.SetReadDeadline(time.Now().Add(2 * time.Second))
+	req, err := remote.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same response is sent over and over, only the first one reaches the waiter
+	for i := 0; i < 3; i++ {
+		resp, _ := NewMsg(MsgStatus, req.ID, &StatusMsg{BlockNumber: 3})
+		if err := remote.WriteMsg(resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	requirePong(t, remote, 1000)
+}
+
+func TestPeer_HandlersLimit(t *testing.T) {
+	defer func(limit int) { MAX_PEER_HANDLERS = limit }(MAX_PEER_HANDLERS)
+	MAX_PEER_HANDLERS = 1
+
+	h := &blockingHandler{testHandler: newTestHandler(5), release: make(chan struct{})}
+	_, remote := startPipePeer(t, h)
+
+	for id := uint64(1); id <= 2; id++ {
+		req, _ := NewMsg(MsgGetStatus, id, struct{}{})
+		if err := remote.WriteMsg(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the request above the limit is rejected right away, while the first one is being handled
+	remote.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err := remote.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != MsgError || msg.ID != 2 {
+		t.Fatalf("expected the second request to be rejected, got %s for %d", msg.Type, msg.ID)
+	}
+	requirePong(t, remote, 1000)
+
+	close(h.release)
+	msg, err = remote.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != MsgStatus || msg.ID != 1 {
+		t.Fatalf("expected the status response to the first request, got %s for %d", msg.Type, msg.ID)
+	}
+}
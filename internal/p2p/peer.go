@@ -0,0 +1,254 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// How often an idle connection is pinged.
+	PING_INTERVAL = 15 * time.Second
+	// A connection without any message during this time is closed.
+	READ_TIMEOUT = 3 * PING_INTERVAL
+	// The maximum number of the requests and announcements of a peer handled at the same time.
+	// The messages above the limit are rejected.
+	MAX_PEER_HANDLERS = 32
+
+	ErrPeerClosed = errors.New("peer connection closed")
+)
+
+// Peer is an established connection to a remote node.
+type Peer struct {
+	conn    *Conn
+	info    Handshake
+	inbound bool
+
+	nextID   atomic.Uint64
+	mu       sync.Mutex
+	pending  map[uint64]chan Msg
+	handlers chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newPeer(conn *Conn, info Handshake, inbound bool) *Peer {
+	return &Peer{
+		conn:     conn,
+		info:     info,
+		inbound:  inbound,
+		pending:  make(map[uint64]chan Msg),
+		handlers: make(chan struct{}, MAX_PEER_HANDLERS),
+		closed:   make(chan struct{}),
+	}
+}
+
+// The handshake received from the remote node.
+func (p *Peer) Info() Handshake {
+	return p.info
+}
+
+// The authenticated node ID of the remote node, which is used as the peer's key.
+func (p *Peer) ID() string {
+	return p.info.NodeID
+}
+
+// The p2p address of the remote node.
+func (p *Peer) Addr() string {
+	return p.info.Addr()
+}
+
+func (p *Peer) Inbound() bool {
+	return p.inbound
+}
+
+// Send a request and wait for the response of the expected type.
+func (p *Peer) Request(ctx context.Context, t MsgType, req any, respType MsgType, resp any) error {
+	id := p.nextID.Add(1)
+	msg, err := NewMsg(t, id, req)
+	if err != nil {
+		return err
+	}
+	ch := make(chan Msg, 1)
+	p.mu.Lock()
+	p.pending[id] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+	}()
+
+	if err := p.conn.WriteMsg(msg); err != nil {
+		p.close(err)
+		return err
+	}
+
+	select {
+	case reply := <-ch:
+		if reply.Type == MsgError {
+			var e ErrorMsg
+			if err := reply.Decode(&e); err != nil {
+				return err
+			}
+			return fmt.Errorf("peer %s: %s", p.Addr(), e.Error)
+		}
+		if reply.Type != respType {
+			err := fmt.Errorf("%w: expected %s response to %s, got %s", ErrProtocolViolation, respType, t, reply.Type)
+			p.close(err)
+			return err
+		}
+		return reply.Decode(resp)
+	case <-p.closed:
+		return ErrPeerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Send a message, which doesn't expect any response, e.g. an announcement.
+func (p *Peer) Send(t MsgType, body any) error {
+	msg, err := NewMsg(t, p.nextID.Add(1), body)
+	if err != nil {
+		return err
+	}
+	if err := p.conn.WriteMsg(msg); err != nil {
+		p.close(err)
+		return err
+	}
+	return nil
+}
+
+func (p *Peer) Close() {
+	p.close(ErrPeerClosed)
+}
+
+func (p *Peer) close(err error) {
+	p.closeOnce.Do(func() {
+		p.closeErr = err
+		close(p.closed)
+		p.conn.Close()
+	})
+}
+
+// The reason the connection was closed.
+func (p *Peer) Err() error {
+	select {
+	case <-p.closed:
+		return p.closeErr
+	default:
+		return nil
+	}
+}
+
+// Read the messages until the connection is closed. Requests and announcements are
+// handled concurrently, so a slow handler doesn't block the keepalive. A response is passed
+// to its waiter once, without blocking, the waiter may be gone already.
+func (p *Peer) run(h Handler) error {
+	go p.keepalive()
+	for {
+		if err := p.conn.SetReadDeadline(time.Now().Add(READ_TIMEOUT)); err != nil {
+			p.close(err)
+			return err
+		}
+		msg, err := p.conn.ReadMsg()
+		if err != nil {
+			p.close(err)
+			return p.Err()
+		}
+		switch {
+		case msg.Type == MsgPing:
+			pong, _ := NewMsg(MsgPong, msg.ID, struct{}{})
+			if err := p.conn.WriteMsg(pong); err != nil {
+				p.close(err)
+				return p.Err()
+			}
+		case msg.Type.isResponse():
+			p.mu.Lock()
+			ch, ok := p.pending[msg.ID]
+			delete(p.pending, msg.ID)
+			p.mu.Unlock()
+			if ok {
+				select {
+				case ch <- msg:
+				default:
+				}
+			}
+		case msg.Type == MsgHandshake || msg.Type == MsgHandshakeAuth:
+			err := fmt.Errorf("%w: unexpected %s", ErrProtocolViolation, msg.Type)
+			p.close(err)
+			return err
+		default:
+			select {
+			case p.handlers <- struct{}{}:
+				go func() {
+					defer func() { <-p.handlers }()
+					p.handle(h, msg)
+				}()
+			default:
+				p.reject(msg)
+			}
+		}
+	}
+}
+
+// Reject the message above the limit of the concurrent handlers. The request gets an error response,
+// the announcement is dropped.
+func (p *Peer) reject(msg Msg) {
+	if msg.Type == MsgTx || msg.Type == MsgNewBlock {
+		logger.Printf(".reject() peer %s is busy, dropping %s\n", p.Addr(), msg.Type)
+		return
+	}
+	reply, _ := NewMsg(MsgError, msg.ID, &ErrorMsg{"too many concurrent requests"})
+	if err := p.conn.WriteMsg(reply); err != nil {
+		p.close(err)
+	}
+}
+
+func (p *Peer) handle(h Handler, msg Msg) {
+	respType, resp, err := dispatch(h, p, msg)
+	if errors.Is(err, ErrProtocolViolation) {
+		logger.Printf(".handle() closing peer %s: %v\n", p.Addr(), err)
+		p.close(err)
+		return
+	}
+	if respType == 0 && err == nil {
+		// an announcement
+		return
+	}
+	if err != nil {
+		respType, resp = MsgError, &ErrorMsg{err.Error()}
+	}
+	reply, err := NewMsg(respType, msg.ID, resp)
+	if err != nil {
+		reply, _ = NewMsg(MsgError, msg.ID, &ErrorMsg{err.Error()})
+	}
+	if err := p.conn.WriteMsg(reply); err != nil {
+		p.close(err)
+	}
+}
+
+func (p *Peer) keepalive() {
+	t := time.NewTicker(PING_INTERVAL)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			ctx, cancel := context.WithTimeout(context.Background(), READ_TIMEOUT)
+			err := p.Request(ctx, MsgPing, struct{}{}, MsgPong, &struct{}{})
+			cancel()
+			if err != nil && !errors.Is(err, ErrPeerClosed) {
+				logger.Printf(".keepalive() peer %s didn't respond to ping: %v\n", p.Addr(), err)
+				p.close(err)
+				return
+			}
+		case <-p.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+type testHandler struct {
+	mu        sync.Mutex
+	status    StatusMsg
+	connected []string
+	txCh      chan TxMsg
+}
+
+func newTestHandler(blockNumber uint64) *testHandler {
+	return &testHandler{status: StatusMsg{BlockNumber: blockNumber}, txCh: make(chan TxMsg, 1)}
+}
+
+func (h *testHandler) HandleGetStatus(p *Peer) (StatusMsg, error) {
+	return h.status, nil
+}
+
+func (h *testHandler) HandleGetBlocks(p *Peer, req GetBlocksMsg) (BlocksMsg, error) {
+	return BlocksMsg{}, errors.New("no blocks")
+}
+
+func (h *testHandler) HandleGetHeaders(p *Peer, req GetHeadersMsg) (HeadersMsg, error) {
+	return HeadersMsg{}, nil
+}
+
+func (h *testHandler) HandleGetPeers(p *Peer) (PeersMsg, error) {
+	return PeersMsg{}, nil
+}
+
+func (h *testHandler) HandleTx(p *Peer, msg TxMsg) error {
+	h.txCh <- msg
+	return nil
+}
+
+func (h *testHandler) HandleNewBlock(p *Peer, msg NewBlockMsg) error {
+	return nil
+}
+
+func (h *testHandler) PeerConnected(p *Peer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connected = append(h.connected, p.Addr())
+}
+
+func (h *testHandler) PeerDisconnected(p *Peer, err error) {}
+
+func startTestServer(t *testing.T, chainID string, h Handler) *Server {
+	// pick a free port, as the port is a part of the node's handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	p2pPort, _ := strconv.Atoi(port)
+
+	local := Handshake{Version: ProtocolVersion, ChainID: chainID, GenesisHash: database.Hash{1}, IP: "127.0.0.1", Port: 8080, P2PPort: uint(p2pPort)}
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(fmt.Sprintf("127.0.0.1:%d", p2pPort), local, key, h, nil)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+func TestServer_RequestAndAnnounce(t *testing.T) {
+	h1, h2 := newTestHandler(1), newTestHandler(7)
+	s1 := startTestServer(t, "test-chain", h1)
+	s2 := startTestServer(t, "test-chain", h2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p, err := s1.Connect(ctx, s2.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var status StatusMsg
+	if err := p.Request(ctx, MsgGetStatus, struct{}{}, MsgStatus, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.BlockNumber != 7 {
+		t.Fatalf("expected the remote block number 7, got %d", status.BlockNumber)
+	}
+
+	// an error of the remote handler is returned to the requester
+	var blocks BlocksMsg
+	if err := p.Request(ctx, MsgGetBlocks, &GetBlocksMsg{}, MsgBlocks, &blocks); err == nil {
+		t.Fatal("expected the remote error")
+	}
+
+	tx := database.NewSignedTx(*database.NewTx(database.NewAccount("a"), database.NewAccount("b"), "", 1, 1), []byte{})
+	if err := p.Send(MsgTx, &TxMsg{Tx: *tx}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case received := <-h2.txCh:
+		if received.Tx.Value != 1 {
+			t.Fatalf("unexpected transaction value %d", received.Tx.Value)
+		}
+	case <-ctx.Done():
+		t.Fatal("the announced transaction wasn't received")
+	}
+
+	// the dialed node registers the inbound peer as well
+	if _, ok := s2.Peer(s1.NodeID()); !ok {
+		t.Fatal("expected the inbound peer to be registered")
+	}
+	// connecting again reuses the connection
+	again, err := s1.Connect(ctx, s2.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != p {
+		t.Fatal("expected the existing peer to be returned")
+	}
+	if p.ID() != s2.NodeID() {
+		t.Fatalf("expected the peer id %s, got %s", s2.NodeID(), p.ID())
+	}
+}
+
+func TestHandshake_RejectsImpersonation(t *testing.T) {
+	honestKey, _ := crypto.GenerateKey()
+	attackerKey, _ := crypto.GenerateKey()
+	victimKey, _ := crypto.GenerateKey()
+	local := Handshake{Version: ProtocolVersion, ChainID: "test-chain", GenesisHash: database.Hash{1}, IP: "127.0.0.1", Port: 8080, P2PPort: 9080}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	result := make(chan error, 1)
+	go func() {
+		_, err := doHandshake(NewConn(c1), local, honestKey)
+		result <- err
+	}()
+
+	// the attacker claims the victim's node id, but can sign with its own key only
+	conn := NewConn(c2)
+	remote := local
+	remote.NodeID = NodeID(&victimKey.PublicKey)
+	remote.Nonce = make([]byte, handshakeNonceSize)
+	msg, _ := NewMsg(MsgHandshake, 0, &remote)
+	reply, err := exchange(conn, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var honest Handshake
+	if err := reply.Decode(&honest); err != nil {
+		t.Fatal(err)
+	}
+	sig, _ := signDigest(attackerKey, handshakeDigest(honest.Nonce, msg.Payload))
+	authMsg, _ := NewMsg(MsgHandshakeAuth, 0, &HandshakeAuth{sig})
+	if _, err := exchange(conn, authMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-result; !errors.Is(err, ErrIncompatiblePeer) {
+		t.Fatalf("expected the impersonation to be rejected, got %v", err)
+	}
+}
+
+func TestServer_HandshakeRejectsOtherChain(t *testing.T) {
+	s1 := startTestServer(t, "chain-a", newTestHandler(0))
+	s2 := startTestServer(t, "chain-b", newTestHandler(0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s1.Connect(ctx, s2.ListenAddr()); !errors.Is(err, ErrIncompatiblePeer) {
+		t.Fatalf("expected an incompatible peer error, got %v", err)
+	}
+	if len(s1.Peers()) != 0 {
+		t.Fatal("expected no peers after a failed handshake")
+	}
+}
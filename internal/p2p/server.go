@@ -0,0 +1,207 @@
+package p2p
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"net"
+	"sync"
+)
+
+// Server accepts the connections of the remote nodes and dials the known ones.
+// There is at most one connection per remote node ID.
+type Server struct {
+	listenAddr string
+	local      Handshake
+	key        *ecdsa.PrivateKey
+	handler    Handler
+	transport  Transport
+
+	mu sync.Mutex
+	// node id -> peer
+	peers    map[string]*Peer
+	listener net.Listener
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// The node key signs the handshakes, the local node ID is derived from it.
+func NewServer(listenAddr string, local Handshake, key *ecdsa.PrivateKey, h Handler, t Transport) *Server {
+	if t == nil {
+		t = TCPTransport{}
+	}
+	local.NodeID = NodeID(&key.PublicKey)
+	return &Server{
+		listenAddr: listenAddr,
+		local:      local,
+		key:        key,
+		handler:    h,
+		transport:  t,
+		peers:      make(map[string]*Peer),
+		quit:       make(chan struct{}),
+	}
+}
+
+func (s *Server) Start() error {
+	l, err := s.transport.Listen(s.listenAddr)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	logger.Printf(".Start() listening on %s\n", l.Addr())
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.acceptLoop()
+	}()
+	return nil
+}
+
+func (s *Server) acceptLoop() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+			logger.Printf(".acceptLoop() accept error %v\n", err)
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if _, err := s.setupConn(c, true); err != nil {
+				logger.Printf(".acceptLoop() inbound connection from %s failed: %v\n", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Stop accepting connections and disconnect all peers.
+func (s *Server) Stop() error {
+	select {
+	case <-s.quit:
+		return nil
+	default:
+	}
+	close(s.quit)
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for _, p := range s.Peers() {
+		p.Close()
+	}
+	s.wg.Wait()
+	return err
+}
+
+// Connect to the remote node. Returns the existing peer, if it's already connected.
+func (s *Server) Connect(ctx context.Context, addr string) (*Peer, error) {
+	if p, ok := s.PeerByAddr(addr); ok {
+		return p, nil
+	}
+	c, err := s.transport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.setupConn(c, false)
+	if err != nil {
+		return nil, err
+	}
+	if p.Addr() != addr {
+		logger.Printf(".Connect() node at %s introduced itself as %s\n", addr, p.Addr())
+	}
+	return p, nil
+}
+
+// Handshake the connection and start serving the peer.
+func (s *Server) setupConn(c net.Conn, inbound bool) (*Peer, error) {
+	conn := NewConn(c)
+	remote, err := doHandshake(conn, s.local, s.key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if remote.NodeID == s.local.NodeID {
+		conn.Close()
+		return nil, errors.New("connected to self")
+	}
+
+	p := newPeer(conn, remote, inbound)
+	s.mu.Lock()
+	select {
+	case <-s.quit:
+		s.mu.Unlock()
+		conn.Close()
+		return nil, errors.New("server is stopped")
+	default:
+	}
+	if existing, ok := s.peers[p.ID()]; ok {
+		s.mu.Unlock()
+		conn.Close()
+		return existing, nil
+	}
+	s.peers[p.ID()] = p
+	s.mu.Unlock()
+
+	s.handler.PeerConnected(p)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := p.run(s.handler)
+		s.mu.Lock()
+		if s.peers[p.ID()] == p {
+			delete(s.peers, p.ID())
+		}
+		s.mu.Unlock()
+		s.handler.PeerDisconnected(p, err)
+	}()
+	return p, nil
+}
+
+// The connected peer with the node ID.
+func (s *Server) Peer(id string) (*Peer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.peers[id]
+	return p, ok
+}
+
+// The connected peer, which introduced itself with the p2p address.
+func (s *Server) PeerByAddr(addr string) (*Peer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.peers {
+		if p.Addr() == addr {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// The node ID of the local node.
+func (s *Server) NodeID() string {
+	return s.local.NodeID
+}
+
+func (s *Server) Peers() []*Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]*Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		res = append(res, p)
+	}
+	return res
+}
+
+// The address the server is listening on.
+func (s *Server) ListenAddr() string {
+	if s.listener == nil {
+		return s.listenAddr
+	}
+	return s.listener.Addr().String()
+}
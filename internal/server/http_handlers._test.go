@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"taraskrasiuk/blockchain_l/internal/node"
+	"taraskrasiuk/blockchain_l/internal/p2p"
+	"taraskrasiuk/blockchain_l/internal/wallet"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// An opened node with an empty chain, the genesis funds the key. The node is served by the returned handler.
+func setupTestNode(t *testing.T) (*node.Node, http.Handler, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "database"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	gen := database.NewGenesisResource()
+	gen.AddAccount(crypto.PubkeyToAddress(key.PublicKey).Hex(), 1000)
+	if err := gen.SaveToFile(filepath.Join(dir, "database", "genesis.json")); err != nil {
+		t.Fatal(err)
+	}
+	n := node.NewNode(dir, 8085, "localhost", nil, database.NewAccount("miner"), true)
+	if err := n.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n, NewNodeServer(n, 8085).handler(), key
+}
+
+func postAnnouncedBlock(t *testing.T, h http.Handler, block database.Block) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(node.AnnounceBlockReq{Block: block, From: "peer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/node/announce/block", bytes.NewReader(body)))
+	return rec
+}
+
+func TestAnnounceBlock_Validation(t *testing.T) {
+	n, h, key := setupTestNode(t)
+	miner := database.NewAccount("0x0d")
+	tx, err := wallet.SignTx(*database.NewTx(crypto.PubkeyToAddress(key.PublicKey), database.NewAccount("0x01"), "", 10, 1), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs := []database.SignedTx{tx}
+
+	// an unmined block is rejected, its miner isn't credited
+	unmined := database.NewBlock(database.Hash{}, 1, 0, txs, miner)
+	for hash, _ := unmined.Hash(); database.IsValidBlock(hash); hash, _ = unmined.Hash() {
+		unmined.Header.Nonce++
+	}
+	if rec := postAnnouncedBlock(t, h, unmined); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected the unmined block to be rejected, got %d %s", rec.Code, rec.Body)
+	}
+
+	// a mined block, which isn't a child of the tip, is left for the sync
+	orphan, err := node.Mine(context.Background(), node.NewPendingBlock(database.Hash{0x01}, 1, txs, miner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := postAnnouncedBlock(t, h, orphan); rec.Code != http.StatusOK {
+		t.Fatalf("expected the orphan block to be skipped, got %d %s", rec.Code, rec.Body)
+	}
+	if n.ViewNodeStatus().BlockNumber != 0 || n.ViewBalancesList().Balance[miner] != 0 {
+		t.Fatal("expected the announced blocks not to change the state")
+	}
+
+	valid, err := node.Mine(context.Background(), node.NewPendingBlock(database.Hash{}, 1, txs, miner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := postAnnouncedBlock(t, h, valid); rec.Code != http.StatusOK {
+		t.Fatalf("expected the valid block to be accepted, got %d %s", rec.Code, rec.Body)
+	}
+	if n.ViewNodeStatus().BlockNumber != 1 || n.ViewBalancesList().Balance[miner] != database.MinerReward+database.TxFee {
+		t.Fatal("expected the valid block to be applied")
+	}
+}
+
+func TestAddPeer_DeclaredAddress(t *testing.T) {
+	n, h, _ := setupTestNode(t)
+	key, err := p2p.LoadOrCreateNodeKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addPeer := func(ip, remoteAddr string) int {
+		join := p2p.JoinRequest{NodeID: p2p.NodeID(&key.PublicKey), IP: ip, Port: 8086, Time: time.Now().Unix()}
+		sig, err := join.Sign(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		url := fmt.Sprintf("/node/addpeer?nodeId=%s&ip=%s&port=8086&time=%d&sig=%s", join.NodeID, ip, join.Time, sig)
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// a validly signed request can't add somebody else's address
+	if code := addPeer("10.0.0.66", "10.0.0.5:52000"); code != http.StatusUnauthorized {
+		t.Fatalf("expected the foreign address to be rejected, got %d", code)
+	}
+	if len(n.ViewNodeStatus().KnownPeers) != 0 {
+		t.Fatal("expected no known peers after the rejected join")
+	}
+	if code := addPeer("10.0.0.5", "10.0.0.5:52000"); code != http.StatusOK {
+		t.Fatalf("expected the sender's own address to be accepted, got %d", code)
+	}
+	if len(n.ViewNodeStatus().KnownPeers) != 1 {
+		t.Fatal("expected the joined peer to be known")
+	}
+}
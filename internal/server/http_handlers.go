@@ -2,12 +2,19 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"taraskrasiuk/blockchain_l/internal/database"
 	"taraskrasiuk/blockchain_l/internal/node"
+	"taraskrasiuk/blockchain_l/internal/p2p"
 	"taraskrasiuk/blockchain_l/internal/wallet"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
 )
 
 type HttpNodeHandler struct {
@@ -40,25 +47,224 @@ func (h *HttpNodeHandler) handlerNodeStatus(w http.ResponseWriter, r *http.Reque
 	}
 }
 
-// ====== GET /node/sync?fromBlock=xxx
+// ====== GET /node/events?types=xxx,xxx
+// Stream the node events as server-sent events, until the client disconnects or the node is closed.
+// All the events are streamed, if the types aren't set.
+func (h *HttpNodeHandler) handlerEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, "streaming isn't supported")
+		return
+	}
+	var types []node.EventType
+	if param := r.URL.Query().Get("types"); param != "" {
+		for _, t := range strings.Split(param, ",") {
+			if !slices.Contains(node.EventTypes, node.EventType(t)) {
+				writeErr(w, http.StatusBadRequest, fmt.Sprintf("unknown event type %s", t))
+				return
+			}
+			types = append(types, node.EventType(t))
+		}
+	}
+	sub := h.node.Subscribe(types...)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// ====== GET /node/sync?fromBlock=xxx&limit=xxx
 func (h *HttpNodeHandler) handlerSync(w http.ResponseWriter, r *http.Request) {
+	hash, limit, ok := parseSyncQuery(w, r)
+	if !ok {
+		return
+	}
+	blocks, err := h.node.ViewSyncBlocks(hash, limit)
+	if errors.Is(err, database.ErrUnknownBlock) {
+		writeErr(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "could not get the blocks. internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, blocks)
+}
+
+// ====== GET /node/headers?fromBlock=xxx&limit=xxx&locator=xxx,xxx
+func (h *HttpNodeHandler) handlerSyncHeaders(w http.ResponseWriter, r *http.Request) {
+	hash, limit, ok := parseSyncQuery(w, r)
+	if !ok {
+		return
+	}
+	locator, ok := parseLocator(w, r)
+	if !ok {
+		return
+	}
+	headers, err := h.node.ViewSyncHeaders(hash, locator, limit)
+	if errors.Is(err, database.ErrUnknownBlock) {
+		writeErr(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, "could not get the headers. internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, headers)
+}
+
+// Parse the fromBlock hash and the optional limit of the sync requests. The zero limit means the node's maximum.
+func parseSyncQuery(w http.ResponseWriter, r *http.Request) (database.Hash, int, bool) {
 	reqHash := r.URL.Query().Get("fromBlock")
 	if reqHash == "" {
 		writeErr(w, http.StatusBadRequest, "fromBlock parameter not found")
-		return
+		return database.Hash{}, 0, false
 	}
 	hash := database.Hash{}
 	err := hash.UnmarshalText([]byte(reqHash))
 	if err != nil {
 		writeErr(w, http.StatusBadRequest, "could not validate a provided hash")
+		return database.Hash{}, 0, false
+	}
+	limit := 0
+	if reqLimit := r.URL.Query().Get("limit"); reqLimit != "" {
+		limit, err = strconv.Atoi(reqLimit)
+		if err != nil || limit < 0 {
+			writeErr(w, http.StatusBadRequest, "limit should be a non negative number")
+			return database.Hash{}, 0, false
+		}
+	}
+	return hash, limit, true
+}
+
+// Parse the optional comma separated block locator.
+func parseLocator(w http.ResponseWriter, r *http.Request) ([]database.Hash, bool) {
+	reqLocator := r.URL.Query().Get("locator")
+	if reqLocator == "" {
+		return nil, true
+	}
+	var locator []database.Hash
+	for _, reqHash := range strings.Split(reqLocator, ",") {
+		var hash database.Hash
+		if err := hash.UnmarshalText([]byte(reqHash)); err != nil {
+			writeErr(w, http.StatusBadRequest, "could not validate a locator hash")
+			return nil, false
+		}
+		locator = append(locator, hash)
+	}
+	return locator, true
+}
+
+// ===== GET /mining/work?miner=xxx
+func (h *HttpNodeHandler) handlerGetWork(w http.ResponseWriter, r *http.Request) {
+	var miner common.Address
+	if reqMiner := r.URL.Query().Get("miner"); reqMiner != "" {
+		if !common.IsHexAddress(reqMiner) {
+			writeErr(w, http.StatusBadRequest, "could not validate the miner address")
+			return
+		}
+		miner = common.HexToAddress(reqMiner)
+	}
+	work, err := h.node.GetWork(miner)
+	if errors.Is(err, node.ErrNoWork) {
+		writeErr(w, http.StatusNotFound, err.Error())
 		return
 	}
-	blocks, err := h.node.ViewSyncBlocks(hash)
 	if err != nil {
-		writeErr(w, http.StatusInternalServerError, "could not get the blocks. internal error")
+		writeErr(w, http.StatusInternalServerError, "could not create the work due to: "+err.Error())
 		return
 	}
-	writeJSON(w, http.StatusOK, blocks)
+	writeJSON(w, http.StatusOK, work)
+}
+
+// ===== POST /mining/submit
+func (h *HttpNodeHandler) handlerSubmitWork(w http.ResponseWriter, r *http.Request) {
+	var req node.SubmitWorkReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "could not decode payload")
+		return
+	}
+	defer r.Body.Close()
+	hash, err := h.node.SubmitWork(req)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, "could not accept the work due to: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, node.SubmitWorkRes{Hash: hash})
+}
+
+// ==== POST /admin/mining/start
+func (h *HttpNodeHandler) handlerStartMining(w http.ResponseWriter, r *http.Request) {
+	h.node.StartMining()
+	writeJSON(w, http.StatusOK, h.node.MiningStatus())
+}
+
+// ==== POST /admin/mining/stop
+func (h *HttpNodeHandler) handlerStopMining(w http.ResponseWriter, r *http.Request) {
+	h.node.StopMining()
+	writeJSON(w, http.StatusOK, h.node.MiningStatus())
+}
+
+// ==== POST /admin/mining/coinbase
+func (h *HttpNodeHandler) handlerSetCoinbase(w http.ResponseWriter, r *http.Request) {
+	var req node.SetCoinbaseReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "could not decode payload")
+		return
+	}
+	defer r.Body.Close()
+	if !common.IsHexAddress(req.Coinbase) {
+		writeErr(w, http.StatusBadRequest, "could not validate the coinbase address")
+		return
+	}
+	h.node.SetCoinbase(common.HexToAddress(req.Coinbase))
+	writeJSON(w, http.StatusOK, h.node.MiningStatus())
+}
+
+// ==== POST /admin/mining/threads
+func (h *HttpNodeHandler) handlerSetMinerThreads(w http.ResponseWriter, r *http.Request) {
+	var req node.SetMinerThreadsReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "could not decode payload")
+		return
+	}
+	defer r.Body.Close()
+	if req.Threads <= 0 {
+		writeErr(w, http.StatusBadRequest, "the number of the threads should be positive")
+		return
+	}
+	h.node.SetMinerThreads(req.Threads)
+	writeJSON(w, http.StatusOK, h.node.MiningStatus())
+}
+
+// ===== GET /tx/status?hash=xxx
+func (h *HttpNodeHandler) handlerTxStatus(w http.ResponseWriter, r *http.Request) {
+	var hash database.Hash
+	if err := hash.UnmarshalText([]byte(r.URL.Query().Get("hash"))); err != nil {
+		writeErr(w, http.StatusBadRequest, "could not validate a transaction hash")
+		return
+	}
+	writeJSON(w, http.StatusOK, h.node.TxStatus(hash))
 }
 
 // ===== POST /tx/add
@@ -69,6 +275,11 @@ func (h *HttpNodeHandler) handlerTxAddRequest(w http.ResponseWriter, r *http.Req
 		To      string `json:"to"`
 		Data    string `json:"data"`
 		Value   uint   `json:"value"`
+		// optional, the minimum fee is charged if it's not set
+		Fee uint `json:"fee"`
+		// optional, the nonce of a pending transaction to replace it with a higher fee,
+		// the next nonce is used if it's not set
+		Nonce *uint `json:"nonce"`
 	}
 
 	var txReqBody reqBody
@@ -80,7 +291,12 @@ func (h *HttpNodeHandler) handlerTxAddRequest(w http.ResponseWriter, r *http.Req
 	defer r.Body.Close()
 
 	fromAcc := database.NewAccount(txReqBody.From)
-	tx := database.NewTx(fromAcc, database.NewAccount(txReqBody.To), txReqBody.Data, txReqBody.Value, h.node.NextAccountNonce(fromAcc))
+	nonce := h.node.NextPendingNonce(fromAcc)
+	if txReqBody.Nonce != nil {
+		nonce = *txReqBody.Nonce
+	}
+	tx := database.NewTx(fromAcc, database.NewAccount(txReqBody.To), txReqBody.Data, txReqBody.Value, nonce)
+	tx.Fee = txReqBody.Fee
 	txHash, err := tx.Hash()
 	if err != nil {
 		writeErr(w, http.StatusBadRequest, "could not create a new pending transcation"+err.Error())
@@ -108,14 +324,19 @@ func (h *HttpNodeHandler) handlerTxAddRequest(w http.ResponseWriter, r *http.Req
 	}
 }
 
-// ==== GET /node/addpeer?ip=xxxx&port=xxxx
+// ==== GET /node/addpeer?nodeId=xxxx&ip=xxxx&port=xxxx&p2pPort=xxxx&time=xxxx&sig=xxxx
+// The request must be signed by the key of the joining node and sent from the declared ip.
 func (h *HttpNodeHandler) handlerAddPeer(w http.ResponseWriter, r *http.Request) {
 	var (
-		ip   = r.URL.Query().Get("ip")
-		port = r.URL.Query().Get("port")
+		nodeID  = r.URL.Query().Get("nodeId")
+		ip      = r.URL.Query().Get("ip")
+		port    = r.URL.Query().Get("port")
+		p2pPort = r.URL.Query().Get("p2pPort")
+		reqTime = r.URL.Query().Get("time")
+		sig     = r.URL.Query().Get("sig")
 	)
-	if ip == "" || port == "" {
-		writeErr(w, http.StatusBadRequest, "ip and port should be defined in query")
+	if nodeID == "" || ip == "" || port == "" || reqTime == "" || sig == "" {
+		writeErr(w, http.StatusBadRequest, "nodeId, ip, port, time and sig should be defined in query")
 		return
 	}
 
@@ -124,12 +345,113 @@ func (h *HttpNodeHandler) handlerAddPeer(w http.ResponseWriter, r *http.Request)
 		writeErr(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	p := node.NewPeerNode(ip, uint(peerPort), false, true)
-	h.node.AddPeer(p)
-	fmt.Printf("Peer node %s, successfully added.", p.TcpAddress())
-	type successRes struct {
-		Success bool   `json:"success"`
-		Error   string `json:"error"`
+	var peerP2PPort uint64
+	if p2pPort != "" {
+		peerP2PPort, err = strconv.ParseUint(p2pPort, 10, 32)
+		if err != nil {
+			writeErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	unixTime, err := strconv.ParseInt(reqTime, 10, 64)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	join := p2p.JoinRequest{NodeID: nodeID, IP: ip, Port: uint(peerPort), P2PPort: uint(peerP2PPort), Time: unixTime}
+	// the peer may add its own address only
+	if err := join.VerifyAddress(r.RemoteAddr); err != nil {
+		writeErr(w, http.StatusUnauthorized, "could not accept the join request due to: "+err.Error())
+		return
+	}
+	p, err := h.node.AcceptJoin(join, sig)
+	if err != nil {
+		writeErr(w, http.StatusUnauthorized, "could not accept the join request due to: "+err.Error())
+		return
+	}
+	fmt.Printf("Peer node %s %s, successfully added.", p.ID, p.TcpAddress())
+	writeJSON(w, http.StatusOK, &successRes{true, ""})
+}
+
+// ==== POST /node/announce/block
+func (h *HttpNodeHandler) handlerAnnounceBlock(w http.ResponseWriter, r *http.Request) {
+	var req node.AnnounceBlockReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "could not decode payload")
+		return
+	}
+	defer r.Body.Close()
+
+	// the sender of the HTTP announcement isn't authenticated, so it's not trusted to be the peer in From,
+	// the block is announced to every peer
+	if err := h.node.HandleAnnouncedBlock(req.Block, ""); err != nil {
+		writeErr(w, http.StatusBadRequest, "could not accept the block due to: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, &successRes{true, ""})
+}
+
+// ==== POST /node/announce/tx
+func (h *HttpNodeHandler) handlerAnnounceTX(w http.ResponseWriter, r *http.Request) {
+	var req node.AnnounceTxReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "could not decode payload")
+		return
+	}
+	defer r.Body.Close()
+
+	// the sender isn't authenticated, see handlerAnnounceBlock
+	if err := h.node.HandleAnnouncedTX(req.Tx, ""); err != nil {
+		writeErr(w, http.StatusBadRequest, "could not accept the transaction due to: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, &successRes{true, ""})
+}
+
+// ADMIN
+// ==== POST /admin/peers/ban
+func (h *HttpNodeHandler) handlerBanPeer(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID string `json:"id"`
+		// e.g. "30m", the default ban duration is used if empty
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "could not decode payload")
+		return
+	}
+	defer r.Body.Close()
+
+	duration := node.PEER_BAN_DURATION
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			writeErr(w, http.StatusBadRequest, "invalid duration "+req.Duration)
+			return
+		}
+		duration = d
+	}
+	if err := h.node.BanPeer(req.ID, duration); err != nil {
+		writeErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, &successRes{true, ""})
+}
+
+// ==== POST /admin/peers/unban
+func (h *HttpNodeHandler) handlerUnbanPeer(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "could not decode payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := h.node.UnbanPeer(req.ID); err != nil {
+		writeErr(w, http.StatusNotFound, err.Error())
+		return
 	}
 	writeJSON(w, http.StatusOK, &successRes{true, ""})
 }
@@ -140,6 +462,11 @@ func (h *HttpNodeHandler) handlerWalletAccounts(w http.ResponseWriter, r *http.R
 	writeJSON(w, http.StatusOK, h.node.WalletAccounts())
 }
 
+type successRes struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+}
+
 func writeJSON(w http.ResponseWriter, statusCode int, v any) error {
 	w.WriteHeader(statusCode)
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func serveCompressed(t *testing.T, acceptEncoding string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/node/sync", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rec := httptest.NewRecorder()
+	NewCompressionMiddleware(handler).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCompressionMiddleware(t *testing.T) {
+	body := strings.Repeat(`{"hash":"0x00"}`, 100)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, body)
+	}
+	decoders := map[string]func(r io.Reader) (io.Reader, error){
+		"zstd": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	}
+
+	for encoding, decode := range decoders {
+		t.Run(encoding, func(t *testing.T) {
+			// the pooled encoders are reused by the following responses
+			for i := 0; i < 3; i++ {
+				rec := serveCompressed(t, encoding, handler)
+				if got := rec.Header().Get("Content-Encoding"); got != encoding {
+					t.Fatalf("expected the %s encoding, got '%s'", encoding, got)
+				}
+				r, err := decode(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.Contains(string(decoded), `{\"hash\":\"0x00\"}`) {
+					t.Fatalf("expected the decoded body to match the written one, got %s", decoded)
+				}
+			}
+		})
+	}
+
+	t.Run("not accepted", func(t *testing.T) {
+		rec := serveCompressed(t, "zstd;q=0", handler)
+		if got := rec.Header().Get("Content-Encoding"); got != "" {
+			t.Fatalf("expected the uncompressed response, got '%s'", got)
+		}
+	})
+}
+
+func TestCompressionMiddleware_EmptyBody(t *testing.T) {
+	rec := serveCompressed(t, "zstd", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected the status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Fatalf("expected no encoding of an empty body, got '%s'", got)
+	}
+	if rec.Body.Len() != 0 {
+		t.Fatalf("expected an empty body, got %d bytes", rec.Body.Len())
+	}
+
+	rec = serveCompressed(t, "gzip", func(w http.ResponseWriter, r *http.Request) {})
+	if rec.Body.Len() != 0 || rec.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("expected nothing to be written, got %d bytes encoded with '%s'", rec.Body.Len(), rec.Header().Get("Content-Encoding"))
+	}
+}
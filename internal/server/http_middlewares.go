@@ -1,11 +1,17 @@
 package server
 
 import (
+	"compress/gzip"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 type LoggerMiddleware struct {
@@ -27,3 +33,149 @@ func (l LoggerMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Fprintf(l.out, "[%s]: %s %s\n", r.Method, r.URL, time.Since(startTime).String())
 }
+
+// Reject the requests, which don't come from a loopback address, e.g. the admin endpoints.
+type LocalOnlyMiddleware struct {
+	next http.Handler
+}
+
+func NewLocalOnlyMiddleware(next http.Handler) *LocalOnlyMiddleware {
+	return &LocalOnlyMiddleware{next}
+}
+
+func (l LocalOnlyMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		writeErr(w, http.StatusForbidden, "the endpoint is available from the local host only")
+		return
+	}
+	l.next.ServeHTTP(w, r)
+}
+
+// The encoders are reused between the responses, a zstd encoder is costly to allocate.
+var (
+	zstdEncoders = sync.Pool{New: func() any {
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil
+		}
+		return enc
+	}}
+	gzipEncoders = sync.Pool{New: func() any {
+		return gzip.NewWriter(nil)
+	}}
+)
+
+// responseEncoder is a pooled compressor, which is reset to write to the next response.
+type responseEncoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// Compress the response body with zstd or gzip, depending on the request's Accept-Encoding header.
+type CompressionMiddleware struct {
+	next http.Handler
+}
+
+func NewCompressionMiddleware(next http.Handler) *CompressionMiddleware {
+	return &CompressionMiddleware{next}
+}
+
+func (c CompressionMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	var (
+		encoding string
+		pool     *sync.Pool
+	)
+	switch acceptedEncodings := parseAcceptEncoding(r.Header.Get("Accept-Encoding")); {
+	case acceptedEncodings["zstd"]:
+		encoding, pool = "zstd", &zstdEncoders
+	case acceptedEncodings["gzip"]:
+		encoding, pool = "gzip", &gzipEncoders
+	default:
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	cw := &compressedResponseWriter{ResponseWriter: w, encoding: encoding, pool: pool}
+	defer cw.close()
+	c.next.ServeHTTP(cw, r)
+}
+
+func parseAcceptEncoding(header string) map[string]bool {
+	res := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		// an encoding with q=0 is explicitly not acceptable
+		if strings.ReplaceAll(strings.TrimSpace(params), " ", "") == "q=0" {
+			continue
+		}
+		res[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	return res
+}
+
+// compressedResponseWriter holds the status code back until the first byte of the body, so an empty
+// response is sent as is, without the Content-Encoding header and an empty compressed frame.
+type compressedResponseWriter struct {
+	http.ResponseWriter
+	encoding    string
+	pool        *sync.Pool
+	enc         responseEncoder
+	statusCode  int
+	wroteHeader bool
+}
+
+func (cw *compressedResponseWriter) WriteHeader(statusCode int) {
+	if cw.statusCode != 0 {
+		return
+	}
+	cw.statusCode = statusCode
+}
+
+func (cw *compressedResponseWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if !cw.wroteHeader {
+		cw.start()
+	}
+	if cw.enc == nil {
+		return cw.ResponseWriter.Write(b)
+	}
+	return cw.enc.Write(b)
+}
+
+// Send the headers and take an encoder from the pool. When no encoder is available, the body is sent uncompressed.
+func (cw *compressedResponseWriter) start() {
+	cw.wroteHeader = true
+	if cw.statusCode == 0 {
+		cw.statusCode = http.StatusOK
+	}
+	if enc, ok := cw.pool.Get().(responseEncoder); ok {
+		enc.Reset(cw.ResponseWriter)
+		cw.enc = enc
+		cw.Header().Set("Content-Encoding", cw.encoding)
+		cw.Header().Del("Content-Length")
+	}
+	cw.ResponseWriter.WriteHeader(cw.statusCode)
+}
+
+// Flush the compressed body and return the encoder, or send the held status code of an empty response.
+func (cw *compressedResponseWriter) close() {
+	if !cw.wroteHeader {
+		if cw.statusCode != 0 {
+			cw.ResponseWriter.WriteHeader(cw.statusCode)
+		}
+		return
+	}
+	if cw.enc == nil {
+		return
+	}
+	if err := cw.enc.Close(); err != nil {
+		logger.Printf(".CompressionMiddleware() could not finish the %s response, %v\n", cw.encoding, err)
+	}
+	cw.pool.Put(cw.enc)
+	cw.enc = nil
+}
@@ -2,12 +2,18 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"taraskrasiuk/blockchain_l/internal/node"
+	"time"
 )
 
+// How long the in-flight requests are waited for on shutdown.
+var SHUTDOWN_TIMEOUT = 10 * time.Second
+
 type NodeServer struct {
 	node *node.Node
 	port uint
@@ -17,13 +23,42 @@ func NewNodeServer(n *node.Node, p uint) *NodeServer {
 	return &NodeServer{n, p}
 }
 
+// Start the node, then serve the HTTP API, until the context is canceled or the listener fails.
+// On shutdown the in-flight requests are drained, before the node is closed. Returns the errors
+// of the serving and of the shutdown.
 func (s *NodeServer) Run(ctx context.Context) error {
 	logger.Printf(" node server is running on port %d", s.port)
-	if err := s.node.Run(ctx); err != nil {
+	if err := s.node.Start(ctx); err != nil {
 		return err
 	}
-	defer s.node.Close()
 
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", s.port), Handler: s.handler()}
+	// the event streams don't finish by themselves, end them on shutdown
+	streamsCtx, cancelStreams := context.WithCancel(context.Background())
+	defer cancelStreams()
+	srv.BaseContext = func(net.Listener) context.Context { return streamsCtx }
+	srv.RegisterOnShutdown(cancelStreams)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+		logger.Printf(" shutting down the node server: %v", ctx.Err())
+	case err := <-serveErr:
+		runErr = err
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		runErr = errors.Join(runErr, fmt.Errorf("shutting down the http server: %w", err))
+	}
+	return errors.Join(runErr, s.node.Close())
+}
+
+func (s *NodeServer) handler() http.Handler {
 	mux := http.NewServeMux()
 	nodeHandler := NewHttpNodeHanlder(s.node)
 
@@ -32,14 +67,28 @@ func (s *NodeServer) Run(ctx context.Context) error {
 	mux.HandleFunc("GET /balances/list", nodeHandler.handleGetBalancesList)
 	// add new transaction
 	mux.HandleFunc("POST /tx/add", nodeHandler.handlerTxAddRequest)
+	mux.HandleFunc("GET /tx/status", nodeHandler.handlerTxStatus)
 	// node
 	mux.HandleFunc("GET /node/status", nodeHandler.handlerNodeStatus)
-	mux.HandleFunc("GET /node/sync", nodeHandler.handlerSync)
+	mux.HandleFunc("GET /node/events", nodeHandler.handlerEvents)
+	mux.Handle("GET /node/sync", NewCompressionMiddleware(http.HandlerFunc(nodeHandler.handlerSync)))
+	mux.Handle("GET /node/headers", NewCompressionMiddleware(http.HandlerFunc(nodeHandler.handlerSyncHeaders)))
 	mux.HandleFunc("GET /node/addpeer", nodeHandler.handlerAddPeer)
+	mux.HandleFunc("POST /node/announce/block", nodeHandler.handlerAnnounceBlock)
+	mux.HandleFunc("POST /node/announce/tx", nodeHandler.handlerAnnounceTX)
+	// external miners
+	mux.HandleFunc("GET /mining/work", nodeHandler.handlerGetWork)
+	mux.HandleFunc("POST /mining/submit", nodeHandler.handlerSubmitWork)
+
+	// admin, allowed from the loopback addresses only
+	mux.Handle("POST /admin/peers/ban", NewLocalOnlyMiddleware(http.HandlerFunc(nodeHandler.handlerBanPeer)))
+	mux.Handle("POST /admin/peers/unban", NewLocalOnlyMiddleware(http.HandlerFunc(nodeHandler.handlerUnbanPeer)))
+	mux.Handle("POST /admin/mining/start", NewLocalOnlyMiddleware(http.HandlerFunc(nodeHandler.handlerStartMining)))
+	mux.Handle("POST /admin/mining/stop", NewLocalOnlyMiddleware(http.HandlerFunc(nodeHandler.handlerStopMining)))
+	mux.Handle("POST /admin/mining/coinbase", NewLocalOnlyMiddleware(http.HandlerFunc(nodeHandler.handlerSetCoinbase)))
+	mux.Handle("POST /admin/mining/threads", NewLocalOnlyMiddleware(http.HandlerFunc(nodeHandler.handlerSetMinerThreads)))
 
 	// keystore
 	mux.HandleFunc("GET /wallet/accounts", nodeHandler.handlerWalletAccounts)
-	withLogger := NewLoggerMiddleware(mux, os.Stdout)
-
-	return http.ListenAndServe(fmt.Sprintf(":%d", s.port), withLogger)
+	return NewLoggerMiddleware(mux, os.Stdout)
 }
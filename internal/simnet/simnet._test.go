@@ -0,0 +1,169 @@
+package simnet
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func newTestNetwork(t *testing.T, cfg Config, keys ...*ecdsa.PrivateKey) *Network {
+	cfg.Balances = make(map[common.Address]uint)
+	for _, key := range keys {
+		cfg.Balances[crypto.PubkeyToAddress(key.PublicKey)] = 1000
+	}
+	if cfg.SyncInterval == 0 {
+		cfg.SyncInterval = 10 * time.Second
+	}
+	net, err := NewNetwork(t.TempDir(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := net.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return net
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestNetwork_BlockPropagates(t *testing.T) {
+	key := newTestKey(t)
+	net := newTestNetwork(t, Config{Nodes: 4, Seed: 1, Latency: 200 * time.Millisecond, Jitter: 300 * time.Millisecond}, key)
+	ctx := context.Background()
+
+	// the nodes join the bootstrap node, then learn about each other
+	net.Step(ctx, 30*time.Second)
+	for i := 0; i < net.Len(); i++ {
+		if peers := len(net.Node(i).ViewNodeStatus().KnownPeers); peers != net.Len()-1 {
+			t.Fatalf("expected node%d to know all the peers, got %d", i, peers)
+		}
+	}
+
+	if _, err := net.SendTX(3, key, database.NewAccount("0x01"), 10); err != nil {
+		t.Fatal(err)
+	}
+	// the transaction is gossiped, before the next sync
+	net.Step(ctx, time.Second)
+	if err := net.Mine(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	net.Step(ctx, time.Second)
+	if !net.Converged() {
+		t.Fatalf("expected the announced block to reach all the nodes, got %v", net.Heads())
+	}
+	if head := net.Heads()[0]; head.Number != 1 {
+		t.Fatalf("expected the chain of one block, got %v", head)
+	}
+}
+
+func TestNetwork_PartitionHeals(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	net := newTestNetwork(t, Config{Nodes: 3, Seed: 2, Latency: 100 * time.Millisecond}, alice, bob)
+	ctx := context.Background()
+	net.Step(ctx, 30*time.Second)
+
+	net.Partition([]int{0, 1}, []int{2})
+	for i := 0; i < 2; i++ {
+		if _, err := net.SendTX(0, alice, database.NewAccount("0x01"), 10); err != nil {
+			t.Fatal(err)
+		}
+		if err := net.Mine(ctx, 0); err != nil {
+			t.Fatal(err)
+		}
+		net.Step(ctx, 5*time.Second)
+	}
+	bobTX, err := net.SendTX(2, bob, database.NewAccount("0x02"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := net.Mine(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := net.WaitConverged(ctx, time.Minute); err == nil {
+		t.Fatal("expected the partitions to diverge")
+	}
+
+	// the shorter fork of node2 is replaced by the longer one, its transaction is pending again and is mined
+	net.Heal()
+	net.RequireConverged(t, 2*time.Minute)
+	if head := net.Heads()[2]; head.Number != 2 {
+		t.Fatalf("expected node2 to switch to the longer fork, got %v", head)
+	}
+	bobHash, _ := bobTX.Hash()
+	if status := net.Node(2).TxStatus(bobHash); status.Status != "pending" {
+		t.Fatalf("expected the transaction of the dropped fork to be pending, got %+v", status)
+	}
+	if err := net.Mine(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	net.RequireConverged(t, time.Minute)
+	head := net.Heads()[0]
+	if status := net.Node(0).TxStatus(bobHash); status.Status != "mined" || status.BlockNumber == nil || *status.BlockNumber != head.Number {
+		t.Fatalf("expected the transaction to be mined in the last block %d, got %+v", head.Number, status)
+	}
+}
+
+// The same seed loses the same messages.
+func TestNetwork_Deterministic(t *testing.T) {
+	key := newTestKey(t)
+	start := time.Now()
+	run := func() (Stats, []uint64) {
+		net := newTestNetwork(t, Config{Nodes: 4, Seed: 3, Start: start, Loss: 0.3, Latency: time.Second, Jitter: time.Second}, key)
+		ctx := context.Background()
+		net.Step(ctx, time.Minute)
+		for i := 0; i < 3; i++ {
+			if _, err := net.SendTX(i, key, database.NewAccount("0x01"), 10); err != nil {
+				t.Fatal(err)
+			}
+			if err := net.Mine(ctx, i); err != nil {
+				t.Fatal(err)
+			}
+			net.Step(ctx, 3*time.Second)
+		}
+		// the forks of the same length are resolved by the next block
+		for attempt := 0; !net.Converged(); attempt++ {
+			if attempt == 5 {
+				t.Fatalf("expected the nodes to converge, got %v", net.Heads())
+			}
+			if _, err := net.SendTX(0, key, database.NewAccount("0x01"), 10); err != nil {
+				t.Fatal(err)
+			}
+			if err := net.Mine(ctx, 0); err != nil {
+				t.Fatal(err)
+			}
+			net.WaitConverged(ctx, 2*time.Minute)
+		}
+		var numbers []uint64
+		for _, h := range net.Heads() {
+			numbers = append(numbers, h.Number)
+		}
+		return net.Stats(), numbers
+	}
+
+	stats, numbers := run()
+	if stats.Lost == 0 {
+		t.Fatalf("expected some messages to be lost, got %+v", stats)
+	}
+	replayed, replayedNumbers := run()
+	if stats != replayed {
+		t.Fatalf("expected the replay to pass the same messages, got %+v and %+v", stats, replayed)
+	}
+	for i := range numbers {
+		if numbers[i] != replayedNumbers[i] {
+			t.Fatalf("expected the replay to build the same chain, got %v and %v", numbers, replayedNumbers)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+// Package simnet runs a network of nodes in a single process over an in-memory transport. The nodes share
+// a simulated clock, the latency, the loss and the partitions of the links are controlled by the test,
+// so a scenario with the same seed replays the same way.
+package simnet
+
+import (
+	"container/heap"
+	"context"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"taraskrasiuk/blockchain_l/internal/node"
+	"taraskrasiuk/blockchain_l/internal/p2p"
+	"taraskrasiuk/blockchain_l/internal/wallet"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// The http port of the simulated nodes, the nodes differ by the ip.
+const nodePort = 8080
+
+type Config struct {
+	// the number of the nodes, the first one is the bootstrap node of the others
+	Nodes int
+	// the seed of the latency jitter and the loss
+	Seed int64
+	// the start of the simulated time, the current time by default
+	Start time.Time
+	// the one-way latency of the announcements, a random jitter up to Jitter is added to it
+	Latency time.Duration
+	Jitter  time.Duration
+	// the probability of a request or an announcement to be lost
+	Loss float64
+	// how often the nodes sync with their peers, node.SYNC_TIME_TIMEOUT by default
+	SyncInterval time.Duration
+	// the balances of the genesis
+	Balances map[common.Address]uint
+}
+
+// The counters of the messages passed between the nodes.
+type Stats struct {
+	Requests    uint64
+	Sent        uint64
+	Delivered   uint64
+	Lost        uint64
+	Partitioned uint64
+}
+
+// Network is the set of the simulated nodes and the links between them. The nodes don't run
+// their own services, the network syncs them on the sync interval and delivers the announcements,
+// when it's stepped, and the test mines the blocks.
+type Network struct {
+	cfg   Config
+	clock *Clock
+	nodes []*node.Node
+	// tcp address -> node
+	addrs map[string]int
+
+	mu sync.Mutex
+	// the random source of each link, so the concurrent requests of the sync don't change the outcome
+	links     map[[2]int]*rand.Rand
+	latency   time.Duration
+	jitter    time.Duration
+	loss      float64
+	partition []int
+	queue     messageQueue
+	seq       uint64
+	nextSync  time.Time
+	stats     Stats
+}
+
+// Create the nodes in the subdirectories of the dir and open them. The node keys are derived from the seed.
+func NewNetwork(dir string, cfg Config) (*Network, error) {
+	if cfg.Nodes <= 0 {
+		return nil, fmt.Errorf("the network should have at least one node, got %d", cfg.Nodes)
+	}
+	if cfg.Start.IsZero() {
+		cfg.Start = time.Now()
+	}
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = node.SYNC_TIME_TIMEOUT
+	}
+	net := &Network{
+		cfg:      cfg,
+		clock:    NewClock(cfg.Start.Truncate(time.Second)),
+		addrs:    make(map[string]int),
+		links:    make(map[[2]int]*rand.Rand),
+		latency:  cfg.Latency,
+		jitter:   cfg.Jitter,
+		loss:     cfg.Loss,
+		nextSync: cfg.Start.Truncate(time.Second).Add(cfg.SyncInterval),
+	}
+
+	genesis := database.NewGenesisResource()
+	genesis.GenesisTime = net.clock.Now().Format(time.RFC3339)
+	for addr, balance := range cfg.Balances {
+		genesis.AddAccount(addr.Hex(), balance)
+	}
+	var bootstrap *node.PeerNode
+	for i := 0; i < cfg.Nodes; i++ {
+		nodeDir := filepath.Join(dir, fmt.Sprintf("node%d", i))
+		if err := os.MkdirAll(filepath.Join(nodeDir, "database"), 0700); err != nil {
+			return nil, errors.Join(err, net.Close())
+		}
+		if err := genesis.SaveToFile(filepath.Join(nodeDir, "database", "genesis.json")); err != nil {
+			return nil, errors.Join(err, net.Close())
+		}
+		key, err := nodeKey(cfg.Seed, i)
+		if err != nil {
+			return nil, errors.Join(err, net.Close())
+		}
+		if err := crypto.SaveECDSA(p2p.GetNodeKeyFile(nodeDir), key); err != nil {
+			return nil, errors.Join(err, net.Close())
+		}
+
+		ip := fmt.Sprintf("10.0.0.%d", i+1)
+		n := node.NewNode(nodeDir, nodePort, ip, bootstrap, crypto.PubkeyToAddress(key.PublicKey), true)
+		n.SetClock(net.clock)
+		n.SetTransport(&endpoint{net: net, from: i})
+		n.SetMinerThreads(1)
+		if err := n.Open(); err != nil {
+			return nil, errors.Join(err, net.Close())
+		}
+		if bootstrap == nil {
+			bootstrap = node.NewPeerNode(ip, nodePort, true, false)
+		}
+		net.nodes = append(net.nodes, n)
+		net.addrs[fmt.Sprintf("%s:%d", ip, nodePort)] = i
+	}
+	return net, nil
+}
+
+// The node key is derived from the seed and the index of the node, so the node ids are the same on replay.
+func nodeKey(seed int64, i int) (*ecdsa.PrivateKey, error) {
+	return crypto.ToECDSA(crypto.Keccak256([]byte(fmt.Sprintf("simnet-%d-%d", seed, i))))
+}
+
+func (net *Network) Node(i int) *node.Node {
+	return net.nodes[i]
+}
+
+func (net *Network) Len() int {
+	return len(net.nodes)
+}
+
+func (net *Network) Clock() *Clock {
+	return net.clock
+}
+
+func (net *Network) Stats() Stats {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	return net.stats
+}
+
+// Change the latency of the announcements, the messages in flight keep their delivery time.
+func (net *Network) SetLatency(latency, jitter time.Duration) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.latency, net.jitter = latency, jitter
+}
+
+func (net *Network) SetLoss(loss float64) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.loss = loss
+}
+
+// Split the network into the groups of the nodes, the nodes of different groups can't reach each other.
+// The nodes, which aren't listed, form a group of their own. The messages in flight between the groups are lost.
+func (net *Network) Partition(groups ...[]int) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.partition = make([]int, len(net.nodes))
+	for g, group := range groups {
+		for _, i := range group {
+			net.partition[i] = g + 1
+		}
+	}
+}
+
+// Remove the partitions.
+func (net *Network) Heal() {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.partition = nil
+}
+
+// Should be called with net.mu held.
+func (net *Network) reachableLocked(from, to int) bool {
+	return net.partition == nil || net.partition[from] == net.partition[to]
+}
+
+// Should be called with net.mu held.
+func (net *Network) linkRandLocked(from, to int) *rand.Rand {
+	r, ok := net.links[[2]int{from, to}]
+	if !ok {
+		h := fnv.New64a()
+		binary.Write(h, binary.BigEndian, [3]int64{net.cfg.Seed, int64(from), int64(to)})
+		r = rand.New(rand.NewSource(int64(h.Sum64())))
+		net.links[[2]int{from, to}] = r
+	}
+	return r
+}
+
+// Resolve the peer and pass a request through the link from the node.
+func (net *Network) link(from int, peer node.PeerNode) (int, error) {
+	to, ok := net.addrs[peer.TcpAddress()]
+	if !ok {
+		return 0, fmt.Errorf("%w %s", ErrUnknownPeer, peer.TcpAddress())
+	}
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.stats.Requests++
+	if !net.reachableLocked(from, to) {
+		net.stats.Partitioned++
+		return 0, ErrPartitioned
+	}
+	if net.loss > 0 && net.linkRandLocked(from, to).Float64() < net.loss {
+		net.stats.Lost++
+		return 0, ErrLost
+	}
+	return to, nil
+}
+
+// Queue the announcement for the delivery after the latency of the link. A lost announcement
+// isn't reported to the sender, as it isn't on the wire.
+func (net *Network) send(from int, peer node.PeerNode, deliver func(n *node.Node) error) error {
+	to, ok := net.addrs[peer.TcpAddress()]
+	if !ok {
+		return fmt.Errorf("%w %s", ErrUnknownPeer, peer.TcpAddress())
+	}
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.stats.Sent++
+	r := net.linkRandLocked(from, to)
+	if net.loss > 0 && r.Float64() < net.loss {
+		net.stats.Lost++
+		return nil
+	}
+	delay := net.latency
+	if net.jitter > 0 {
+		delay += time.Duration(r.Int63n(int64(net.jitter)))
+	}
+	net.seq++
+	heap.Push(&net.queue, &message{at: net.clock.Now().Add(delay), seq: net.seq, from: from, to: to, deliver: deliver})
+	return nil
+}
+
+// The next message due by the time, if any. The message between the partitions is dropped.
+func (net *Network) nextMessage(by time.Time) (*message, bool) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	for len(net.queue) > 0 && !net.queue[0].at.After(by) {
+		m := heap.Pop(&net.queue).(*message)
+		if !net.reachableLocked(m.from, m.to) {
+			net.stats.Partitioned++
+			continue
+		}
+		net.stats.Delivered++
+		return m, true
+	}
+	return nil, false
+}
+
+// Move the simulated time forward by d. The announcements are delivered and the sync rounds run in the order
+// of their time, the nodes of a round are synced in the order of their index.
+func (net *Network) Step(ctx context.Context, d time.Duration) {
+	end := net.clock.Now().Add(d)
+	for ctx.Err() == nil {
+		if m, ok := net.nextMessage(minTime(net.nextSync, end)); ok {
+			net.clock.set(m.at)
+			// the node rejects an invalid message the same way it does over the wire
+			m.deliver(net.nodes[m.to])
+			continue
+		}
+		if net.nextSync.After(end) {
+			break
+		}
+		net.clock.set(net.nextSync)
+		for _, n := range net.nodes {
+			n.SyncOnce(ctx)
+		}
+		net.nextSync = net.nextSync.Add(net.cfg.SyncInterval)
+	}
+	net.clock.set(end)
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// Mine a block of the pending transactions of the node.
+func (net *Network) Mine(ctx context.Context, i int) error {
+	return net.nodes[i].MineOnce(ctx)
+}
+
+// Sign a transfer from the account of the key with the next pending nonce of the node, and submit it to the node.
+// The transaction is created at the simulated time.
+func (net *Network) SendTX(i int, key *ecdsa.PrivateKey, to common.Address, value uint) (database.SignedTx, error) {
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	tx := database.NewTx(from, to, "", value, net.nodes[i].NextPendingNonce(from))
+	tx.CreatedAt = net.clock.Now().Format(time.RFC3339)
+	signed, err := wallet.SignTx(*tx, key)
+	if err != nil {
+		return database.SignedTx{}, err
+	}
+	return signed, net.nodes[i].AddPendingTX(signed)
+}
+
+// Head is the latest block of a node.
+type Head struct {
+	Node   int
+	Number uint64
+	Hash   database.Hash
+}
+
+func (h Head) String() string {
+	return fmt.Sprintf("node%d: %d %s", h.Node, h.Number, h.Hash)
+}
+
+func (net *Network) Heads() []Head {
+	res := make([]Head, len(net.nodes))
+	for i, n := range net.nodes {
+		status := n.ViewNodeStatus()
+		var hash database.Hash
+		hash.UnmarshalText([]byte(status.BlockHash))
+		res[i] = Head{Node: i, Number: status.BlockNumber, Hash: hash}
+	}
+	return res
+}
+
+// Whether all the nodes have the same latest block.
+func (net *Network) Converged() bool {
+	heads := net.Heads()
+	for _, h := range heads[1:] {
+		if h.Hash != heads[0].Hash {
+			return false
+		}
+	}
+	return true
+}
+
+// Step the network by the sync interval, until the nodes converge on the same chain or the simulated
+// time runs out. Returns the error describing the heads of the nodes, if they don't converge.
+func (net *Network) WaitConverged(ctx context.Context, within time.Duration) error {
+	deadline := net.clock.Now().Add(within)
+	for !net.Converged() {
+		if !net.clock.Now().Before(deadline) || ctx.Err() != nil {
+			var heads []string
+			for _, h := range net.Heads() {
+				heads = append(heads, h.String())
+			}
+			return fmt.Errorf("the nodes didn't converge within %s: %s", within, strings.Join(heads, ", "))
+		}
+		net.Step(ctx, net.cfg.SyncInterval)
+	}
+	return nil
+}
+
+// Fail the test, unless the nodes converge within the simulated time.
+func (net *Network) RequireConverged(t testing.TB, within time.Duration) {
+	t.Helper()
+	if err := net.WaitConverged(context.Background(), within); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Close the nodes.
+func (net *Network) Close() error {
+	var errs []error
+	for i, n := range net.nodes {
+		if err := n.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing node%d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
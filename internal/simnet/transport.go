@@ -0,0 +1,138 @@
+package simnet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"taraskrasiuk/blockchain_l/internal/database"
+	"taraskrasiuk/blockchain_l/internal/node"
+	"taraskrasiuk/blockchain_l/internal/p2p"
+	"time"
+)
+
+var (
+	ErrUnknownPeer = errors.New("there is no node at the address")
+	ErrPartitioned = errors.New("the peer is in another partition")
+	ErrLost        = errors.New("the message is lost")
+)
+
+// message is an announcement in flight, delivered at the simulated time.
+type message struct {
+	at  time.Time
+	seq uint64
+	// the sending and the receiving node
+	from, to int
+	deliver  func(n *node.Node) error
+}
+
+// messageQueue orders the messages by the delivery time, then by the order they were sent.
+type messageQueue []*message
+
+func (q messageQueue) Len() int { return len(q) }
+func (q messageQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+func (q messageQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *messageQueue) Push(x any)   { *q = append(*q, x.(*message)) }
+func (q *messageQueue) Pop() any {
+	old := *q
+	m := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return m
+}
+
+// endpoint is the transport of a single node. The requests are answered right away, the announcements
+// are delivered after the latency of the link. Both are lost with the loss probability of the network.
+type endpoint struct {
+	net  *Network
+	from int
+}
+
+// Resolve the peer's node and pass the request through the link. The request and the response
+// are serialized, as they would be on the wire.
+func (e *endpoint) request(peer node.PeerNode, call func(n *node.Node) (any, error), res any) error {
+	to, err := e.net.link(e.from, peer)
+	if err != nil {
+		return err
+	}
+	v, err := call(e.net.nodes[to])
+	if err != nil {
+		return err
+	}
+	return roundTrip(v, res)
+}
+
+func (e *endpoint) Status(ctx context.Context, peer node.PeerNode) (node.GetPeerNodeStatusResponse, error) {
+	var res node.GetPeerNodeStatusResponse
+	err := e.request(peer, func(n *node.Node) (any, error) {
+		status := n.ViewNodeStatus()
+		return node.GetPeerNodeStatusResponse{
+			NodeID:      status.NodeID,
+			BlockHash:   status.BlockHash,
+			BlockNumber: status.BlockNumber,
+			KnownPeers:  status.KnownPeers,
+			PendingTXs:  status.PendingTXs,
+		}, nil
+	}, &res)
+	return res, err
+}
+
+func (e *endpoint) Headers(ctx context.Context, peer node.PeerNode, lastBlockHash database.Hash, locator []database.Hash, limit int) (node.GetNodeHeadersResponse, error) {
+	var res node.GetNodeHeadersResponse
+	err := e.request(peer, func(n *node.Node) (any, error) {
+		return n.ViewSyncHeaders(lastBlockHash, locator, limit)
+	}, &res)
+	return res, err
+}
+
+func (e *endpoint) Blocks(ctx context.Context, peer node.PeerNode, lastBlockHash database.Hash, limit int) (node.GetNodeBlocksResponse, error) {
+	var res node.GetNodeBlocksResponse
+	err := e.request(peer, func(n *node.Node) (any, error) {
+		return n.ViewSyncBlocks(lastBlockHash, limit)
+	}, &res)
+	return res, err
+}
+
+func (e *endpoint) Join(ctx context.Context, peer node.PeerNode, req p2p.JoinRequest, sig string) error {
+	var res struct{}
+	return e.request(peer, func(n *node.Node) (any, error) {
+		_, err := n.AcceptJoin(req, sig)
+		return res, err
+	}, &res)
+}
+
+func (e *endpoint) AnnounceBlock(peer node.PeerNode, req node.AnnounceBlockReq) error {
+	var sent node.AnnounceBlockReq
+	if err := roundTrip(req, &sent); err != nil {
+		return err
+	}
+	return e.net.send(e.from, peer, func(n *node.Node) error {
+		return n.HandleAnnouncedBlock(sent.Block, sent.From)
+	})
+}
+
+func (e *endpoint) AnnounceTX(peer node.PeerNode, req node.AnnounceTxReq) error {
+	var sent node.AnnounceTxReq
+	if err := roundTrip(req, &sent); err != nil {
+		return err
+	}
+	return e.net.send(e.from, peer, func(n *node.Node) error {
+		return n.HandleAnnouncedTX(sent.Tx, sent.From)
+	})
+}
+
+// Pass the value through JSON, the way it's sent between the nodes.
+func roundTrip(v, res any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding the message: %w", err)
+	}
+	if err := json.Unmarshal(data, res); err != nil {
+		return fmt.Errorf("decoding the message: %w", err)
+	}
+	return nil
+}